@@ -0,0 +1,201 @@
+package main
+
+import (
+	"encoding/json"
+	"fmt"
+	"os"
+	"sort"
+	"strings"
+
+	"github.com/hyperledger/fabric-contract-api-go/contractapi"
+)
+
+// roleAttribute is the attribute of the client's certificate holding its role, e.g. role=shipper
+const roleAttribute = "role"
+
+// permissionsEnv enables the checks of client roles, either with the default permission matrix if it is set to
+// defaultPermissionsValue, or with a JSON object mapping function names to the roles allowed to call them.
+// Enforcement is opt-in: roles are not checked at all if it is not set, so that clients enrolled without a role
+// attribute keep working.
+const permissionsEnv = "CHAINCODE_PERMISSIONS"
+
+// defaultPermissionsValue is the value of CHAINCODE_PERMISSIONS enabling the default permission matrix
+const defaultPermissionsValue = "default"
+
+// Roles of the default permission matrix
+const (
+	roleAdmin    = "admin"    // every transaction
+	roleProducer = "producer" // creates, splits, assembles and describes commodities
+	roleShipper  = "shipper"  // hands over commodities
+	roleReceiver = "receiver" // takes over commodities
+	roleQuality  = "quality"  // recalls commodities
+)
+
+// PermissionMatrix maps contract functions to the roles allowed to call them.
+// Queries that are not listed can be called by every client, other functions that are not listed by none.
+type PermissionMatrix map[string][]string
+
+// knownRoles are the roles that a permission matrix may allow
+var knownRoles = []string{roleAdmin, roleProducer, roleShipper, roleReceiver, roleQuality}
+
+// queryFunctions are the read-only functions of the contract, which every client may call unless the permission
+// matrix lists them
+var queryFunctions = []string{
+	"CompareTerms",
+	"GetBillOfMaterials",
+	"GetCommodityDownstreamKey",
+	"GetCommodityHashId",
+	"GetCommodityPrivateProperties",
+	"GetCommodityStatus",
+	"GetCommodityUpstreamKey",
+	"GetCustodyChain",
+	"GetDetailedInformation",
+	"GetDisclosedProperties",
+	"GetEndorsementPolicy",
+	"GetOrgRole",
+	"GetRecall",
+	"GetReceipt",
+	"GetRetirementReceipt",
+	"GetRouteProgress",
+	"GetTermsHistory",
+	"GetTokenBalance",
+	"QueryCommodities",
+	"QueryCommoditiesByOwner",
+	"QueryCommoditiesBySource",
+	"QueryCommodityGetAgreements",
+	"QueryCommodityGetAgreementsWithPagination",
+	"QueryCommodityHistory",
+	"QueryCommodityHistoryWithPagination",
+	"QueryCommodityPutAgreements",
+	"QueryCommodityPutAgreementsWithPagination",
+	"QueryDisclosures",
+	"QueryGetReceipts",
+	"QueryPutReceipts",
+	"QueryRecalledCommodities",
+	"ReadCommodity",
+	"VerifyCommodityProperties",
+	"VerifyDisclosedProperties",
+}
+
+// defaultPermissions is the permission matrix used when CHAINCODE_PERMISSIONS is set to default
+var defaultPermissions = PermissionMatrix{
+	"CreateAsset":                 {roleAdmin, roleProducer},
+	"CreateAssetWithEndorsers":    {roleAdmin, roleProducer},
+	"SetCommodityEndorsers":       {roleAdmin, roleProducer},
+	"SplitCommodity":              {roleAdmin, roleProducer},
+	"AssembleCommodity":           {roleAdmin, roleProducer},
+	"ChangePublicDescription":     {roleAdmin, roleProducer},
+	"SetDetailedInformation":      {roleAdmin, roleProducer},
+	"ShareDetailedInformation":    {roleAdmin, roleProducer, roleShipper},
+	"DiscloseCommodityProperties": {roleAdmin, roleProducer, roleQuality},
+	"AmendRoute":                  {roleAdmin, roleShipper},
+	"AgreeToPut":                  {roleAdmin, roleShipper},
+	"CancelPutAgreement":          {roleAdmin, roleShipper},
+	"TransferCommodity":           {roleAdmin, roleShipper},
+	"ShipCommodity":               {roleAdmin, roleShipper},
+	"ConfirmReceipt":              {roleAdmin, roleReceiver},
+	"RaiseTransitDispute":         {roleAdmin, roleShipper, roleReceiver},
+	"CancelShipment":              {roleAdmin, roleShipper},
+	"AgreeToGet":                  {roleAdmin, roleReceiver},
+	"ProposeTerms":                {roleAdmin, roleShipper, roleReceiver},
+	"CancelGetAgreement":          {roleAdmin, roleReceiver},
+	"PurgeExpiredAgreements":      {roleAdmin, roleShipper, roleReceiver},
+	"IssueRecall":                 {roleAdmin, roleQuality},
+	"RetireCommodity":             {roleAdmin, roleProducer, roleReceiver},
+	"MigrateCommodityStatuses":    {roleAdmin},
+	"SetOrgRole":                  {roleAdmin},
+	"InitOrgRoles":                {roleAdmin},
+	"MintTokens":                  {roleAdmin},
+	"TransferTokens":              {roleAdmin, roleReceiver},
+}
+
+// AuthorizationError is returned whenever a client is denied a transaction, either because of its org or of its role
+type AuthorizationError struct {
+	ClientOrg string
+	Role      string // Role is only set when the client was denied because of its role
+	Action    string
+}
+
+func (e *AuthorizationError) Error() string {
+	if e.Role != "" {
+		return fmt.Sprintf("a client from %s with role %q cannot %s", e.ClientOrg, e.Role, e.Action)
+	}
+	return fmt.Sprintf("a client from %s cannot %s", e.ClientOrg, e.Action)
+}
+
+// GetBeforeTransaction makes the contract api check the role of the client before every transaction
+func (s *SmartContract) GetBeforeTransaction() interface{} {
+	return s.authorizeRole
+}
+
+// authorizeRole checks that the role of the client is allowed to call the invoked function by the permission matrix.
+// Roles are not checked when the contract has no permission matrix, functions that it does not list are denied
+// unless they are queries.
+func (s *SmartContract) authorizeRole(ctx contractapi.TransactionContextInterface) error {
+	if s.Permissions == nil {
+		return nil
+	}
+
+	// The function is prefixed with the contract name when the client names it, e.g. SmartContract:TransferCommodity
+	function, _ := ctx.GetStub().GetFunctionAndParameters()
+	function = function[strings.LastIndex(function, ":")+1:]
+
+	allowedRoles, ok := s.Permissions[function]
+	if !ok && indexOf(queryFunctions, function) >= 0 {
+		return nil
+	}
+
+	role, _, err := ctx.GetClientIdentity().GetAttributeValue(roleAttribute)
+	if err != nil {
+		return fmt.Errorf("failed to get the role of the client: %v", err)
+	}
+	if indexOf(allowedRoles, role) >= 0 {
+		return nil
+	}
+
+	clientOrgID, err := getClientOrgID(ctx)
+	if err != nil {
+		return err
+	}
+	if !ok {
+		return &AuthorizationError{ClientOrg: clientOrgID, Action: fmt.Sprintf("call %s, which the permission matrix does not list", function)}
+	}
+	if role == "" {
+		return &AuthorizationError{ClientOrg: clientOrgID, Action: fmt.Sprintf("call %s without a %q attribute", function, roleAttribute)}
+	}
+	return &AuthorizationError{ClientOrg: clientOrgID, Role: role, Action: fmt.Sprintf("call %s, allowed roles are %s", function, strings.Join(allowedRoles, ", "))}
+}
+
+// permissionsFromEnv returns the permission matrix configured by CHAINCODE_PERMISSIONS, or nil if it is not set.
+// A configured matrix may only name functions of the contract and known roles, so that a typo cannot go unnoticed.
+func permissionsFromEnv() (PermissionMatrix, error) {
+	value := os.Getenv(permissionsEnv)
+	switch value {
+	case "":
+		return nil, nil
+	case defaultPermissionsValue:
+		return defaultPermissions, nil
+	}
+
+	var permissions PermissionMatrix
+	err := json.Unmarshal([]byte(value), &permissions)
+	if err != nil {
+		return nil, fmt.Errorf("invalid %s: %v", permissionsEnv, err)
+	}
+	functions := make([]string, 0, len(permissions))
+	for function := range permissions {
+		functions = append(functions, function)
+	}
+	sort.Strings(functions)
+	for _, function := range functions {
+		if _, ok := defaultPermissions[function]; !ok && indexOf(queryFunctions, function) < 0 {
+			return nil, fmt.Errorf("invalid %s: unknown function %s", permissionsEnv, function)
+		}
+		for _, role := range permissions[function] {
+			if indexOf(knownRoles, role) < 0 {
+				return nil, fmt.Errorf("invalid %s: unknown role %q for function %s, known roles are %s", permissionsEnv, role, function, strings.Join(knownRoles, ", "))
+			}
+		}
+	}
+	return permissions, nil
+}
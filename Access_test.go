@@ -0,0 +1,125 @@
+package main
+
+import (
+	"errors"
+	"reflect"
+	"testing"
+
+	"SupplyChainTrackingChaincode/chaincodetest"
+
+	"github.com/hyperledger/fabric-contract-api-go/contractapi"
+)
+
+func TestAuthorizeRole(t *testing.T) {
+	ledger := chaincodetest.NewLedger()
+	s := newContract()
+	s.Permissions = defaultPermissions
+
+	shipper := chaincodetest.Identity{MSPID: org1MSP, Attributes: map[string]string{"role": "shipper"}}
+	clerk := chaincodetest.Identity{MSPID: org1MSP, Attributes: map[string]string{"role": "clerk"}}
+
+	for _, test := range []struct {
+		client   chaincodetest.Identity
+		function string
+		allowed  bool
+	}{
+		{shipper, "TransferCommodity", true},
+		{shipper, "SmartContract:TransferCommodity", true},
+		{clerk, "TransferCommodity", false},
+		{org1Client, "TransferCommodity", false},
+		{shipper, "CreateAsset", false},
+		{clerk, "ReadCommodity", true},
+		{org1Client, "QueryCommodityHistory", true},
+	} {
+		ctx := ledger.NewTransaction(test.client).WithFunction(test.function)
+		err := s.authorizeRole(ctx)
+		if test.allowed && err != nil {
+			t.Errorf("%s by %v: %v", test.function, test.client.Attributes, err)
+		}
+		var denied *AuthorizationError
+		if !test.allowed && !errors.As(err, &denied) {
+			t.Errorf("%s by %v: err = %v, want an AuthorizationError", test.function, test.client.Attributes, err)
+		}
+	}
+
+	// Mutating functions that a configured matrix does not list are denied, queries are not
+	s.Permissions = PermissionMatrix{"CreateAsset": {roleProducer}}
+	for function, allowed := range map[string]bool{"TransferCommodity": false, "ReadCommodity": true} {
+		ctx := ledger.NewTransaction(shipper).WithFunction(function)
+		if err := s.authorizeRole(ctx); (err == nil) != allowed {
+			t.Errorf("%s not listed in the matrix: err = %v", function, err)
+		}
+	}
+
+	// Without a permission matrix only orgs are checked
+	ctx := ledger.NewTransaction(clerk).WithFunction("TransferCommodity")
+	if err := newContract().authorizeRole(ctx); err != nil {
+		t.Errorf("authorizeRole without permissions: %v", err)
+	}
+}
+
+func TestOrgDenialIsAuthorizationError(t *testing.T) {
+	ledger := chaincodetest.NewLedger()
+	commodityID := createCommodity(t, ledger, org1Client, palletProperties)
+	agree(t, ledger, org1Client, org2Client, commodityID, palletProperties, transferKeyOf(commodityID))
+
+	_, err := transfer(ledger, org2Client, org2MSP, commodityID, transferKeyOf(commodityID))
+	var denied *AuthorizationError
+	if !errors.As(err, &denied) || denied.ClientOrg != org2MSP || denied.Role != "" {
+		t.Errorf("err = %v, want an AuthorizationError of %s", err, org2MSP)
+	}
+}
+
+func TestPeerOrgDenialIsAuthorizationError(t *testing.T) {
+	ledger := chaincodetest.NewLedger()
+
+	ctx := ledger.NewTransaction(org1Client).OnPeer(org2MSP)
+	_, err := newContract().GetTermsHistory(ctx, "any")
+	var denied *AuthorizationError
+	if !errors.As(err, &denied) || denied.ClientOrg != org1MSP {
+		t.Errorf("err = %v, want an AuthorizationError of %s", err, org1MSP)
+	}
+}
+
+func TestPermissionsFromEnvAreOptIn(t *testing.T) {
+	t.Setenv(permissionsEnv, "")
+	if permissions, err := permissionsFromEnv(); err != nil || permissions != nil {
+		t.Errorf("permissions without %s = %v, %v, want none", permissionsEnv, permissions, err)
+	}
+
+	t.Setenv(permissionsEnv, "default")
+	if permissions, err := permissionsFromEnv(); err != nil || len(permissions) != len(defaultPermissions) {
+		t.Errorf("default permissions = %v, %v", permissions, err)
+	}
+
+	t.Setenv(permissionsEnv, `{"TransferCommodity":["shipper"]}`)
+	if permissions, err := permissionsFromEnv(); err != nil || len(permissions) != 1 {
+		t.Errorf("configured permissions = %v, %v", permissions, err)
+	}
+
+	for _, value := range []string{
+		"shipper",
+		`{"TransferComodity":["shipper"]}`,
+		`{"TransferCommodity":["shiper"]}`,
+	} {
+		t.Setenv(permissionsEnv, value)
+		if _, err := permissionsFromEnv(); err == nil {
+			t.Errorf("invalid permissions %s were accepted", value)
+		}
+	}
+}
+
+func TestEveryTransactionIsAQueryOrInTheDefaultPermissions(t *testing.T) {
+	contract := reflect.TypeOf(&contractapi.Contract{})
+	smartContract := reflect.TypeOf(newContract())
+	for i := 0; i < smartContract.NumMethod(); i++ {
+		name := smartContract.Method(i).Name
+		if _, ok := contract.MethodByName(name); ok || name == "GetBeforeTransaction" {
+			continue
+		}
+		_, listed := defaultPermissions[name]
+		if query := indexOf(queryFunctions, name) >= 0; listed == query {
+			t.Errorf("%s must either be a query or be listed in the default permissions", name)
+		}
+	}
+}
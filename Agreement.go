@@ -0,0 +1,150 @@
+package main
+
+import (
+	"encoding/json"
+	"fmt"
+	"math"
+	"sort"
+	"strings"
+	"time"
+)
+
+// agreementSchemaVersion is the version of the commodity_transferKey payload new agreements must use.
+// Version 1 agreements have no "version" member and an integer transferKey, version 2 agreements do not name the putter
+// and getter orgs. They can no longer be agreed on, but those stored before version 3 can still be used to transfer
+// their commodity.
+const agreementSchemaVersion = 3
+
+// minTransferKeyEntropyBits is the least estimated entropy of the transferKey of a new agreement.
+// 64 random hex digits, i.e. 32 random bytes, are estimated well above it, while shorter keys may fall below it.
+const minTransferKeyEntropyBits = 96
+
+// Agreement is the transferKey both upstream and downstream companies agree on, an empty Expires never expires
+type Agreement struct {
+	Version     int         `json:"version,omitempty"` // Version is the agreement schema version, 0 for version 1 agreements
+	ID          string      `json:"commodity"`
+	TransferKey TransferKey `json:"transferKey"`
+	TransferID  string      `json:"transfer_id"`
+	Expires     time.Time   `json:"expires"`
+	PutterOrg   string      `json:"putter,omitempty"` // PutterOrg and GetterOrg are the companies of the transfer, empty before version 3
+	GetterOrg   string      `json:"getter,omitempty"`
+}
+
+// TransferKey is the secret of an agreement, a high-entropy string.
+// The integer keys of version 1 agreements are kept as their decimal representation.
+type TransferKey string
+
+// UnmarshalJSON accepts the string keys of current agreements and the integer keys of version 1 agreements
+func (key *TransferKey) UnmarshalJSON(data []byte) error {
+	if kindOfJSON(data) == jsonNumber {
+		var number json.Number
+		err := json.Unmarshal(data, &number)
+		if err != nil {
+			return err
+		}
+		*key = TransferKey(number.String())
+		return nil
+	}
+
+	var value string
+	err := json.Unmarshal(data, &value)
+	if err != nil {
+		return fmt.Errorf("transferKey must be a string: %v", err)
+	}
+	*key = TransferKey(value)
+	return nil
+}
+
+// expiredAt tells whether the agreement can no longer be used to transfer the commodity at time t
+func (agreement Agreement) expiredAt(t time.Time) bool {
+	return !agreement.Expires.IsZero() && !t.Before(agreement.Expires)
+}
+
+// counterparty returns the org on the other side of an agreement of the given type, empty if the agreement does not name it
+func (agreement Agreement) counterparty(agreementType string) string {
+	if agreementType == typeCommodityKey {
+		return agreement.PutterOrg
+	}
+	return agreement.GetterOrg
+}
+
+// parseAgreement unmarshals the commodity_transferKey of a transfer of commodityID, which may be an agreement of any version
+func parseAgreement(agreementJSON []byte, commodityID string) (*Agreement, error) {
+	var agreement Agreement
+	err := json.Unmarshal(agreementJSON, &agreement)
+	if err != nil {
+		return nil, &InvalidTransientValueError{Key: commodityTransferKeyInput.key, Reason: err.Error()}
+	}
+	if agreement.Version > agreementSchemaVersion {
+		return nil, &InvalidTransientValueError{Key: commodityTransferKeyInput.key,
+			Reason: fmt.Sprintf("unknown agreement version %d, the latest is %d", agreement.Version, agreementSchemaVersion)}
+	}
+	if agreement.ID != commodityID {
+		return nil, &InvalidTransientValueError{Key: commodityTransferKeyInput.key,
+			Reason: fmt.Sprintf("agreement is about commodity %q, not %s", agreement.ID, commodityID)}
+	}
+
+	return &agreement, nil
+}
+
+// parseNewAgreement unmarshals the commodity_transferKey of an agreement to put or get commodityID,
+// which must follow the current agreement schema
+func parseNewAgreement(agreementJSON []byte, commodityID string) (*Agreement, error) {
+	agreement, err := parseAgreement(agreementJSON, commodityID)
+	if err != nil {
+		return nil, err
+	}
+
+	if agreement.Version != agreementSchemaVersion {
+		return nil, &InvalidTransientValueError{Key: commodityTransferKeyInput.key,
+			Reason: fmt.Sprintf("agreement version must be %d", agreementSchemaVersion)}
+	}
+	if kindOfJSON(rawMember(agreementJSON, "transferKey")) != jsonString {
+		return nil, &InvalidTransientValueError{Key: commodityTransferKeyInput.key, Reason: "transferKey must be a string"}
+	}
+	if strings.TrimSpace(agreement.TransferID) == "" {
+		return nil, &InvalidTransientValueError{Key: commodityTransferKeyInput.key, Reason: "transfer_id must not be empty"}
+	}
+	if bits := estimateEntropyBits(string(agreement.TransferKey)); bits < minTransferKeyEntropyBits {
+		return nil, &InvalidTransientValueError{Key: commodityTransferKeyInput.key,
+			Reason: fmt.Sprintf("transferKey is too easy to guess, about %.0f bits of entropy where %d are needed", bits, minTransferKeyEntropyBits)}
+	}
+	if agreement.PutterOrg == "" || agreement.GetterOrg == "" {
+		return nil, &InvalidTransientValueError{Key: commodityTransferKeyInput.key, Reason: "putter and getter must not be empty"}
+	}
+	if agreement.PutterOrg == agreement.GetterOrg {
+		return nil, &InvalidTransientValueError{Key: commodityTransferKeyInput.key, Reason: "putter and getter must be different orgs"}
+	}
+
+	return agreement, nil
+}
+
+// rawMember returns a member of a JSON object as is, or nil if it is missing
+func rawMember(objectJSON []byte, member string) json.RawMessage {
+	var members map[string]json.RawMessage
+	if json.Unmarshal(objectJSON, &members) != nil {
+		return nil
+	}
+	return members[member]
+}
+
+// estimateEntropyBits estimates the entropy of a secret from the frequency of its characters.
+// It can only tell that a secret is weak, e.g. short or repetitive, not that it was randomly generated.
+// The characters are summed up in sorted order, as floating-point sums depend on their order and every peer
+// must come to the same estimate.
+func estimateEntropyBits(secret string) float64 {
+	runes := []rune(secret)
+	sort.Slice(runes, func(i, j int) bool { return runes[i] < runes[j] })
+
+	bitsPerCharacter := 0.0
+	for i := 0; i < len(runes); {
+		count := 1
+		for i+count < len(runes) && runes[i+count] == runes[i] {
+			count++
+		}
+		p := float64(count) / float64(len(runes))
+		bitsPerCharacter -= p * math.Log2(p)
+		i += count
+	}
+	return bitsPerCharacter * float64(len(runes))
+}
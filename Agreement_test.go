@@ -0,0 +1,142 @@
+package main
+
+import (
+	"crypto/rand"
+	"encoding/hex"
+	"errors"
+	"fmt"
+	"strings"
+	"testing"
+
+	"SupplyChainTrackingChaincode/chaincodetest"
+)
+
+func TestAgreeToPutValidatesAgreement(t *testing.T) {
+	ledger := chaincodetest.NewLedger()
+	s := newContract()
+	commodityID := createCommodity(t, ledger, org1Client, palletProperties)
+	secret := secretOf(commodityID)
+
+	for name, test := range map[string]struct {
+		agreement string
+		reason    string
+	}{
+		"another commodity":  {fmt.Sprintf(`{"version":3,"commodity":"other","transferKey":%q,"transfer_id":"t1"}`, secret), "not " + commodityID},
+		"no transfer id":     {fmt.Sprintf(`{"version":3,"commodity":%q,"transferKey":%q}`, commodityID, secret), "transfer_id"},
+		"blank transfer id":  {fmt.Sprintf(`{"version":3,"commodity":%q,"transferKey":%q,"transfer_id":" "}`, commodityID, secret), "transfer_id"},
+		"version 1":          {fmt.Sprintf(`{"commodity":%q,"transferKey":42,"transfer_id":"t1"}`, commodityID), "version must be 3"},
+		"integer key":        {fmt.Sprintf(`{"version":3,"commodity":%q,"transferKey":42,"transfer_id":"t1"}`, commodityID), "must be a string"},
+		"weak key":           {fmt.Sprintf(`{"version":3,"commodity":%q,"transferKey":"password1234","transfer_id":"t1"}`, commodityID), "too easy to guess"},
+		"repetitive key":     {fmt.Sprintf(`{"version":3,"commodity":%q,"transferKey":%q,"transfer_id":"t1"}`, commodityID, strings.Repeat("ab", 40)), "too easy to guess"},
+		"unknown version":    {fmt.Sprintf(`{"version":4,"commodity":%q,"transferKey":%q,"transfer_id":"t1"}`, commodityID, secret), "unknown agreement version"},
+		"transfer id number": {fmt.Sprintf(`{"version":3,"commodity":%q,"transferKey":%q,"transfer_id":1}`, commodityID, secret), "transfer_id"},
+		"version 2":          {fmt.Sprintf(`{"version":2,"commodity":%q,"transferKey":%q,"transfer_id":"t1"}`, commodityID, secret), "version must be 3"},
+		"no getter":          {fmt.Sprintf(`{"version":3,"commodity":%q,"transferKey":%q,"transfer_id":"t1","putter":"Org1MSP"}`, commodityID, secret), "getter"},
+		"same orgs":          {fmt.Sprintf(`{"version":3,"commodity":%q,"transferKey":%q,"transfer_id":"t1","putter":"Org1MSP","getter":"Org1MSP"}`, commodityID, secret), "different"},
+		"other putter":       {fmt.Sprintf(`{"version":3,"commodity":%q,"transferKey":%q,"transfer_id":"t1","putter":"Org2MSP","getter":"Org3MSP"}`, commodityID, secret), "owned by"},
+	} {
+		ctx := ledger.NewTransaction(org1Client).WithTransient("commodity_transferKey", []byte(test.agreement))
+		err := s.AgreeToPut(ctx, commodityID)
+		var invalid *InvalidTransientValueError
+		if !errors.As(err, &invalid) || !strings.Contains(err.Error(), test.reason) {
+			t.Errorf("%s: err = %v, want an InvalidTransientValueError about %s", name, err, test.reason)
+		}
+	}
+}
+
+func TestVersion1AgreementCanStillBeTransferred(t *testing.T) {
+	ledger := chaincodetest.NewLedger()
+	s := newContract()
+	commodityID := createCommodity(t, ledger, org1Client, palletProperties)
+	legacyAgreement := []byte(fmt.Sprintf(`{"commodity":%q,"transferKey":42,"transfer_id":"transfer-1"}`, commodityID))
+
+	// Store the agreements as AgreeToPut and AgreeToGet did before agreements were versioned
+	for _, party := range []struct {
+		client        chaincodetest.Identity
+		agreementType string
+	}{
+		{org1Client, typeCommodityForTransfer},
+		{org2Client, typeCommodityKey},
+	} {
+		ctx := ledger.NewTransaction(party.client)
+		collection := buildCollectionName(party.client.MSPID)
+		agreementKey, err := ctx.Stub().CreateCompositeKey(party.agreementType, []string{commodityID})
+		if err != nil {
+			t.Fatal(err)
+		}
+		if err = ctx.Stub().PutPrivateData(collection, agreementKey, legacyAgreement); err != nil {
+			t.Fatal(err)
+		}
+		if err = ctx.Stub().PutPrivateData(collection, commodityID, []byte(palletProperties)); err != nil {
+			t.Fatal(err)
+		}
+		if err = ctx.Commit(); err != nil {
+			t.Fatalf("commit legacy agreement: %v", err)
+		}
+	}
+
+	agreements, err := s.QueryCommodityPutAgreements(ledger.NewTransaction(org1Client))
+	if err != nil || len(agreements) != 1 || agreements[0].TransferKey != "42" || agreements[0].Version != 0 {
+		t.Errorf("legacy put agreements = %+v, %v", agreements, err)
+	}
+
+	ctx, err := transfer(ledger, org1Client, org2MSP, commodityID, legacyAgreement)
+	if err != nil {
+		t.Fatalf("TransferCommodity with a version 1 agreement: %v", err)
+	}
+	receipt, err := s.GetReceipt(ledger.NewTransaction(org2Client), commodityID, ctx.GetStub().GetTxID())
+	if err != nil || receipt.TransferKey != "42" {
+		t.Errorf("GetReceipt = %+v, %v", receipt, err)
+	}
+}
+
+func TestAgreementNamesItsCompanies(t *testing.T) {
+	ledger := chaincodetest.NewLedger()
+	s := newContract()
+	commodityID := createCommodity(t, ledger, org1Client, palletProperties)
+
+	ctx := ledger.NewTransaction(org3Client).
+		WithTransient("commodity_properties", []byte(palletProperties)).
+		WithTransient("commodity_transferKey", transferKeyOf(commodityID))
+	var invalid *InvalidTransientValueError
+	if err := s.AgreeToGet(ctx, commodityID); !errors.As(err, &invalid) || !strings.Contains(err.Error(), "as getter") {
+		t.Errorf("AgreeToGet by an org the agreement does not name: err = %v, want an InvalidTransientValueError", err)
+	}
+}
+
+func TestAgreeToPutAcceptsRandomKeys(t *testing.T) {
+	ledger := chaincodetest.NewLedger()
+	s := newContract()
+	commodityID := createCommodity(t, ledger, org1Client, palletProperties)
+
+	// The documented format of transferKey, 64 random hex digits
+	for i := 0; i < 100; i++ {
+		secret := make([]byte, 32)
+		if _, err := rand.Read(secret); err != nil {
+			t.Fatal(err)
+		}
+		transferKey := fmt.Sprintf(`{"version":3,"commodity":%q,"transferKey":%q,"transfer_id":"t1","putter":%q,"getter":%q}`,
+			commodityID, hex.EncodeToString(secret), org1MSP, org2MSP)
+
+		ctx := ledger.NewTransaction(org1Client).WithTransient("commodity_transferKey", []byte(transferKey))
+		if err := s.AgreeToPut(ctx, commodityID); err != nil {
+			t.Fatalf("AgreeToPut with the random key %x: %v", secret, err)
+		}
+	}
+}
+
+func TestEstimateEntropyBitsIsDeterministic(t *testing.T) {
+	secret := string(secretOf("commodity"))
+	want := estimateEntropyBits(secret)
+	for i := 0; i < 100; i++ {
+		if bits := estimateEntropyBits(secret); bits != want {
+			t.Fatalf("estimateEntropyBits = %v, then %v", want, bits)
+		}
+	}
+	if bits := estimateEntropyBits(strings.Repeat("a", 64)); bits != 0 {
+		t.Errorf("estimateEntropyBits of a single repeated character = %v, want 0", bits)
+	}
+	if bits := estimateEntropyBits("abcd"); bits != 8 {
+		t.Errorf("estimateEntropyBits(abcd) = %v, want 8", bits)
+	}
+}
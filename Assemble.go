@@ -0,0 +1,198 @@
+package main
+
+import (
+	"crypto/sha256"
+	"encoding/hex"
+	"fmt"
+	"strings"
+
+	"github.com/hyperledger/fabric-contract-api-go/contractapi"
+)
+
+// BillOfMaterialsItem is a component of an assembled commodity, either directly or through the components it is assembled from
+type BillOfMaterialsItem struct {
+	CommodityID       string `json:"commodityID"`
+	AssemblyID        string `json:"assemblyID"` // AssemblyID is the commodity this item is a direct component of
+	Depth             int    `json:"depth"`      // Depth is 1 for the direct components of the queried commodity
+	OwnerOrg          string `json:"ownerCompany"`
+	PublicDescription string `json:"publicDescription"`
+}
+
+// BillOfMaterials lists every component of an assembled commodity, depth first
+type BillOfMaterials struct {
+	CommodityID string                `json:"commodityID"`
+	Items       []BillOfMaterialsItem `json:"items"`
+}
+
+// AssembleCommodity consumes commodities owned by the client's org and creates the commodity assembled from them.
+// components is a comma separated list of the consumed commodities, the properties of the assembled commodity are passed
+// by transient field like for CreateAsset and its id is their hash. target is the planned route of the assembled commodity.
+func (s *SmartContract) AssembleCommodity(ctx contractapi.TransactionContextInterface, components string, target string, publicDescription string) (string, error) {
+	componentIDs, err := parseCommodityIDs(components)
+	if err != nil {
+		return "", err
+	}
+
+	route, err := parseRoute(target)
+	if err != nil {
+		return "", err
+	}
+
+	clientOrgID, err := getClientOrgID(ctx)
+	if err != nil {
+		return "", err
+	}
+
+	// Commodity properties must be retrieved from the transient field as they are private
+	immutablePropertiesJSON, err := getTransientInput(ctx, commodityPropertiesInput)
+	if err != nil {
+		return "", err
+	}
+
+	hash := sha256.New()
+	hash.Write(immutablePropertiesJSON)
+	commodityID := hex.EncodeToString(hash.Sum(nil))
+
+	err = verifyCommodityDoesNotExist(ctx, commodityID)
+	if err != nil {
+		return "", err
+	}
+
+	var consumed []*Commodity
+	for _, componentID := range componentIDs {
+		component, err := s.ReadCommodity(ctx, componentID)
+		if err != nil {
+			return "", fmt.Errorf("failed to get component: %v", err)
+		}
+
+		// Auth check to ensure that client's org actually owns every component
+		if clientOrgID != component.OwnerOrg {
+			return "", &AuthorizationError{ClientOrg: clientOrgID, Action: fmt.Sprintf("assemble a component owned by %s", component.OwnerOrg)}
+		}
+
+		err = transitionStatus(ctx, component, statusConsumed)
+		if err != nil {
+			return "", err
+		}
+
+		component.AssembledInto = commodityID
+		component.Consumed = true
+		err = putCommodity(ctx, component)
+		if err != nil {
+			return "", err
+		}
+		consumed = append(consumed, component)
+	}
+
+	// The properties of the assembled commodity are only written to the owner's collection, so the peers of the
+	// endorsers of the components can endorse too
+	_, err = s.verifyPeerEndorsesCommodities(ctx, clientOrgID, consumed...)
+	if err != nil {
+		return "", err
+	}
+
+	commodity := &Commodity{
+		ObjectType:        "Commodity",
+		ID:                commodityID,
+		OwnerOrg:          clientOrgID,
+		Source:            clientOrgID,
+		Target:            routeDestination(route),
+		Route:             route,
+		PublicDescription: publicDescription,
+		Components:        componentIDs,
+		Status:            statusCreated,
+	}
+	err = putCommodity(ctx, commodity)
+	if err != nil {
+		return "", err
+	}
+
+	err = setCommodityStateBasedEndorsement(ctx, commodity)
+	if err != nil {
+		return "", fmt.Errorf("failed setting state based endorsement for assembled commodity: %v", err)
+	}
+
+	err = ctx.GetStub().PutPrivateData(buildCollectionName(clientOrgID), commodityID, immutablePropertiesJSON)
+	if err != nil {
+		return "", fmt.Errorf("failed to put Commodity private details: %v", err)
+	}
+
+	err = setCommodityEvent(ctx, eventCommodityAssembled, CommodityEvent{CommodityID: commodityID, OwnerOrg: clientOrgID, RelatedCommodityIDs: componentIDs})
+	if err != nil {
+		return "", err
+	}
+
+	return commodityID, nil
+}
+
+// GetBillOfMaterials returns the components of a commodity, the components of those components and so on
+func (s *SmartContract) GetBillOfMaterials(ctx contractapi.TransactionContextInterface, commodityID string) (*BillOfMaterials, error) {
+	commodity, err := s.ReadCommodity(ctx, commodityID)
+	if err != nil {
+		return nil, fmt.Errorf("failed to get commodity: %v", err)
+	}
+
+	bom := &BillOfMaterials{CommodityID: commodityID}
+	err = s.addBillOfMaterialsItems(ctx, bom, commodity, 1, map[string]bool{commodityID: true})
+	if err != nil {
+		return nil, err
+	}
+
+	return bom, nil
+}
+
+// addBillOfMaterialsItems appends the components of an assembly to the bill of materials, each followed by its own components
+func (s *SmartContract) addBillOfMaterialsItems(ctx contractapi.TransactionContextInterface, bom *BillOfMaterials, assembly *Commodity, depth int, listed map[string]bool) error {
+	for _, componentID := range assembly.Components {
+		if listed[componentID] {
+			continue
+		}
+		listed[componentID] = true
+
+		component, err := s.ReadCommodity(ctx, componentID)
+		if err != nil {
+			return fmt.Errorf("failed to get component of %s: %v", assembly.ID, err)
+		}
+
+		bom.Items = append(bom.Items, BillOfMaterialsItem{
+			CommodityID:       componentID,
+			AssemblyID:        assembly.ID,
+			Depth:             depth,
+			OwnerOrg:          component.OwnerOrg,
+			PublicDescription: component.PublicDescription,
+		})
+
+		err = s.addBillOfMaterialsItems(ctx, bom, component, depth+1, listed)
+		if err != nil {
+			return err
+		}
+	}
+
+	return nil
+}
+
+// parseCommodityIDs splits a comma separated list of distinct commodity ids
+func parseCommodityIDs(list string) ([]string, error) {
+	return parseDistinctList(list, "commodity id")
+}
+
+// parseDistinctList splits a non-empty comma separated list of distinct items, which are named in errors
+func parseDistinctList(list string, name string) ([]string, error) {
+	if strings.TrimSpace(list) == "" {
+		return nil, fmt.Errorf("no %s given", name)
+	}
+
+	var items []string
+	for _, item := range strings.Split(list, ",") {
+		item = strings.TrimSpace(item)
+		if item == "" {
+			return nil, fmt.Errorf("%q contains an empty %s", list, name)
+		}
+		if indexOf(items, item) >= 0 {
+			return nil, fmt.Errorf("%q contains %s %s twice", list, name, item)
+		}
+		items = append(items, item)
+	}
+
+	return items, nil
+}
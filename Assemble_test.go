@@ -0,0 +1,92 @@
+package main
+
+import (
+	"strings"
+	"testing"
+
+	"SupplyChainTrackingChaincode/chaincodetest"
+)
+
+// assembleCommodity assembles commodities owned by the client's org and returns the id of the assembled commodity
+func assembleCommodity(t *testing.T, ledger *chaincodetest.Ledger, client chaincodetest.Identity, properties string, componentIDs ...string) string {
+	t.Helper()
+
+	ctx := ledger.NewTransaction(client).WithTransient("commodity_properties", []byte(properties))
+	commodityID, err := newContract().AssembleCommodity(ctx, strings.Join(componentIDs, ","), "", "an assembly")
+	if err != nil {
+		t.Fatalf("AssembleCommodity: %v", err)
+	}
+	if err = ctx.Commit(); err != nil {
+		t.Fatalf("commit AssembleCommodity: %v", err)
+	}
+
+	return commodityID
+}
+
+func TestAssembleCommodity(t *testing.T) {
+	ledger := chaincodetest.NewLedger()
+	s := newContract()
+
+	wheel := createCommodity(t, ledger, org1Client, `{"name":"wheel"}`)
+	frame := createCommodity(t, ledger, org1Client, `{"name":"frame"}`)
+	bike := assembleCommodity(t, ledger, org1Client, `{"name":"bike"}`, wheel, frame)
+	bell := createCommodity(t, ledger, org1Client, `{"name":"bell"}`)
+	kit := assembleCommodity(t, ledger, org1Client, `{"name":"kit"}`, bike, bell)
+
+	assembled, err := s.ReadCommodity(ledger.NewTransaction(org1Client), bike)
+	if err != nil {
+		t.Fatalf("ReadCommodity: %v", err)
+	}
+	if len(assembled.Components) != 2 || assembled.Components[0] != wheel || assembled.AssembledInto != kit || !assembled.Consumed {
+		t.Errorf("assembled commodity = %+v", assembled)
+	}
+
+	bom, err := s.GetBillOfMaterials(ledger.NewTransaction(org2Client), kit)
+	if err != nil {
+		t.Fatalf("GetBillOfMaterials: %v", err)
+	}
+	want := []BillOfMaterialsItem{
+		{CommodityID: bike, AssemblyID: kit, Depth: 1},
+		{CommodityID: wheel, AssemblyID: bike, Depth: 2},
+		{CommodityID: frame, AssemblyID: bike, Depth: 2},
+		{CommodityID: bell, AssemblyID: kit, Depth: 1},
+	}
+	if len(bom.Items) != len(want) {
+		t.Fatalf("bill of materials = %+v, want %d items", bom.Items, len(want))
+	}
+	for i, item := range bom.Items {
+		if item.CommodityID != want[i].CommodityID || item.AssemblyID != want[i].AssemblyID || item.Depth != want[i].Depth {
+			t.Errorf("item %d = %+v, want %+v", i, item, want[i])
+		}
+	}
+
+	// Components can no longer be transferred nor assembled again
+	ctx := ledger.NewTransaction(org1Client).WithTransient("commodity_transferKey", transferKeyOf(wheel))
+	if err = s.AgreeToPut(ctx, wheel); err == nil || !strings.Contains(err.Error(), "assembled into "+bike) {
+		t.Errorf("AgreeToPut of a component: err = %v", err)
+	}
+	ctx = ledger.NewTransaction(org1Client).WithTransient("commodity_properties", []byte(`{"name":"spare"}`))
+	if _, err = s.AssembleCommodity(ctx, wheel, "", "a spare"); err == nil {
+		t.Error("AssembleCommodity of a consumed component succeeded")
+	}
+}
+
+func TestAssembleCommodityRequiresOwnedComponents(t *testing.T) {
+	ledger := chaincodetest.NewLedger()
+	s := newContract()
+
+	wheel := createCommodity(t, ledger, org1Client, `{"name":"wheel"}`)
+	frame := createCommodity(t, ledger, org2Client, `{"name":"frame"}`)
+
+	ctx := ledger.NewTransaction(org1Client).WithTransient("commodity_properties", []byte(`{"name":"bike"}`))
+	if _, err := s.AssembleCommodity(ctx, wheel+","+frame, "", "a bike"); err == nil {
+		t.Error("AssembleCommodity of another org's component succeeded")
+	}
+
+	for _, components := range []string{"", wheel + ",", wheel + "," + wheel} {
+		ctx = ledger.NewTransaction(org1Client).WithTransient("commodity_properties", []byte(`{"name":"bike"}`))
+		if _, err := s.AssembleCommodity(ctx, components, "", "a bike"); err == nil {
+			t.Errorf("AssembleCommodity of %q succeeded", components)
+		}
+	}
+}
@@ -0,0 +1,220 @@
+package main
+
+import (
+	"crypto/sha256"
+	"encoding/hex"
+	"fmt"
+
+	"github.com/hyperledger/fabric-contract-api-go/contractapi"
+)
+
+// SetDetailedInformation stores the detailed information of a commodity passed by transient field in the owner's
+// implicit private data collection and anchors its hash on the public record. Only the current owner can set it,
+// the copies of the counterparties it was shared with are updated as well.
+func (s *SmartContract) SetDetailedInformation(ctx contractapi.TransactionContextInterface, commodityID string) error {
+	clientOrgID, err := getClientOrgID(ctx)
+	if err != nil {
+		return err
+	}
+
+	// Detailed information must be retrieved from the transient field as it is private
+	detailsJSON, err := getTransientInput(ctx, commodityDetailsInput)
+	if err != nil {
+		return err
+	}
+
+	commodity, err := s.ReadCommodity(ctx, commodityID)
+	if err != nil {
+		return fmt.Errorf("failed to get commodity: %v", err)
+	}
+
+	// Auth check to ensure that client's org actually owns the commodity
+	if clientOrgID != commodity.OwnerOrg {
+		return &AuthorizationError{ClientOrg: clientOrgID, Action: fmt.Sprintf("set the detailed information of a commodity owned by %s", commodity.OwnerOrg)}
+	}
+
+	// The details are only written, so the peers of the endorsers of the commodity can endorse too
+	_, err = s.verifyPeerEndorsesCommodities(ctx, clientOrgID, commodity)
+	if err != nil {
+		return err
+	}
+
+	err = verifyStatus(ctx, commodity, "have its detailed information set", activeStatuses...)
+	if err != nil {
+		return err
+	}
+
+	// The details are persisted as is, so that their private data hash equals the anchored hash
+	for _, org := range append([]string{clientOrgID}, commodity.DetailsSharedWith...) {
+		err = putDetailedInformation(ctx, org, commodityID, detailsJSON)
+		if err != nil {
+			return err
+		}
+	}
+
+	hash := sha256.New()
+	hash.Write(detailsJSON)
+	commodity.DetailedInformationHash = hex.EncodeToString(hash.Sum(nil))
+
+	err = putCommodity(ctx, commodity)
+	if err != nil {
+		return err
+	}
+
+	return setCommodityEvent(ctx, eventDetailsChanged, CommodityEvent{CommodityID: commodityID, OwnerOrg: clientOrgID})
+}
+
+// ShareDetailedInformation copies the detailed information of a commodity from the owner's implicit private data collection
+// to the one of a counterparty. Only the current owner can share it. The peers of the endorsers of the commodity cannot
+// read the owner's copy, so the owner must pass the details by transient field too when the commodity has endorsers.
+func (s *SmartContract) ShareDetailedInformation(ctx contractapi.TransactionContextInterface, commodityID string, counterpartyOrgID string) error {
+	clientOrgID, err := getClientOrgID(ctx)
+	if err != nil {
+		return err
+	}
+
+	commodity, err := s.ReadCommodity(ctx, commodityID)
+	if err != nil {
+		return fmt.Errorf("failed to get commodity: %v", err)
+	}
+
+	// Auth check to ensure that client's org actually owns the commodity
+	if clientOrgID != commodity.OwnerOrg {
+		return &AuthorizationError{ClientOrg: clientOrgID, Action: fmt.Sprintf("share the detailed information of a commodity owned by %s", commodity.OwnerOrg)}
+	}
+	if counterpartyOrgID == clientOrgID {
+		return fmt.Errorf("detailed information of %s cannot be shared with its owner", commodityID)
+	}
+
+	err = verifyStatus(ctx, commodity, "have its detailed information shared", activeStatuses...)
+	if err != nil {
+		return err
+	}
+
+	// The owner's copy is read on the owner's peers only, other endorsing peers check the details passed by the client
+	ownerPeer, err := s.verifyPeerEndorsesCommodities(ctx, clientOrgID, commodity)
+	if err != nil {
+		return err
+	}
+	var detailsJSON []byte
+	if ownerPeer {
+		detailsJSON, err = getDetailedInformation(ctx, commodity, clientOrgID)
+	} else {
+		detailsJSON, err = getTransientDetailedInformation(ctx, commodity)
+	}
+	if err != nil {
+		return err
+	}
+
+	err = putDetailedInformation(ctx, counterpartyOrgID, commodityID, detailsJSON)
+	if err != nil {
+		return err
+	}
+
+	if indexOf(commodity.DetailsSharedWith, counterpartyOrgID) < 0 {
+		commodity.DetailsSharedWith = append(commodity.DetailsSharedWith, counterpartyOrgID)
+		err = putCommodity(ctx, commodity)
+		if err != nil {
+			return err
+		}
+	}
+
+	return setCommodityEvent(ctx, eventDetailsShared, CommodityEvent{CommodityID: commodityID, OwnerOrg: clientOrgID, GetterOrg: counterpartyOrgID})
+}
+
+// GetDetailedInformation returns the detailed information of a commodity from caller's implicit private data collection.
+// Only the current owner and the counterparties it was shared with can read it.
+func (s *SmartContract) GetDetailedInformation(ctx contractapi.TransactionContextInterface, commodityID string) (string, error) {
+	clientOrgID, err := getClientOrgID(ctx)
+	if err != nil {
+		return "", err
+	}
+
+	err = s.verifyClientOrgMatchesPeerOrg(ctx, clientOrgID)
+	if err != nil {
+		return "", err
+	}
+
+	commodity, err := s.ReadCommodity(ctx, commodityID)
+	if err != nil {
+		return "", fmt.Errorf("failed to get commodity: %v", err)
+	}
+
+	if clientOrgID != commodity.OwnerOrg && indexOf(commodity.DetailsSharedWith, clientOrgID) < 0 {
+		return "", &AuthorizationError{ClientOrg: clientOrgID, Action: fmt.Sprintf("read the detailed information of a commodity owned by %s", commodity.OwnerOrg)}
+	}
+
+	detailsJSON, err := getDetailedInformation(ctx, commodity, clientOrgID)
+	if err != nil {
+		return "", err
+	}
+
+	return string(detailsJSON), nil
+}
+
+// getDetailedInformation reads the detailed information of a commodity from an org's implicit private data collection
+// and verifies it against the hash anchored on the public record
+func getDetailedInformation(ctx contractapi.TransactionContextInterface, commodity *Commodity, orgID string) ([]byte, error) {
+	if commodity.DetailedInformationHash == "" {
+		return nil, fmt.Errorf("detailed information of %s was never set", commodity.ID)
+	}
+
+	detailsKey, err := ctx.GetStub().CreateCompositeKey(typeCommodityDetails, []string{commodity.ID})
+	if err != nil {
+		return nil, fmt.Errorf("failed to create composite key: %v", err)
+	}
+
+	detailsJSON, err := ctx.GetStub().GetPrivateData(buildCollectionName(orgID), detailsKey)
+	if err != nil {
+		return nil, fmt.Errorf("failed to read detailed information from implicit private data collection: %v", err)
+	}
+	if detailsJSON == nil {
+		return nil, fmt.Errorf("detailed information of %s does not exist in the collection of %s", commodity.ID, orgID)
+	}
+
+	hash := sha256.New()
+	hash.Write(detailsJSON)
+	if hex.EncodeToString(hash.Sum(nil)) != commodity.DetailedInformationHash {
+		return nil, fmt.Errorf("detailed information of %s in the collection of %s does not match the anchored hash %s",
+			commodity.ID, orgID, commodity.DetailedInformationHash)
+	}
+
+	return detailsJSON, nil
+}
+
+// getTransientDetailedInformation returns the detailed information of a commodity passed by transient field, which must
+// match the anchored hash
+func getTransientDetailedInformation(ctx contractapi.TransactionContextInterface, commodity *Commodity) ([]byte, error) {
+	if commodity.DetailedInformationHash == "" {
+		return nil, fmt.Errorf("detailed information of %s was never set", commodity.ID)
+	}
+
+	detailsJSON, err := getTransientInput(ctx, commodityDetailsInput)
+	if err != nil {
+		return nil, err
+	}
+
+	hash := sha256.New()
+	hash.Write(detailsJSON)
+	if hex.EncodeToString(hash.Sum(nil)) != commodity.DetailedInformationHash {
+		return nil, fmt.Errorf("detailed information of %s passed by transient field does not match the anchored hash %s",
+			commodity.ID, commodity.DetailedInformationHash)
+	}
+
+	return detailsJSON, nil
+}
+
+// putDetailedInformation writes the detailed information of a commodity to an org's implicit private data collection
+func putDetailedInformation(ctx contractapi.TransactionContextInterface, orgID string, commodityID string, detailsJSON []byte) error {
+	detailsKey, err := ctx.GetStub().CreateCompositeKey(typeCommodityDetails, []string{commodityID})
+	if err != nil {
+		return fmt.Errorf("failed to create composite key: %v", err)
+	}
+
+	err = ctx.GetStub().PutPrivateData(buildCollectionName(orgID), detailsKey, detailsJSON)
+	if err != nil {
+		return fmt.Errorf("failed to put detailed information for %s: %v", orgID, err)
+	}
+
+	return nil
+}
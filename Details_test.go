@@ -0,0 +1,132 @@
+package main
+
+import (
+	"crypto/sha256"
+	"encoding/hex"
+	"strings"
+	"testing"
+
+	"SupplyChainTrackingChaincode/chaincodetest"
+)
+
+const palletDetails = `{"lot":"L-0042","unitCost":12.5}`
+
+func TestDetailedInformation(t *testing.T) {
+	ledger := chaincodetest.NewLedger()
+	s := newContract()
+
+	commodityID := createCommodity(t, ledger, org1Client, palletProperties)
+
+	ctx := ledger.NewTransaction(org2Client).WithTransient("commodity_details", []byte(palletDetails))
+	if err := s.SetDetailedInformation(ctx, commodityID); err == nil {
+		t.Error("SetDetailedInformation succeeded for a client of an org not owning the commodity")
+	}
+
+	ctx = ledger.NewTransaction(org1Client).WithTransient("commodity_details", []byte(palletDetails))
+	if err := s.SetDetailedInformation(ctx, commodityID); err != nil {
+		t.Fatalf("SetDetailedInformation: %v", err)
+	}
+	if err := ctx.Commit(); err != nil {
+		t.Fatalf("commit SetDetailedInformation: %v", err)
+	}
+
+	publicRecord := string(ledger.State(commodityID))
+	if strings.Contains(publicRecord, "L-0042") {
+		t.Fatalf("public record %s contains the detailed information", publicRecord)
+	}
+	hash := sha256.Sum256([]byte(palletDetails))
+	if !strings.Contains(publicRecord, hex.EncodeToString(hash[:])) {
+		t.Errorf("public record %s does not anchor the detailed information hash", publicRecord)
+	}
+
+	if _, err := s.GetDetailedInformation(ledger.NewTransaction(org2Client), commodityID); err == nil {
+		t.Error("GetDetailedInformation succeeded for an org it was not shared with")
+	}
+
+	ctx = ledger.NewTransaction(org1Client)
+	if err := s.ShareDetailedInformation(ctx, commodityID, org2MSP); err != nil {
+		t.Fatalf("ShareDetailedInformation: %v", err)
+	}
+	if err := ctx.Commit(); err != nil {
+		t.Fatalf("commit ShareDetailedInformation: %v", err)
+	}
+
+	for _, client := range []chaincodetest.Identity{org1Client, org2Client} {
+		details, err := s.GetDetailedInformation(ledger.NewTransaction(client), commodityID)
+		if err != nil || details != palletDetails {
+			t.Errorf("%s GetDetailedInformation = %s, %v, want %s", client.MSPID, details, err, palletDetails)
+		}
+	}
+	if _, err := s.GetDetailedInformation(ledger.NewTransaction(org3Client), commodityID); err == nil {
+		t.Error("GetDetailedInformation succeeded for an org it was not shared with")
+	}
+
+	// updates reach the counterparty as well
+	updatedDetails := `{"lot":"L-0043","unitCost":12.5}`
+	ctx = ledger.NewTransaction(org1Client).WithTransient("commodity_details", []byte(updatedDetails))
+	if err := s.SetDetailedInformation(ctx, commodityID); err != nil {
+		t.Fatalf("SetDetailedInformation: %v", err)
+	}
+	if err := ctx.Commit(); err != nil {
+		t.Fatalf("commit SetDetailedInformation: %v", err)
+	}
+	details, err := s.GetDetailedInformation(ledger.NewTransaction(org2Client), commodityID)
+	if err != nil || details != updatedDetails {
+		t.Errorf("counterparty GetDetailedInformation = %s, %v, want %s", details, err, updatedDetails)
+	}
+}
+
+func TestTransferResetsDetailedInformation(t *testing.T) {
+	ledger := chaincodetest.NewLedger()
+	s := newContract()
+	commodityID := createCommodity(t, ledger, org1Client, palletProperties)
+
+	ctx := ledger.NewTransaction(org1Client).WithTransient("commodity_details", []byte(palletDetails))
+	if err := s.SetDetailedInformation(ctx, commodityID); err != nil {
+		t.Fatalf("SetDetailedInformation: %v", err)
+	}
+	if err := ctx.Commit(); err != nil {
+		t.Fatalf("commit SetDetailedInformation: %v", err)
+	}
+	ctx = ledger.NewTransaction(org1Client)
+	if err := s.ShareDetailedInformation(ctx, commodityID, org3MSP); err != nil {
+		t.Fatalf("ShareDetailedInformation: %v", err)
+	}
+	if err := ctx.Commit(); err != nil {
+		t.Fatalf("commit ShareDetailedInformation: %v", err)
+	}
+
+	agree(t, ledger, org1Client, org2Client, commodityID, palletProperties, transferKeyOf(commodityID))
+	if _, err := transfer(ledger, org1Client, org2MSP, commodityID, transferKeyOf(commodityID)); err != nil {
+		t.Fatalf("TransferCommodity: %v", err)
+	}
+
+	commodity, err := s.ReadCommodity(ledger.NewTransaction(org2Client), commodityID)
+	if err != nil || commodity.DetailedInformationHash != "" || len(commodity.DetailsSharedWith) != 0 {
+		t.Fatalf("commodity after the transfer = %+v, %v", commodity, err)
+	}
+	detailsKey, err := ledger.NewTransaction(org1Client).Stub().CreateCompositeKey(typeCommodityDetails, []string{commodityID})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if leftover := ledger.PrivateData(buildCollectionName(org1MSP), detailsKey); leftover != nil {
+		t.Errorf("previous owner still holds the detailed information %s", leftover)
+	}
+
+	// The new owner's details are only written to its own collection, not to the ones the previous owner shared with
+	newDetails := `{"lot":"L-0043"}`
+	ctx = ledger.NewTransaction(org2Client).WithTransient("commodity_details", []byte(newDetails))
+	if err = s.SetDetailedInformation(ctx, commodityID); err != nil {
+		t.Fatalf("SetDetailedInformation by the new owner: %v", err)
+	}
+	if err = ctx.Commit(); err != nil {
+		t.Fatalf("commit SetDetailedInformation: %v", err)
+	}
+	if leftover := ledger.PrivateData(buildCollectionName(org3MSP), detailsKey); string(leftover) != palletDetails {
+		t.Errorf("details shared by the previous owner = %s, want them unchanged", leftover)
+	}
+	details, err := s.GetDetailedInformation(ledger.NewTransaction(org2Client), commodityID)
+	if err != nil || details != newDetails {
+		t.Errorf("GetDetailedInformation of the new owner = %s, %v", details, err)
+	}
+}
@@ -0,0 +1,191 @@
+package main
+
+import (
+	"encoding/json"
+	"fmt"
+	"strings"
+	"time"
+
+	"github.com/hyperledger/fabric-contract-api-go/contractapi"
+)
+
+const (
+	typeDisclosedProperties = "DP" // DP~commodityID holds the properties of a commodity disclosed to an auditor in its implicit collection
+	typeDisclosure          = "DL" // DL~commodityID~txID logs a disclosure of the properties of a commodity in public data
+)
+
+// Disclosure records that an owner disclosed the private properties of a commodity to an auditor.
+// It is kept in public data, the disclosed properties are only written to the auditor's implicit private data collection.
+type Disclosure struct {
+	ObjectType  string    `json:"objectType"`
+	CommodityID string    `json:"commodityID"`
+	OwnerOrg    string    `json:"ownerCompany"`
+	AuditorOrg  string    `json:"auditorCompany"`
+	Purpose     string    `json:"purpose"`
+	TxID        string    `json:"txId"`
+	Timestamp   time.Time `json:"timestamp"`
+}
+
+// DiscloseCommodityProperties copies the private properties of a commodity from the owner's implicit private data collection
+// to the one of an auditor and logs the disclosure. The properties are verified before they are disclosed.
+// DiscloseCommodityProperties can only be called by current owner, for the orgs granted the auditor role, see SetOrgRole
+func (s *SmartContract) DiscloseCommodityProperties(ctx contractapi.TransactionContextInterface, commodityID string, auditorOrgID string, purpose string) error {
+	clientOrgID, err := getClientOrgID(ctx)
+	if err != nil {
+		return err
+	}
+
+	// The owner's properties are read, therefore the client must belong to the peer's org
+	err = s.verifyClientOrgMatchesPeerOrg(ctx, clientOrgID)
+	if err != nil {
+		return err
+	}
+
+	auditor, err := hasOrgRole(ctx, orgRoleAuditor, auditorOrgID)
+	if err != nil {
+		return err
+	}
+	if !auditor {
+		return fmt.Errorf("%s is not an auditor, properties can only be disclosed to auditors", auditorOrgID)
+	}
+	if strings.TrimSpace(purpose) == "" {
+		return fmt.Errorf("a disclosure needs a purpose")
+	}
+
+	commodity, err := s.ReadCommodity(ctx, commodityID)
+	if err != nil {
+		return fmt.Errorf("failed to get commodity: %v", err)
+	}
+
+	// Auth check to ensure that client's org actually owns the commodity
+	if clientOrgID != commodity.OwnerOrg {
+		return &AuthorizationError{ClientOrg: clientOrgID, Action: fmt.Sprintf("disclose the properties of a commodity owned by %s", commodity.OwnerOrg)}
+	}
+
+	propertiesJSON, err := ctx.GetStub().GetPrivateData(buildCollectionName(clientOrgID), commodityID)
+	if err != nil {
+		return fmt.Errorf("failed to read commodity private properties: %v", err)
+	}
+	if propertiesJSON == nil {
+		return fmt.Errorf("commodity private properties of %s do not exist in the collection of %s", commodityID, clientOrgID)
+	}
+	err = verifyCommodityProperties(ctx, commodity, propertiesJSON)
+	if err != nil {
+		return err
+	}
+
+	disclosedKey, err := ctx.GetStub().CreateCompositeKey(typeDisclosedProperties, []string{commodityID})
+	if err != nil {
+		return fmt.Errorf("failed to create composite key: %v", err)
+	}
+	err = ctx.GetStub().PutPrivateData(buildCollectionName(auditorOrgID), disclosedKey, propertiesJSON)
+	if err != nil {
+		return fmt.Errorf("failed to put disclosed properties for %s: %v", auditorOrgID, err)
+	}
+
+	timestamp, err := getTxTime(ctx)
+	if err != nil {
+		return err
+	}
+	disclosure := Disclosure{
+		ObjectType:  "Disclosure",
+		CommodityID: commodityID,
+		OwnerOrg:    clientOrgID,
+		AuditorOrg:  auditorOrgID,
+		Purpose:     purpose,
+		TxID:        ctx.GetStub().GetTxID(),
+		Timestamp:   timestamp,
+	}
+	disclosureJSON, err := json.Marshal(disclosure)
+	if err != nil {
+		return fmt.Errorf("failed to marshal disclosure: %v", err)
+	}
+	disclosureKey, err := ctx.GetStub().CreateCompositeKey(typeDisclosure, []string{commodityID, disclosure.TxID})
+	if err != nil {
+		return fmt.Errorf("failed to create composite key: %v", err)
+	}
+	err = ctx.GetStub().PutState(disclosureKey, disclosureJSON)
+	if err != nil {
+		return fmt.Errorf("failed to put disclosure in public data: %v", err)
+	}
+
+	return setCommodityEvent(ctx, eventPropertiesDisclosed, CommodityEvent{CommodityID: commodityID, OwnerOrg: clientOrgID, GetterOrg: auditorOrgID})
+}
+
+// GetDisclosedProperties returns the properties of a commodity disclosed to the caller from its implicit private data collection
+func (s *SmartContract) GetDisclosedProperties(ctx contractapi.TransactionContextInterface, commodityID string) (string, error) {
+	propertiesJSON, err := s.getDisclosedProperties(ctx, commodityID)
+	if err != nil {
+		return "", err
+	}
+	return string(propertiesJSON), nil
+}
+
+// VerifyDisclosedProperties allows an auditor to verify the properties of a commodity disclosed to it
+// the same way VerifyCommodityProperties verifies properties passed by transient field
+func (s *SmartContract) VerifyDisclosedProperties(ctx contractapi.TransactionContextInterface, commodityID string) (bool, error) {
+	propertiesJSON, err := s.getDisclosedProperties(ctx, commodityID)
+	if err != nil {
+		return false, err
+	}
+
+	commodity, err := s.ReadCommodity(ctx, commodityID)
+	if err != nil {
+		return false, fmt.Errorf("failed to get commodity: %v", err)
+	}
+
+	err = verifyCommodityProperties(ctx, commodity, propertiesJSON)
+	if err != nil {
+		return false, err
+	}
+
+	return true, nil
+}
+
+// QueryDisclosures returns every disclosure of the properties of a commodity, in the order of their transactions' ids
+func (s *SmartContract) QueryDisclosures(ctx contractapi.TransactionContextInterface, commodityID string) ([]Disclosure, error) {
+	disclosuresIterator, err := ctx.GetStub().GetStateByPartialCompositeKey(typeDisclosure, []string{commodityID})
+	if err != nil {
+		return nil, fmt.Errorf("failed to read from world state: %v", err)
+	}
+	defer disclosuresIterator.Close()
+
+	disclosures := []Disclosure{}
+	for disclosuresIterator.HasNext() {
+		resp, err := disclosuresIterator.Next()
+		if err != nil {
+			return nil, err
+		}
+
+		var disclosure Disclosure
+		err = json.Unmarshal(resp.Value, &disclosure)
+		if err != nil {
+			return nil, err
+		}
+		disclosures = append(disclosures, disclosure)
+	}
+
+	return disclosures, nil
+}
+
+// getDisclosedProperties reads the properties of a commodity disclosed to the caller
+func (s *SmartContract) getDisclosedProperties(ctx contractapi.TransactionContextInterface, commodityID string) ([]byte, error) {
+	collection, err := s.getClientImplicitCollectionNameAndVerifyClientOrg(ctx)
+	if err != nil {
+		return nil, err
+	}
+
+	disclosedKey, err := ctx.GetStub().CreateCompositeKey(typeDisclosedProperties, []string{commodityID})
+	if err != nil {
+		return nil, fmt.Errorf("failed to create composite key: %v", err)
+	}
+	propertiesJSON, err := ctx.GetStub().GetPrivateData(collection, disclosedKey)
+	if err != nil {
+		return nil, fmt.Errorf("failed to read disclosed properties from implicit private data collection: %v", err)
+	}
+	if propertiesJSON == nil {
+		return nil, fmt.Errorf("properties of %s were not disclosed to the caller", commodityID)
+	}
+
+	return propertiesJSON, nil
+}
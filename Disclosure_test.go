@@ -0,0 +1,86 @@
+package main
+
+import (
+	"errors"
+	"strings"
+	"testing"
+
+	"SupplyChainTrackingChaincode/chaincodetest"
+)
+
+func TestDiscloseCommodityProperties(t *testing.T) {
+	ledger := chaincodetest.NewLedger()
+	s := newContract()
+	grantOrgRole(t, ledger, orgRoleAuditor, org3MSP)
+	commodityID := createCommodity(t, ledger, org1Client, palletProperties)
+
+	if err := s.DiscloseCommodityProperties(ledger.NewTransaction(org1Client), commodityID, org2MSP, "annual audit"); err == nil || !strings.Contains(err.Error(), "not an auditor") {
+		t.Errorf("DiscloseCommodityProperties to a company that is not an auditor: err = %v", err)
+	}
+	if err := s.DiscloseCommodityProperties(ledger.NewTransaction(org1Client), commodityID, org3MSP, " "); err == nil {
+		t.Errorf("DiscloseCommodityProperties without a purpose succeeded")
+	}
+	var authErr *AuthorizationError
+	if err := s.DiscloseCommodityProperties(ledger.NewTransaction(org2Client), commodityID, org3MSP, "annual audit"); !errors.As(err, &authErr) {
+		t.Errorf("DiscloseCommodityProperties by a company that does not own the commodity: err = %v, want an AuthorizationError", err)
+	}
+	if _, err := s.GetDisclosedProperties(ledger.NewTransaction(org3Client), commodityID); err == nil {
+		t.Errorf("GetDisclosedProperties before any disclosure succeeded")
+	}
+
+	ctx := ledger.NewTransaction(org1Client)
+	if err := s.DiscloseCommodityProperties(ctx, commodityID, org3MSP, "annual audit"); err != nil {
+		t.Fatalf("DiscloseCommodityProperties: %v", err)
+	}
+	if err := ctx.Commit(); err != nil {
+		t.Fatalf("commit DiscloseCommodityProperties: %v", err)
+	}
+
+	properties, err := s.GetDisclosedProperties(ledger.NewTransaction(org3Client), commodityID)
+	if err != nil || properties != palletProperties {
+		t.Errorf("GetDisclosedProperties = %s, %v", properties, err)
+	}
+	verified, err := s.VerifyDisclosedProperties(ledger.NewTransaction(org3Client), commodityID)
+	if err != nil || !verified {
+		t.Errorf("VerifyDisclosedProperties = %v, %v", verified, err)
+	}
+	if _, err = s.GetDisclosedProperties(ledger.NewTransaction(org2Client), commodityID); err == nil {
+		t.Errorf("GetDisclosedProperties by a company the properties were not disclosed to succeeded")
+	}
+
+	disclosures, err := s.QueryDisclosures(ledger.NewTransaction(org2Client), commodityID)
+	if err != nil || len(disclosures) != 1 {
+		t.Fatalf("QueryDisclosures = %+v, %v", disclosures, err)
+	}
+	if d := disclosures[0]; d.OwnerOrg != org1MSP || d.AuditorOrg != org3MSP || d.Purpose != "annual audit" || d.TxID != ctx.GetStub().GetTxID() {
+		t.Errorf("disclosure = %+v", d)
+	}
+	events := ledger.Events()
+	if last := events[len(events)-1]; last.Name != eventPropertiesDisclosed || strings.Contains(string(last.Payload), "pallet") {
+		t.Errorf("last event = %s %s", last.Name, last.Payload)
+	}
+}
+
+func TestVerifyDisclosedPropertiesDetectsAlteredCopy(t *testing.T) {
+	ledger := chaincodetest.NewLedger()
+	s := newContract()
+	commodityID := createCommodity(t, ledger, org1Client, palletProperties)
+
+	// Store a copy that differs from the properties the commodityID was derived from
+	ctx := ledger.NewTransaction(org3Client)
+	disclosedKey, err := ctx.Stub().CreateCompositeKey(typeDisclosedProperties, []string{commodityID})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err = ctx.Stub().PutPrivateData(buildCollectionName(org3MSP), disclosedKey, []byte(`{"name":"pallet","weight":90}`)); err != nil {
+		t.Fatal(err)
+	}
+	if err = ctx.Commit(); err != nil {
+		t.Fatalf("commit altered copy: %v", err)
+	}
+
+	verified, err := s.VerifyDisclosedProperties(ledger.NewTransaction(org3Client), commodityID)
+	if err == nil || verified {
+		t.Errorf("VerifyDisclosedProperties of an altered copy = %v, %v", verified, err)
+	}
+}
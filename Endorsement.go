@@ -0,0 +1,237 @@
+package main
+
+import (
+	"fmt"
+	"strings"
+
+	"github.com/golang/protobuf/proto"
+	"github.com/hyperledger/fabric-chaincode-go/pkg/statebased"
+	"github.com/hyperledger/fabric-contract-api-go/contractapi"
+	"github.com/hyperledger/fabric-protos-go/common"
+	"github.com/hyperledger/fabric-protos-go/msp"
+)
+
+// EndorsementPolicy shows who has to endorse the updates of a commodity.
+// Policy is the state-based endorsement policy on the ledger, e.g. AND(Org1MSP.peer, OutOf(2, Org3MSP.peer, Org4MSP.peer, Org5MSP.peer))
+type EndorsementPolicy struct {
+	CommodityID       string   `json:"commodityID"`
+	OwnerOrg          string   `json:"ownerCompany"`
+	Endorsers         []string `json:"endorsers"`
+	EndorsersRequired int      `json:"endorsersRequired"`
+	Policy            string   `json:"policy"`
+}
+
+// CreateAssetWithEndorsers creates a Commodity like CreateAsset, whose updates must also be endorsed by third parties,
+// e.g. a logistics provider or an inspector. endorsers is a comma separated list of orgs, endorsersRequired how many of
+// them must endorse, 0 for all of them.
+func (s *SmartContract) CreateAssetWithEndorsers(ctx contractapi.TransactionContextInterface, target string, publicDescription string, endorsers string, endorsersRequired int) (string, error) {
+	endorserOrgs, err := parseEndorsers(endorsers, endorsersRequired)
+	if err != nil {
+		return "", err
+	}
+
+	return s.createCommodity(ctx, target, publicDescription, endorserOrgs, endorsersRequired)
+}
+
+// SetCommodityEndorsers replaces the third parties that must endorse the updates of a commodity, an empty list removes them.
+// Only the current owner can change them, and the transaction must be endorsed by the current endorsers as well, as it
+// updates the commodity under its current endorsement policy.
+func (s *SmartContract) SetCommodityEndorsers(ctx contractapi.TransactionContextInterface, commodityID string, endorsers string, endorsersRequired int) error {
+	clientOrgID, err := getClientOrgID(ctx)
+	if err != nil {
+		return err
+	}
+
+	var endorserOrgs []string
+	if strings.TrimSpace(endorsers) != "" {
+		endorserOrgs, err = parseEndorsers(endorsers, endorsersRequired)
+		if err != nil {
+			return err
+		}
+	} else if endorsersRequired != 0 {
+		return fmt.Errorf("%d endorsers required but none given", endorsersRequired)
+	}
+
+	commodity, err := s.ReadCommodity(ctx, commodityID)
+	if err != nil {
+		return fmt.Errorf("failed to get commodity: %v", err)
+	}
+
+	// Auth check to ensure that client's org actually owns the commodity
+	if clientOrgID != commodity.OwnerOrg {
+		return &AuthorizationError{ClientOrg: clientOrgID, Action: fmt.Sprintf("change the endorsers of a commodity owned by %s", commodity.OwnerOrg)}
+	}
+	if indexOf(endorserOrgs, clientOrgID) >= 0 {
+		return fmt.Errorf("the owner %s always endorses, it cannot be one of the endorsers", clientOrgID)
+	}
+
+	err = verifyStatus(ctx, commodity, "have its endorsers changed", activeStatuses...)
+	if err != nil {
+		return err
+	}
+
+	commodity.Endorsers = endorserOrgs
+	commodity.EndorsersRequired = endorsersRequired
+	err = putCommodity(ctx, commodity)
+	if err != nil {
+		return err
+	}
+
+	err = setCommodityStateBasedEndorsement(ctx, commodity)
+	if err != nil {
+		return fmt.Errorf("failed setting state based endorsement: %v", err)
+	}
+
+	return setCommodityEvent(ctx, eventEndorsersChanged, CommodityEvent{CommodityID: commodityID, OwnerOrg: clientOrgID})
+}
+
+// GetEndorsementPolicy returns the endorsers of a commodity and its endorsement policy as recorded on the ledger
+func (s *SmartContract) GetEndorsementPolicy(ctx contractapi.TransactionContextInterface, commodityID string) (*EndorsementPolicy, error) {
+	commodity, err := s.ReadCommodity(ctx, commodityID)
+	if err != nil {
+		return nil, fmt.Errorf("failed to get commodity: %v", err)
+	}
+
+	policyBytes, err := ctx.GetStub().GetStateValidationParameter(commodityID)
+	if err != nil {
+		return nil, fmt.Errorf("failed to get validation parameter of commodity: %v", err)
+	}
+
+	policy := "chaincode endorsement policy"
+	if policyBytes != nil {
+		policy, err = describeEndorsementPolicy(policyBytes)
+		if err != nil {
+			return nil, err
+		}
+	}
+
+	return &EndorsementPolicy{
+		CommodityID:       commodityID,
+		OwnerOrg:          commodity.OwnerOrg,
+		Endorsers:         commodity.Endorsers,
+		EndorsersRequired: commodity.requiredEndorsers(),
+		Policy:            policy,
+	}, nil
+}
+
+// requiredEndorsers returns how many endorsers must endorse the updates of the commodity, besides the owner
+func (commodity *Commodity) requiredEndorsers() int {
+	if commodity.EndorsersRequired == 0 {
+		return len(commodity.Endorsers)
+	}
+	return commodity.EndorsersRequired
+}
+
+// ownerEndorsementPolicy returns the policy only requiring a peer of every owner org
+func ownerEndorsementPolicy(owners []string) ([]byte, error) {
+	endorsementPolicy, err := statebased.NewStateEP(nil)
+	if err != nil {
+		return nil, err
+	}
+	err = endorsementPolicy.AddOrgs(statebased.RoleTypePeer, owners...)
+	if err != nil {
+		return nil, fmt.Errorf("failed to add org to endorsement policy: %v", err)
+	}
+	policy, err := endorsementPolicy.Policy()
+	if err != nil {
+		return nil, fmt.Errorf("failed to create endorsement policy bytes from org: %v", err)
+	}
+	return policy, nil
+}
+
+// coEndorsementPolicy returns the policy requiring a peer of every owner org and peers of required endorsers.
+// statebased only builds policies requiring every org, so the signature policy is built here.
+func coEndorsementPolicy(owners []string, endorsers []string, required int) ([]byte, error) {
+	var identities []*msp.MSPPrincipal
+	var ownerRules, endorserRules []*common.SignaturePolicy
+	for i, org := range append(append([]string{}, owners...), endorsers...) {
+		role, err := proto.Marshal(&msp.MSPRole{MspIdentifier: org, Role: msp.MSPRole_PEER})
+		if err != nil {
+			return nil, fmt.Errorf("failed to marshal principal of %s: %v", org, err)
+		}
+		identities = append(identities, &msp.MSPPrincipal{PrincipalClassification: msp.MSPPrincipal_ROLE, Principal: role})
+		if i < len(owners) {
+			ownerRules = append(ownerRules, signedBy(i))
+		} else {
+			endorserRules = append(endorserRules, signedBy(i))
+		}
+	}
+
+	rules := append(ownerRules, nOutOf(required, endorserRules...))
+	envelope := &common.SignaturePolicyEnvelope{
+		Rule:       nOutOf(len(rules), rules...),
+		Identities: identities,
+	}
+	policy, err := proto.Marshal(envelope)
+	if err != nil {
+		return nil, fmt.Errorf("failed to create endorsement policy bytes: %v", err)
+	}
+	return policy, nil
+}
+
+func signedBy(identity int) *common.SignaturePolicy {
+	return &common.SignaturePolicy{Type: &common.SignaturePolicy_SignedBy{SignedBy: int32(identity)}}
+}
+
+func nOutOf(n int, rules ...*common.SignaturePolicy) *common.SignaturePolicy {
+	return &common.SignaturePolicy{Type: &common.SignaturePolicy_NOutOf_{NOutOf: &common.SignaturePolicy_NOutOf{N: int32(n), Rules: rules}}}
+}
+
+// describeEndorsementPolicy renders a signature policy in the syntax of Fabric policies
+func describeEndorsementPolicy(policyBytes []byte) (string, error) {
+	envelope := &common.SignaturePolicyEnvelope{}
+	err := proto.Unmarshal(policyBytes, envelope)
+	if err != nil {
+		return "", fmt.Errorf("failed to unmarshal endorsement policy: %v", err)
+	}
+
+	var principals []string
+	for _, identity := range envelope.GetIdentities() {
+		role := &msp.MSPRole{}
+		err = proto.Unmarshal(identity.GetPrincipal(), role)
+		if err != nil {
+			return "", fmt.Errorf("failed to unmarshal principal: %v", err)
+		}
+		principals = append(principals, fmt.Sprintf("%s.%s", role.GetMspIdentifier(), strings.ToLower(role.GetRole().String())))
+	}
+
+	return describeRule(envelope.GetRule(), principals), nil
+}
+
+func describeRule(rule *common.SignaturePolicy, principals []string) string {
+	rules := rule.GetNOutOf()
+	if rules == nil {
+		signedBy := int(rule.GetSignedBy())
+		if signedBy >= len(principals) {
+			return fmt.Sprintf("unknown principal %d", signedBy)
+		}
+		return principals[signedBy]
+	}
+
+	var operands []string
+	for _, subRule := range rules.GetRules() {
+		operands = append(operands, describeRule(subRule, principals))
+	}
+	switch {
+	case len(operands) == 1 && rules.GetN() == 1:
+		return operands[0]
+	case int(rules.GetN()) == len(operands):
+		return fmt.Sprintf("AND(%s)", strings.Join(operands, ", "))
+	case rules.GetN() == 1:
+		return fmt.Sprintf("OR(%s)", strings.Join(operands, ", "))
+	default:
+		return fmt.Sprintf("OutOf(%d, %s)", rules.GetN(), strings.Join(operands, ", "))
+	}
+}
+
+// parseEndorsers splits a comma separated list of distinct endorser orgs and checks how many of them are required
+func parseEndorsers(endorsers string, required int) ([]string, error) {
+	orgs, err := parseDistinctList(endorsers, "endorser")
+	if err != nil {
+		return nil, err
+	}
+	if required < 0 || required > len(orgs) {
+		return nil, fmt.Errorf("%d endorsers required out of %d", required, len(orgs))
+	}
+	return orgs, nil
+}
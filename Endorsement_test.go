@@ -0,0 +1,218 @@
+package main
+
+import (
+	"errors"
+	"strings"
+	"testing"
+
+	"SupplyChainTrackingChaincode/chaincodetest"
+
+	"github.com/hyperledger/fabric-contract-api-go/contractapi"
+)
+
+const org4MSP = "Org4MSP"
+
+// createCommodityWithEndorsers creates a commodity owned by the client's org whose updates must also be endorsed by endorsers
+func createCommodityWithEndorsers(t *testing.T, ledger *chaincodetest.Ledger, client chaincodetest.Identity, endorsers string, required int) string {
+	t.Helper()
+
+	ctx := ledger.NewTransaction(client).WithTransient("commodity_properties", []byte(palletProperties))
+	commodityID, err := newContract().CreateAssetWithEndorsers(ctx, "", "a pallet", endorsers, required)
+	if err != nil {
+		t.Fatalf("CreateAssetWithEndorsers: %v", err)
+	}
+	if err = ctx.Commit(); err != nil {
+		t.Fatalf("commit CreateAssetWithEndorsers: %v", err)
+	}
+
+	return commodityID
+}
+
+func TestTransferRequiresThirdPartyEndorsement(t *testing.T) {
+	ledger := chaincodetest.NewLedger()
+	s := newContract()
+	commodityID := createCommodityWithEndorsers(t, ledger, org1Client, org3MSP, 0)
+
+	policy, err := s.GetEndorsementPolicy(ledger.NewTransaction(org2Client), commodityID)
+	if err != nil {
+		t.Fatalf("GetEndorsementPolicy: %v", err)
+	}
+	if want := "AND(Org1MSP.peer, Org3MSP.peer)"; policy.Policy != want || policy.EndorsersRequired != 1 {
+		t.Errorf("policy = %+v, want %s", policy, want)
+	}
+
+	ctx := ledger.NewTransaction(org1Client)
+	if err = s.ChangePublicDescription(ctx, commodityID, "inspected"); err != nil {
+		t.Fatalf("ChangePublicDescription: %v", err)
+	}
+	if err = ctx.Commit(); err == nil {
+		t.Error("update endorsed by the owner only was committed")
+	}
+
+	agree(t, ledger, org1Client, org2Client, commodityID, palletProperties, transferKeyOf(commodityID))
+	ctx = ledger.NewTransaction(org1Client).WithTransient("commodity_transferKey", transferKeyOf(commodityID)).
+		EndorsedBy(org1MSP, org3MSP)
+	err = ctx.Endorse(func(ctx contractapi.TransactionContextInterface) error {
+		return s.TransferCommodity(ctx, commodityID, org2MSP)
+	})
+	if err != nil {
+		t.Fatalf("TransferCommodity: %v", err)
+	}
+	if err = ctx.Commit(); err != nil {
+		t.Fatalf("commit TransferCommodity endorsed by the owner and the third party: %v", err)
+	}
+
+	// The third party keeps endorsing for the new owner
+	policy, err = s.GetEndorsementPolicy(ledger.NewTransaction(org2Client), commodityID)
+	if err != nil {
+		t.Fatalf("GetEndorsementPolicy: %v", err)
+	}
+	if want := "AND(Org2MSP.peer, Org3MSP.peer)"; policy.Policy != want || policy.OwnerOrg != org2MSP {
+		t.Errorf("policy = %+v, want %s", policy, want)
+	}
+}
+
+func TestSetCommodityEndorsersRequiresConsent(t *testing.T) {
+	ledger := chaincodetest.NewLedger()
+	s := newContract()
+	commodityID := createCommodityWithEndorsers(t, ledger, org1Client, org3MSP, 0)
+
+	ctx := ledger.NewTransaction(org1Client)
+	if err := s.SetCommodityEndorsers(ctx, commodityID, org3MSP+","+org4MSP, 1); err != nil {
+		t.Fatalf("SetCommodityEndorsers: %v", err)
+	}
+	if err := ctx.Commit(); err == nil {
+		t.Fatal("endorsers were changed without the consent of the current endorser")
+	}
+
+	ctx = ledger.NewTransaction(org1Client).EndorsedBy(org1MSP, org3MSP)
+	err := ctx.Endorse(func(ctx contractapi.TransactionContextInterface) error {
+		return s.SetCommodityEndorsers(ctx, commodityID, org3MSP+","+org4MSP, 1)
+	})
+	if err != nil {
+		t.Fatalf("SetCommodityEndorsers: %v", err)
+	}
+	if err = ctx.Commit(); err != nil {
+		t.Fatalf("commit SetCommodityEndorsers: %v", err)
+	}
+
+	policy, err := s.GetEndorsementPolicy(ledger.NewTransaction(org1Client), commodityID)
+	if err != nil {
+		t.Fatalf("GetEndorsementPolicy: %v", err)
+	}
+	if want := "AND(Org1MSP.peer, OR(Org3MSP.peer, Org4MSP.peer))"; policy.Policy != want {
+		t.Errorf("policy = %s, want %s", policy.Policy, want)
+	}
+
+	// Any one of the endorsers is now enough
+	ctx = ledger.NewTransaction(org1Client).EndorsedBy(org1MSP, org4MSP)
+	err = ctx.Endorse(func(ctx contractapi.TransactionContextInterface) error {
+		return s.ChangePublicDescription(ctx, commodityID, "inspected")
+	})
+	if err != nil {
+		t.Fatalf("ChangePublicDescription: %v", err)
+	}
+	if err = ctx.Commit(); err != nil {
+		t.Errorf("commit endorsed by the owner and one endorser: %v", err)
+	}
+
+	for _, test := range []struct {
+		client    chaincodetest.Identity
+		endorsers string
+		required  int
+	}{
+		{org2Client, org3MSP, 0},
+		{org1Client, org1MSP, 0},
+		{org1Client, org3MSP, 2},
+		{org1Client, org3MSP + "," + org3MSP, 1},
+		{org1Client, "", 1},
+	} {
+		ctx = ledger.NewTransaction(test.client)
+		if err = s.SetCommodityEndorsers(ctx, commodityID, test.endorsers, test.required); err == nil {
+			t.Errorf("SetCommodityEndorsers(%q, %d) by %s succeeded", test.endorsers, test.required, test.client.MSPID)
+		}
+	}
+}
+
+// endorse simulates a transaction of the client on the peers of the owner org1 and of the endorser org3, and commits it
+func endorse(t *testing.T, ledger *chaincodetest.Ledger, client chaincodetest.Identity, transient map[string]string, name string, tx func(contractapi.TransactionContextInterface) error) {
+	t.Helper()
+
+	ctx := ledger.NewTransaction(client).EndorsedBy(org1MSP, org3MSP)
+	for key, value := range transient {
+		ctx.WithTransient(key, []byte(value))
+	}
+	if err := ctx.Endorse(tx); err != nil {
+		t.Fatalf("%s: %v", name, err)
+	}
+	if err := ctx.Commit(); err != nil {
+		t.Fatalf("commit %s: %v", name, err)
+	}
+}
+
+func TestEndorserPeersEndorseOwnerUpdates(t *testing.T) {
+	ledger := chaincodetest.NewLedger()
+	s := newContract()
+	commodityID := createCommodityWithEndorsers(t, ledger, org1Client, org3MSP, 0)
+	details := map[string]string{"commodity_details": palletDetails}
+
+	endorse(t, ledger, org1Client, details, "SetDetailedInformation", func(ctx contractapi.TransactionContextInterface) error {
+		return s.SetDetailedInformation(ctx, commodityID)
+	})
+
+	// The peer of the endorser cannot read the owner's copy of the details
+	ctx := ledger.NewTransaction(org1Client).EndorsedBy(org1MSP, org3MSP)
+	err := ctx.Endorse(func(ctx contractapi.TransactionContextInterface) error {
+		return s.ShareDetailedInformation(ctx, commodityID, org2MSP)
+	})
+	if err == nil || !strings.Contains(err.Error(), "commodity_details") {
+		t.Errorf("ShareDetailedInformation without the details: err = %v", err)
+	}
+	ctx = ledger.NewTransaction(org1Client).EndorsedBy(org1MSP, org3MSP).WithTransient("commodity_details", []byte(`{"lot":"forged"}`))
+	err = ctx.Endorse(func(ctx contractapi.TransactionContextInterface) error {
+		return s.ShareDetailedInformation(ctx, commodityID, org2MSP)
+	})
+	if err == nil || !strings.Contains(err.Error(), "anchored hash") {
+		t.Errorf("ShareDetailedInformation with other details: err = %v", err)
+	}
+	endorse(t, ledger, org1Client, details, "ShareDetailedInformation", func(ctx contractapi.TransactionContextInterface) error {
+		return s.ShareDetailedInformation(ctx, commodityID, org2MSP)
+	})
+
+	var childIDs []string
+	endorse(t, ledger, org1Client, map[string]string{"commodity_children": casesProperties}, "SplitCommodity", func(ctx contractapi.TransactionContextInterface) (err error) {
+		childIDs, err = s.SplitCommodity(ctx, commodityID)
+		return err
+	})
+	endorse(t, ledger, org1Client, map[string]string{"commodity_properties": `{"name":"crate"}`}, "AssembleCommodity", func(ctx contractapi.TransactionContextInterface) error {
+		_, err := s.AssembleCommodity(ctx, childIDs[0], "", "a crate")
+		return err
+	})
+	endorse(t, ledger, org1Client, nil, "RetireCommodity", func(ctx contractapi.TransactionContextInterface) error {
+		return s.RetireCommodity(ctx, childIDs[1], "destroyed")
+	})
+
+	// The peers of other orgs still cannot endorse the updates of the owner
+	ctx = ledger.NewTransaction(org1Client).OnPeer(org4MSP)
+	var denied *AuthorizationError
+	if err = s.RetireCommodity(ctx, childIDs[1], "destroyed"); !errors.As(err, &denied) {
+		t.Errorf("RetireCommodity on the peer of another org: err = %v, want an AuthorizationError", err)
+	}
+}
+
+func TestTransferToEndorserIsRejected(t *testing.T) {
+	ledger := chaincodetest.NewLedger()
+	s := newContract()
+	commodityID := createCommodityWithEndorsers(t, ledger, org1Client, org3MSP, 0)
+	transferKey := transferKeyBetween(commodityID, org1MSP, org3MSP)
+	agree(t, ledger, org1Client, org3Client, commodityID, palletProperties, transferKey)
+
+	if _, err := transfer(ledger, org1Client, org3MSP, commodityID, transferKey); err == nil || !strings.Contains(err.Error(), "endorsers") {
+		t.Errorf("TransferCommodity to an endorser: err = %v", err)
+	}
+
+	ctx := ledger.NewTransaction(org1Client).WithTransient("commodity_transferKey", transferKey)
+	if err := s.ShipCommodity(ctx, commodityID, org3MSP); err == nil || !strings.Contains(err.Error(), "endorsers") {
+		t.Errorf("ShipCommodity to an endorser: err = %v", err)
+	}
+}
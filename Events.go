@@ -0,0 +1,71 @@
+package main
+
+import (
+	"encoding/json"
+	"fmt"
+
+	"github.com/hyperledger/fabric-contract-api-go/contractapi"
+)
+
+// eventSchemaVersion is the version of the CommodityEvent payload.
+// It is increased whenever a field is removed or changes meaning, consumers should ignore unknown fields.
+const eventSchemaVersion = 1
+
+// Names of the chaincode events, each transaction sets at most one of them
+const (
+	eventCommodityCreated     = "CommodityCreated"     // CreateAsset: ownerOrg
+	eventDescriptionChanged   = "DescriptionChanged"   // ChangePublicDescription: ownerOrg
+	eventTransferProposed     = "TransferProposed"     // AgreeToPut: ownerOrg, putterOrg
+	eventTransferAccepted     = "TransferAccepted"     // AgreeToGet: getterOrg
+	eventCommodityTransferred = "CommodityTransferred" // TransferCommodity: ownerOrg (the getter), putterOrg, getterOrg
+	eventRouteAmended         = "RouteAmended"         // AmendRoute: ownerOrg
+	eventDetailsChanged       = "DetailsChanged"       // SetDetailedInformation: ownerOrg
+	eventDetailsShared        = "DetailsShared"        // ShareDetailedInformation: ownerOrg, getterOrg (the counterparty)
+	eventCommoditySplit       = "CommoditySplit"       // SplitCommodity: ownerOrg, relatedCommodityIDs (the children)
+	eventCommodityAssembled   = "CommodityAssembled"   // AssembleCommodity: ownerOrg, relatedCommodityIDs (the components)
+	eventCommodityRecalled    = "CommodityRecalled"    // IssueRecall: relatedCommodityIDs (every affected commodity), recallID, severity
+	eventEndorsersChanged     = "EndorsersChanged"     // SetCommodityEndorsers: ownerOrg
+	eventCommodityShipped     = "CommodityShipped"     // ShipCommodity: ownerOrg (the putter), putterOrg, getterOrg
+	eventCommodityReceived    = "CommodityReceived"    // ConfirmReceipt: ownerOrg (the getter), putterOrg, getterOrg
+	eventTransitDisputed      = "TransitDisputed"      // RaiseTransitDispute: ownerOrg, putterOrg, getterOrg
+	eventShipmentCancelled    = "ShipmentCancelled"    // CancelShipment: ownerOrg (the putter), putterOrg, getterOrg
+	eventCommodityRetired     = "CommodityRetired"     // RetireCommodity: ownerOrg
+	eventTermsProposed        = "TermsProposed"        // ProposeTerms: ownerOrg, the terms and the proposing org are private
+	eventPropertiesDisclosed  = "PropertiesDisclosed"  // DiscloseCommodityProperties: ownerOrg, getterOrg (the auditor)
+)
+
+// CommodityEvent is the JSON payload of every chaincode event, its name is repeated in EventType.
+// It only carries public information, private commodity properties and transferKeys are never part of an event.
+type CommodityEvent struct {
+	Version     int    `json:"version"`
+	EventType   string `json:"eventType"`
+	CommodityID string `json:"commodityID"`
+	OwnerOrg    string `json:"ownerOrg,omitempty"`
+	PutterOrg   string `json:"putterOrg,omitempty"`
+	GetterOrg   string `json:"getterOrg,omitempty"`
+	// RelatedCommodityIDs lists the other commodities involved in the transaction
+	RelatedCommodityIDs []string `json:"relatedCommodityIDs,omitempty"`
+	RecallID            string   `json:"recallID,omitempty"`
+	Severity            string   `json:"severity,omitempty"`
+	TxID                string   `json:"txId"`
+}
+
+// setCommodityEvent sets the event of the transaction.
+// Fabric keeps only one event per transaction, so calling it again in the same transaction replaces the previous event.
+func setCommodityEvent(ctx contractapi.TransactionContextInterface, eventType string, event CommodityEvent) error {
+	event.Version = eventSchemaVersion
+	event.EventType = eventType
+	event.TxID = ctx.GetStub().GetTxID()
+
+	eventJSON, err := json.Marshal(event)
+	if err != nil {
+		return fmt.Errorf("failed to marshal %s event: %v", eventType, err)
+	}
+
+	err = ctx.GetStub().SetEvent(eventType, eventJSON)
+	if err != nil {
+		return fmt.Errorf("failed to set %s event: %v", eventType, err)
+	}
+
+	return nil
+}
@@ -0,0 +1,181 @@
+package main
+
+import (
+	"encoding/json"
+	"fmt"
+	"strings"
+
+	"github.com/hyperledger/fabric-contract-api-go/contractapi"
+)
+
+// Composite-key indexes of the commodities in public data, used when the state database does not support rich queries
+const (
+	typeOwnerIndex  = "OI" // OI~ownerOrg~commodityID
+	typeSourceIndex = "SI" // SI~source~commodityID
+)
+
+// commodityIndex is a CouchDB index shipped in META-INF/statedb/couchdb/indexes and its composite-key counterpart
+type commodityIndex struct {
+	field     string // field is the JSON field of the Commodity that is indexed
+	ddoc      string
+	name      string
+	keyPrefix string
+	value     func(commodity *Commodity) string
+}
+
+var (
+	ownerIndex = commodityIndex{
+		field:     "ownerCompany",
+		ddoc:      "indexOwnerDoc",
+		name:      "indexOwner",
+		keyPrefix: typeOwnerIndex,
+		value:     func(commodity *Commodity) string { return commodity.OwnerOrg },
+	}
+	sourceIndex = commodityIndex{
+		field:     "source",
+		ddoc:      "indexSourceDoc",
+		name:      "indexSource",
+		keyPrefix: typeSourceIndex,
+		value:     func(commodity *Commodity) string { return commodity.Source },
+	}
+)
+
+// QueryCommoditiesByOwner returns the commodities currently owned by ownerOrg
+func (s *SmartContract) QueryCommoditiesByOwner(ctx contractapi.TransactionContextInterface, ownerOrg string) ([]*Commodity, error) {
+	return s.queryCommoditiesByIndex(ctx, ownerIndex, ownerOrg)
+}
+
+// QueryCommoditiesBySource returns the commodities whose last upstream company is source, or that source created and still owns
+func (s *SmartContract) QueryCommoditiesBySource(ctx contractapi.TransactionContextInterface, source string) ([]*Commodity, error) {
+	return s.queryCommoditiesByIndex(ctx, sourceIndex, source)
+}
+
+// QueryCommodities returns the commodities matching a CouchDB selector, a JSON object on the public fields of Commodity,
+// e.g. {"target":"Org3MSP","status":"Delivered"}. Only commodities are returned, whatever objectType the selector asks for.
+// Rich queries are not supported by LevelDB state databases.
+func (s *SmartContract) QueryCommodities(ctx contractapi.TransactionContextInterface, selector string) ([]*Commodity, error) {
+	var fields map[string]interface{}
+	err := json.Unmarshal([]byte(selector), &fields)
+	if err != nil {
+		return nil, fmt.Errorf("selector must be a JSON object: %v", err)
+	}
+	if fields == nil {
+		fields = map[string]interface{}{}
+	}
+	fields["objectType"] = "Commodity"
+
+	queryJSON, err := json.Marshal(map[string]interface{}{"selector": fields})
+	if err != nil {
+		return nil, fmt.Errorf("failed to marshal query: %v", err)
+	}
+
+	commodities, err := getCommodityQueryResult(ctx, string(queryJSON))
+	if isRichQueryNotSupported(err) {
+		return nil, fmt.Errorf("QueryCommodities needs a CouchDB state database, use QueryCommoditiesByOwner or QueryCommoditiesBySource: %v", err)
+	}
+	return commodities, err
+}
+
+// queryCommoditiesByIndex returns the commodities whose indexed field equals value.
+// The CouchDB index is used if the state database supports rich queries, the composite-key index otherwise.
+// Commodities that were not updated since the composite-key indexes were introduced are only found by CouchDB.
+func (s *SmartContract) queryCommoditiesByIndex(ctx contractapi.TransactionContextInterface, index commodityIndex, value string) ([]*Commodity, error) {
+	queryJSON, err := json.Marshal(map[string]interface{}{
+		"selector":  map[string]string{"objectType": "Commodity", index.field: value},
+		"use_index": []string{"_design/" + index.ddoc, index.name},
+	})
+	if err != nil {
+		return nil, fmt.Errorf("failed to marshal query: %v", err)
+	}
+
+	commodities, err := getCommodityQueryResult(ctx, string(queryJSON))
+	if !isRichQueryNotSupported(err) {
+		return commodities, err
+	}
+
+	indexIterator, err := ctx.GetStub().GetStateByPartialCompositeKey(index.keyPrefix, []string{value})
+	if err != nil {
+		return nil, fmt.Errorf("failed to read from world state: %v", err)
+	}
+	defer indexIterator.Close()
+
+	commodities = []*Commodity{}
+	for indexIterator.HasNext() {
+		response, err := indexIterator.Next()
+		if err != nil {
+			return nil, err
+		}
+
+		_, attributes, err := ctx.GetStub().SplitCompositeKey(response.Key)
+		if err != nil {
+			return nil, fmt.Errorf("failed to split composite key: %v", err)
+		}
+		commodity, err := s.ReadCommodity(ctx, attributes[1])
+		if err != nil {
+			return nil, err
+		}
+		commodities = append(commodities, commodity)
+	}
+
+	return commodities, nil
+}
+
+// getCommodityQueryResult runs a rich query whose selector is restricted to commodities
+func getCommodityQueryResult(ctx contractapi.TransactionContextInterface, queryJSON string) ([]*Commodity, error) {
+	resultsIterator, err := ctx.GetStub().GetQueryResult(queryJSON)
+	if err != nil {
+		return nil, err
+	}
+	defer resultsIterator.Close()
+
+	commodities := []*Commodity{}
+	for resultsIterator.HasNext() {
+		response, err := resultsIterator.Next()
+		if err != nil {
+			return nil, err
+		}
+
+		var commodity *Commodity
+		err = json.Unmarshal(response.Value, &commodity)
+		if err != nil {
+			return nil, err
+		}
+		commodities = append(commodities, commodity)
+	}
+
+	return commodities, nil
+}
+
+// isRichQueryNotSupported tells whether a query failed because the peer uses a LevelDB state database
+func isRichQueryNotSupported(err error) bool {
+	return err != nil && strings.Contains(err.Error(), "not supported for leveldb")
+}
+
+// updateCommodityIndexes moves the composite-key index entries of a commodity from its previous public data to the updated one.
+// The entries are written on every update, so that commodities created before the indexes get indexed on their next update.
+func updateCommodityIndexes(ctx contractapi.TransactionContextInterface, previous *Commodity, updated *Commodity) error {
+	for _, index := range []commodityIndex{ownerIndex, sourceIndex} {
+		if previous != nil && index.value(previous) != index.value(updated) {
+			previousKey, err := ctx.GetStub().CreateCompositeKey(index.keyPrefix, []string{index.value(previous), previous.ID})
+			if err != nil {
+				return fmt.Errorf("failed to create composite key: %v", err)
+			}
+			err = ctx.GetStub().DelState(previousKey)
+			if err != nil {
+				return fmt.Errorf("failed to delete %s index entry: %v", index.field, err)
+			}
+		}
+
+		key, err := ctx.GetStub().CreateCompositeKey(index.keyPrefix, []string{index.value(updated), updated.ID})
+		if err != nil {
+			return fmt.Errorf("failed to create composite key: %v", err)
+		}
+		// Like in the Fabric samples, the value of an index entry is never read and cannot be empty
+		err = ctx.GetStub().PutState(key, []byte{0x00})
+		if err != nil {
+			return fmt.Errorf("failed to put %s index entry: %v", index.field, err)
+		}
+	}
+
+	return nil
+}
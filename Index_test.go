@@ -0,0 +1,52 @@
+package main
+
+import (
+	"strings"
+	"testing"
+
+	"SupplyChainTrackingChaincode/chaincodetest"
+)
+
+// The ledger fake has no rich queries, like a LevelDB state database, so the composite-key indexes are used
+func TestQueryCommoditiesByOwnerAndSource(t *testing.T) {
+	ledger := chaincodetest.NewLedger()
+	s := newContract()
+	palletID := createCommodity(t, ledger, org1Client, palletProperties)
+	crateID := createCommodity(t, ledger, org1Client, `{"name":"crate","weight":12}`)
+	handOver(t, ledger, org1Client, org2Client, palletID)
+
+	ids := func(commodities []*Commodity, err error) string {
+		t.Helper()
+		if err != nil {
+			t.Fatalf("query: %v", err)
+		}
+		var ids []string
+		for _, commodity := range commodities {
+			ids = append(ids, commodity.ID)
+		}
+		return strings.Join(ids, ",")
+	}
+
+	ctx := ledger.NewTransaction(org3Client)
+	if got := ids(s.QueryCommoditiesByOwner(ctx, org1MSP)); got != crateID {
+		t.Errorf("commodities owned by org1 = %s, want %s", got, crateID)
+	}
+	if got := ids(s.QueryCommoditiesByOwner(ctx, org2MSP)); got != palletID {
+		t.Errorf("commodities owned by org2 = %s, want %s", got, palletID)
+	}
+	if got := ids(s.QueryCommoditiesByOwner(ctx, org3MSP)); got != "" {
+		t.Errorf("commodities owned by org3 = %s, want none", got)
+	}
+
+	got := ids(s.QueryCommoditiesBySource(ctx, org1MSP))
+	if len(got) != 2*len(palletID)+1 || !strings.Contains(got, palletID) || !strings.Contains(got, crateID) {
+		t.Errorf("commodities from org1 = %s", got)
+	}
+
+	if _, err := s.QueryCommodities(ctx, `{"target":"Org3MSP"}`); err == nil || !strings.Contains(err.Error(), "CouchDB") {
+		t.Errorf("QueryCommodities on LevelDB: err = %v", err)
+	}
+	if _, err := s.QueryCommodities(ctx, `["target"]`); err == nil || !strings.Contains(err.Error(), "JSON object") {
+		t.Errorf("QueryCommodities with an invalid selector: err = %v", err)
+	}
+}
@@ -0,0 +1,247 @@
+package main
+
+import (
+	"encoding/json"
+	"fmt"
+	"os"
+	"strings"
+
+	"github.com/hyperledger/fabric-contract-api-go/contractapi"
+)
+
+// typeOrgRole is the prefix of OR~role, the orgs granted a channel-wide role in public data
+const typeOrgRole = "OR"
+
+// Channel-wide roles of orgs. Unlike the roles of clients of the permission matrix, they are kept on the ledger
+// and granted by the admin orgs: every role key has a state-based endorsement policy requiring the peers of a majority
+// of the admin orgs, so no role changes without their approval, whatever the chaincode endorsement policy.
+const (
+	orgRoleAdmin       = "admin"       // grants the org roles, see SetOrgRole
+	orgRoleRegulator   = "regulator"   // recalls any commodity
+	orgRoleTokenIssuer = "tokenIssuer" // mints settlement tokens
+	orgRoleAuditor     = "auditor"     // receives the private properties owners disclose
+)
+
+// adminMSPIDsEnv configures the comma separated list of admin orgs InitOrgRoles grants the admin role to
+const adminMSPIDsEnv = "CHAINCODE_ADMIN_MSPIDS"
+
+// orgRoleEnvs configure, for each org role, the comma separated list of orgs InitOrgRoles grants it to
+var orgRoleEnvs = []struct {
+	role string
+	env  string
+}{
+	{orgRoleAdmin, adminMSPIDsEnv},
+	{orgRoleRegulator, "CHAINCODE_REGULATOR_MSPIDS"},
+	{orgRoleTokenIssuer, "CHAINCODE_TOKEN_ISSUER_MSPIDS"},
+	{orgRoleAuditor, "CHAINCODE_AUDITOR_MSPIDS"},
+}
+
+// OrgRole lists the orgs granted a channel-wide role
+type OrgRole struct {
+	ObjectType string   `json:"objectType"`
+	Role       string   `json:"role"`
+	MSPIDs     []string `json:"mspIDs"`
+}
+
+// SetOrgRole grants a channel-wide role, e.g. regulator, to a comma separated list of orgs
+// and revokes it from any other org. An empty list revokes the role from every org, except for the admin role.
+// SetOrgRole can only be called by an admin org, and commits once the peers of a majority of the admin orgs endorse it.
+// A change of the admin orgs applies to the approval of the next changes of every role.
+func (s *SmartContract) SetOrgRole(ctx contractapi.TransactionContextInterface, role string, mspIDs string) (*OrgRole, error) {
+	if !isOrgRole(role) {
+		return nil, fmt.Errorf("unknown org role %q", role)
+	}
+
+	clientOrgID, err := getClientOrgID(ctx)
+	if err != nil {
+		return nil, err
+	}
+	admins, err := getOrgRole(ctx, orgRoleAdmin)
+	if err != nil {
+		return nil, err
+	}
+	if indexOf(admins.MSPIDs, clientOrgID) < 0 {
+		return nil, &AuthorizationError{ClientOrg: clientOrgID, Action: fmt.Sprintf("set the org role %s, only admin orgs can", role)}
+	}
+
+	orgRole := &OrgRole{ObjectType: "OrgRole", Role: role, MSPIDs: splitMSPIDs(mspIDs)}
+	if role != orgRoleAdmin {
+		err = putOrgRole(ctx, orgRole, admins.MSPIDs)
+		if err != nil {
+			return nil, err
+		}
+		return orgRole, nil
+	}
+
+	if len(orgRole.MSPIDs) == 0 {
+		return nil, fmt.Errorf("the admin role cannot be revoked from every org")
+	}
+	err = putOrgRole(ctx, orgRole, orgRole.MSPIDs)
+	if err != nil {
+		return nil, err
+	}
+	// The other roles are now approved by the new admin orgs
+	for _, roleEnv := range orgRoleEnvs {
+		if roleEnv.role == orgRoleAdmin {
+			continue
+		}
+		otherRole, err := getOrgRole(ctx, roleEnv.role)
+		if err != nil {
+			return nil, err
+		}
+		if otherRole.MSPIDs == nil {
+			continue
+		}
+		err = setOrgRoleEndorsementPolicy(ctx, roleEnv.role, orgRole.MSPIDs)
+		if err != nil {
+			return nil, err
+		}
+	}
+	return orgRole, nil
+}
+
+// InitOrgRoles grants the org roles to the orgs configured by their environment variables, e.g. CHAINCODE_ADMIN_MSPIDS,
+// and returns the roles it set. It can only run once, before any admin org is set, and the caller must be one of
+// the admin orgs it grants. As it trusts the configuration of the endorsing peer, it is meant to be invoked as
+// the init transaction of the chaincode definition (--init-required), which runs before any other transaction.
+// Roles already on the ledger keep their orgs, use SetOrgRole to change them.
+func (s *SmartContract) InitOrgRoles(ctx contractapi.TransactionContextInterface) ([]OrgRole, error) {
+	clientOrgID, err := getClientOrgID(ctx)
+	if err != nil {
+		return nil, err
+	}
+	admins, err := getOrgRole(ctx, orgRoleAdmin)
+	if err != nil {
+		return nil, err
+	}
+	if admins.MSPIDs != nil {
+		return nil, fmt.Errorf("org roles were already initialized, use SetOrgRole to change them")
+	}
+	admins.MSPIDs = mspIDsFromEnv(adminMSPIDsEnv)
+	if indexOf(admins.MSPIDs, clientOrgID) < 0 {
+		return nil, &AuthorizationError{ClientOrg: clientOrgID, Action: "initialize the org roles without being one of the admin orgs"}
+	}
+
+	initialized := []OrgRole{}
+	for _, roleEnv := range orgRoleEnvs {
+		orgRole, err := getOrgRole(ctx, roleEnv.role)
+		if err != nil {
+			return nil, err
+		}
+		if orgRole.MSPIDs == nil {
+			orgRole.MSPIDs = mspIDsFromEnv(roleEnv.env)
+		}
+		err = putOrgRole(ctx, orgRole, admins.MSPIDs)
+		if err != nil {
+			return nil, err
+		}
+		initialized = append(initialized, *orgRole)
+	}
+	return initialized, nil
+}
+
+// GetOrgRole returns the orgs granted a channel-wide role
+func (s *SmartContract) GetOrgRole(ctx contractapi.TransactionContextInterface, role string) (*OrgRole, error) {
+	if !isOrgRole(role) {
+		return nil, fmt.Errorf("unknown org role %q", role)
+	}
+	return getOrgRole(ctx, role)
+}
+
+// hasOrgRole tells whether an org was granted a channel-wide role
+func hasOrgRole(ctx contractapi.TransactionContextInterface, role string, mspID string) (bool, error) {
+	orgRole, err := getOrgRole(ctx, role)
+	if err != nil {
+		return false, err
+	}
+	return indexOf(orgRole.MSPIDs, mspID) >= 0, nil
+}
+
+// getOrgRole reads the orgs granted a role, whose MSPIDs are nil if the role was never set
+func getOrgRole(ctx contractapi.TransactionContextInterface, role string) (*OrgRole, error) {
+	roleKey, err := ctx.GetStub().CreateCompositeKey(typeOrgRole, []string{role})
+	if err != nil {
+		return nil, fmt.Errorf("failed to create composite key: %v", err)
+	}
+	roleJSON, err := ctx.GetStub().GetState(roleKey)
+	if err != nil {
+		return nil, fmt.Errorf("failed to read from world state: %v", err)
+	}
+
+	orgRole := &OrgRole{ObjectType: "OrgRole", Role: role}
+	if roleJSON == nil {
+		return orgRole, nil
+	}
+	err = json.Unmarshal(roleJSON, orgRole)
+	if err != nil {
+		return nil, err
+	}
+	return orgRole, nil
+}
+
+// putOrgRole writes the orgs granted a role in public data, an empty list is kept to tell that the role was set.
+// The next update of the role needs the endorsement of a majority of the given admin orgs.
+func putOrgRole(ctx contractapi.TransactionContextInterface, orgRole *OrgRole, adminMSPIDs []string) error {
+	if orgRole.MSPIDs == nil {
+		orgRole.MSPIDs = []string{}
+	}
+
+	roleKey, err := ctx.GetStub().CreateCompositeKey(typeOrgRole, []string{orgRole.Role})
+	if err != nil {
+		return fmt.Errorf("failed to create composite key: %v", err)
+	}
+	roleJSON, err := json.Marshal(orgRole)
+	if err != nil {
+		return fmt.Errorf("failed to marshal org role: %v", err)
+	}
+
+	err = ctx.GetStub().PutState(roleKey, roleJSON)
+	if err != nil {
+		return fmt.Errorf("failed to put org role in public data: %v", err)
+	}
+	return setOrgRoleEndorsementPolicy(ctx, orgRole.Role, adminMSPIDs)
+}
+
+// setOrgRoleEndorsementPolicy requires the peers of a majority of the admin orgs to endorse the updates of a role
+func setOrgRoleEndorsementPolicy(ctx contractapi.TransactionContextInterface, role string, adminMSPIDs []string) error {
+	roleKey, err := ctx.GetStub().CreateCompositeKey(typeOrgRole, []string{role})
+	if err != nil {
+		return fmt.Errorf("failed to create composite key: %v", err)
+	}
+	policy, err := coEndorsementPolicy(nil, adminMSPIDs, len(adminMSPIDs)/2+1)
+	if err != nil {
+		return err
+	}
+	err = ctx.GetStub().SetStateValidationParameter(roleKey, policy)
+	if err != nil {
+		return fmt.Errorf("failed to set validation parameter on org role: %v", err)
+	}
+	return nil
+}
+
+// isOrgRole tells whether a role is one of the channel-wide roles of orgs
+func isOrgRole(role string) bool {
+	for _, roleEnv := range orgRoleEnvs {
+		if roleEnv.role == role {
+			return true
+		}
+	}
+	return false
+}
+
+// mspIDsFromEnv returns the orgs of a comma separated list configured by an environment variable, if any.
+// The variable must be the same on every peer, otherwise their endorsements of the transactions reading it differ.
+func mspIDsFromEnv(name string) []string {
+	return splitMSPIDs(os.Getenv(name))
+}
+
+// splitMSPIDs splits a comma separated list of orgs, ignoring blank entries
+func splitMSPIDs(mspIDs string) []string {
+	var orgs []string
+	for _, mspID := range strings.Split(mspIDs, ",") {
+		if mspID = strings.TrimSpace(mspID); mspID != "" {
+			orgs = append(orgs, mspID)
+		}
+	}
+	return orgs
+}
@@ -0,0 +1,153 @@
+package main
+
+import (
+	"errors"
+	"reflect"
+	"strings"
+	"testing"
+
+	"SupplyChainTrackingChaincode/chaincodetest"
+
+	"github.com/hyperledger/fabric-contract-api-go/contractapi"
+)
+
+// initOrgRoles initializes the org roles of the ledger with org1 as the only admin org
+func initOrgRoles(t *testing.T, ledger *chaincodetest.Ledger) {
+	t.Helper()
+	t.Setenv(adminMSPIDsEnv, org1MSP)
+
+	ctx := ledger.NewTransaction(org1Client)
+	if _, err := newContract().InitOrgRoles(ctx); err != nil {
+		t.Fatalf("InitOrgRoles: %v", err)
+	}
+	if err := ctx.Commit(); err != nil {
+		t.Fatalf("commit InitOrgRoles: %v", err)
+	}
+}
+
+// grantOrgRole grants a channel-wide role to orgs on the ledger by the admin org org1
+func grantOrgRole(t *testing.T, ledger *chaincodetest.Ledger, role string, mspIDs ...string) {
+	t.Helper()
+
+	if admin, err := hasOrgRole(ledger.NewTransaction(org1Client), orgRoleAdmin, org1MSP); err != nil || !admin {
+		initOrgRoles(t, ledger)
+	}
+	ctx := ledger.NewTransaction(org1Client)
+	if _, err := newContract().SetOrgRole(ctx, role, strings.Join(mspIDs, ",")); err != nil {
+		t.Fatalf("SetOrgRole: %v", err)
+	}
+	if err := ctx.Commit(); err != nil {
+		t.Fatalf("commit SetOrgRole: %v", err)
+	}
+}
+
+func TestSetOrgRole(t *testing.T) {
+	ledger := chaincodetest.NewLedger()
+	s := newContract()
+	initOrgRoles(t, ledger)
+
+	if _, err := s.SetOrgRole(ledger.NewTransaction(org1Client), "superuser", org1MSP); err == nil {
+		t.Error("SetOrgRole of an unknown role succeeded")
+	}
+
+	grantOrgRole(t, ledger, orgRoleRegulator, org3MSP, " ", org2MSP)
+	orgRole, err := s.GetOrgRole(ledger.NewTransaction(org1Client), orgRoleRegulator)
+	if err != nil || !reflect.DeepEqual(orgRole.MSPIDs, []string{org3MSP, org2MSP}) {
+		t.Errorf("GetOrgRole = %+v, %v", orgRole, err)
+	}
+
+	grantOrgRole(t, ledger, orgRoleRegulator)
+	orgRole, err = s.GetOrgRole(ledger.NewTransaction(org1Client), orgRoleRegulator)
+	if err != nil || orgRole.MSPIDs == nil || len(orgRole.MSPIDs) != 0 {
+		t.Errorf("GetOrgRole after revoking the role = %+v, %v", orgRole, err)
+	}
+
+	if _, err = s.SetOrgRole(ledger.NewTransaction(org1Client), orgRoleAdmin, " "); err == nil {
+		t.Error("SetOrgRole revoking the admin role from every org succeeded")
+	}
+}
+
+func TestNonAdminOrgCannotGrantItselfARole(t *testing.T) {
+	ledger := chaincodetest.NewLedger()
+	s := newContract()
+	initOrgRoles(t, ledger)
+
+	var denied *AuthorizationError
+	if _, err := s.SetOrgRole(ledger.NewTransaction(org2Client), orgRoleTokenIssuer, org2MSP); !errors.As(err, &denied) {
+		t.Errorf("SetOrgRole by a non-admin org: err = %v, want an AuthorizationError", err)
+	}
+
+	// Writing the role key without the chaincode's check still needs the endorsement of the admin orgs
+	ctx := ledger.NewTransaction(org2Client)
+	if err := putOrgRole(ctx, &OrgRole{ObjectType: "OrgRole", Role: orgRoleTokenIssuer, MSPIDs: []string{org2MSP}}, []string{org2MSP}); err != nil {
+		t.Fatalf("putOrgRole: %v", err)
+	}
+	if err := ctx.Commit(); err == nil {
+		t.Error("token issuer role granted without the endorsement of the admin orgs")
+	}
+	if issuer, err := hasOrgRole(ledger.NewTransaction(org2Client), orgRoleTokenIssuer, org2MSP); err != nil || issuer {
+		t.Errorf("org2 is token issuer = %v, %v", issuer, err)
+	}
+}
+
+func TestSetOrgRoleNeedsMajorityOfAdminOrgs(t *testing.T) {
+	ledger := chaincodetest.NewLedger()
+	s := newContract()
+	grantOrgRole(t, ledger, orgRoleAdmin, org1MSP, org2MSP, org3MSP)
+
+	ctx := ledger.NewTransaction(org1Client)
+	if _, err := s.SetOrgRole(ctx, orgRoleRegulator, org1MSP); err != nil {
+		t.Fatalf("SetOrgRole: %v", err)
+	}
+	if err := ctx.Commit(); err == nil {
+		t.Fatal("role set with the endorsement of a single admin org out of 3")
+	}
+
+	ctx = ledger.NewTransaction(org1Client).EndorsedBy(org1MSP, org3MSP)
+	err := ctx.Endorse(func(ctx contractapi.TransactionContextInterface) error {
+		_, err := s.SetOrgRole(ctx, orgRoleRegulator, org1MSP)
+		return err
+	})
+	if err != nil {
+		t.Fatalf("SetOrgRole: %v", err)
+	}
+	if err = ctx.Commit(); err != nil {
+		t.Fatalf("commit SetOrgRole endorsed by 2 admin orgs out of 3: %v", err)
+	}
+	if regulator, err := hasOrgRole(ledger.NewTransaction(org1Client), orgRoleRegulator, org1MSP); err != nil || !regulator {
+		t.Errorf("org1 is regulator = %v, %v", regulator, err)
+	}
+}
+
+func TestInitOrgRolesOnlyRunsOnce(t *testing.T) {
+	ledger := chaincodetest.NewLedger()
+	s := newContract()
+	t.Setenv(adminMSPIDsEnv, org1MSP)
+	t.Setenv("CHAINCODE_REGULATOR_MSPIDS", org3MSP+", "+org2MSP)
+
+	var denied *AuthorizationError
+	if _, err := s.InitOrgRoles(ledger.NewTransaction(org2Client)); !errors.As(err, &denied) {
+		t.Errorf("InitOrgRoles by an org that is not an admin: err = %v, want an AuthorizationError", err)
+	}
+
+	ctx := ledger.NewTransaction(org1Client)
+	initialized, err := s.InitOrgRoles(ctx)
+	if err != nil || len(initialized) != len(orgRoleEnvs) {
+		t.Fatalf("InitOrgRoles = %+v, %v", initialized, err)
+	}
+	if err = ctx.Commit(); err != nil {
+		t.Fatalf("commit InitOrgRoles: %v", err)
+	}
+	if regulator, err := hasOrgRole(ledger.NewTransaction(org1Client), orgRoleRegulator, org2MSP); err != nil || !regulator {
+		t.Errorf("org2 is regulator = %v, %v", regulator, err)
+	}
+
+	// A peer configured differently does not change the roles on the ledger
+	t.Setenv(adminMSPIDsEnv, org2MSP)
+	if _, err = s.InitOrgRoles(ledger.NewTransaction(org2Client)); err == nil {
+		t.Error("InitOrgRoles succeeded once the roles were initialized")
+	}
+	if admin, err := hasOrgRole(ledger.NewTransaction(org1Client), orgRoleAdmin, org2MSP); err != nil || admin {
+		t.Errorf("org2 is admin = %v, %v", admin, err)
+	}
+}
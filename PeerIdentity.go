@@ -0,0 +1,55 @@
+package main
+
+import (
+	"fmt"
+	"os"
+
+	"github.com/hyperledger/fabric-chaincode-go/shim"
+	"github.com/hyperledger/fabric-contract-api-go/contractapi"
+)
+
+// peerMSPIDEnv configures the org of the peer for chaincode that is not launched by the peer,
+// e.g. chaincode deployed as an external service, where CORE_PEER_LOCALMSPID is not set
+const peerMSPIDEnv = "CHAINCODE_PEER_MSPID"
+
+// PeerIdentityProvider tells which org the peer executing a transaction belongs to.
+// Private data of an implicit collection can only be read or written from a peer of the collection's org.
+type PeerIdentityProvider interface {
+	GetPeerMSPID(ctx contractapi.TransactionContextInterface) (string, error)
+}
+
+// EnvPeerIdentity reads the org of the peer from CORE_PEER_LOCALMSPID, which the peer sets for the chaincode it launches
+type EnvPeerIdentity struct{}
+
+// GetPeerMSPID returns the MSP ID set by the peer in the chaincode's environment
+func (EnvPeerIdentity) GetPeerMSPID(ctx contractapi.TransactionContextInterface) (string, error) {
+	return shim.GetMSPID()
+}
+
+// StaticPeerIdentity is the MSP ID of the org of the peer, configured when the chaincode is deployed
+type StaticPeerIdentity string
+
+// GetPeerMSPID returns the configured MSP ID
+func (id StaticPeerIdentity) GetPeerMSPID(ctx contractapi.TransactionContextInterface) (string, error) {
+	if id == "" {
+		return "", fmt.Errorf("peer MSP ID is not configured")
+	}
+	return string(id), nil
+}
+
+// peerIdentityFromEnv returns the static peer org configured by CHAINCODE_PEER_MSPID, if any,
+// otherwise the org set by the peer in CORE_PEER_LOCALMSPID
+func peerIdentityFromEnv() PeerIdentityProvider {
+	if mspID := os.Getenv(peerMSPIDEnv); mspID != "" {
+		return StaticPeerIdentity(mspID)
+	}
+	return EnvPeerIdentity{}
+}
+
+// peerIdentity returns the configured peer identity provider, or EnvPeerIdentity by default
+func (s *SmartContract) peerIdentity() PeerIdentityProvider {
+	if s.PeerIdentity == nil {
+		return EnvPeerIdentity{}
+	}
+	return s.PeerIdentity
+}
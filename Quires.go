@@ -3,23 +3,44 @@ package main
 import (
 	"encoding/json"
 	"fmt"
+	"sort"
+	"strings"
 	"time"
 
 	"github.com/golang/protobuf/ptypes"
 	"github.com/hyperledger/fabric-contract-api-go/contractapi"
 )
 
-// QueryResult structure used for handling result of query
+// QueryResult structure used for handling result of query, Record is nil when the commodity was deleted
 type QueryResult struct {
-	Record    *Commodity
-	TxId      string    `json:"txId"`
-	Timestamp time.Time `json:"timestamp"`
+	CommodityID string `json:"commodityID"` // CommodityID tells which commodity was modified, histories can span commodities split from one another
+	Record      *Commodity
+	TxId        string    `json:"txId"`
+	Timestamp   time.Time `json:"timestamp"`
+	IsDelete    bool      `json:"isDelete"`
 }
 
-type Agreement struct {
-	ID          string `json:"commodity"`
-	TransferKey int    `json:"transferKey"`
-	TransferID  string `json:"transfer_id"`
+// HistoryQueryResult is a page of the history of a commodity, Bookmark is empty on the last page
+type HistoryQueryResult struct {
+	Records             []QueryResult `json:"records"`
+	FetchedRecordsCount int32         `json:"fetchedRecordsCount"`
+	Bookmark            string        `json:"bookmark"`
+}
+
+// AgreementRecord is an agreement of the caller and the commodity it is about
+type AgreementRecord struct {
+	CommodityID  string    `json:"commodityID"`
+	Counterparty string    `json:"counterparty"` // Counterparty is the org on the other side of the agreement, empty for agreements before version 3
+	Agreement    Agreement `json:"agreement"`
+}
+
+// AgreementQueryResult is a page of agreements, TotalCount counts the agreements matching the filters on all pages.
+// Bookmark is empty on the last page.
+type AgreementQueryResult struct {
+	Records             []AgreementRecord `json:"records"`
+	FetchedRecordsCount int32             `json:"fetchedRecordsCount"`
+	TotalCount          int32             `json:"totalCount"`
+	Bookmark            string            `json:"bookmark"`
 }
 
 // ReadCommodity returns the public commodity data
@@ -44,7 +65,7 @@ func (s *SmartContract) ReadCommodity(ctx contractapi.TransactionContextInterfac
 // GetCommodityPrivateProperties returns the immutable commodity properties from owner's private data collection
 func (s *SmartContract) GetCommodityPrivateProperties(ctx contractapi.TransactionContextInterface, commodityID string) (string, error) {
 
-	collection, err := getClientImplicitCollectionNameAndVerifyClientOrg(ctx)
+	collection, err := s.getClientImplicitCollectionNameAndVerifyClientOrg(ctx)
 	if err != nil {
 		return "", err
 	}
@@ -62,18 +83,18 @@ func (s *SmartContract) GetCommodityPrivateProperties(ctx contractapi.Transactio
 
 // GetCommodityUpstreamKey returns the Upstream company's transferKey
 func (s *SmartContract) GetCommodityUpstreamKey(ctx contractapi.TransactionContextInterface, commodityID string) (string, error) {
-	return getTransferKey(ctx, commodityID, typeCommodityForTransfer)
+	return s.getTransferKey(ctx, commodityID, typeCommodityForTransfer)
 }
 
 // GetCommodityDownstreamKey returns the Downstream company's transferKey
 func (s *SmartContract) GetCommodityDownstreamKey(ctx contractapi.TransactionContextInterface, commodityID string) (string, error) {
-	return getTransferKey(ctx, commodityID, typeCommodityKey)
+	return s.getTransferKey(ctx, commodityID, typeCommodityKey)
 }
 
 // getTransferKey gets the bid or ask price from caller's implicit private data collection
-func getTransferKey(ctx contractapi.TransactionContextInterface, commodityID string, keyType string) (string, error) {
+func (s *SmartContract) getTransferKey(ctx contractapi.TransactionContextInterface, commodityID string, keyType string) (string, error) {
 
-	collection, err := getClientImplicitCollectionNameAndVerifyClientOrg(ctx)
+	collection, err := s.getClientImplicitCollectionNameAndVerifyClientOrg(ctx)
 	if err != nil {
 		return "", err
 	}
@@ -96,16 +117,16 @@ func getTransferKey(ctx contractapi.TransactionContextInterface, commodityID str
 
 // QueryCommodityPutAgreements returns all of an organization's proposed Putting
 func (s *SmartContract) QueryCommodityPutAgreements(ctx contractapi.TransactionContextInterface) ([]Agreement, error) {
-	return queryAgreementsByType(ctx, typeCommodityForTransfer)
+	return s.queryAgreementsByType(ctx, typeCommodityForTransfer)
 }
 
 // QueryCommodityGetAgreements returns all of an organization's proposed Getting
 func (s *SmartContract) QueryCommodityGetAgreements(ctx contractapi.TransactionContextInterface) ([]Agreement, error) {
-	return queryAgreementsByType(ctx, typeCommodityKey)
+	return s.queryAgreementsByType(ctx, typeCommodityKey)
 }
 
-func queryAgreementsByType(ctx contractapi.TransactionContextInterface, agreeType string) ([]Agreement, error) {
-	collection, err := getClientImplicitCollectionNameAndVerifyClientOrg(ctx)
+func (s *SmartContract) queryAgreementsByType(ctx contractapi.TransactionContextInterface, agreeType string) ([]Agreement, error) {
+	collection, err := s.getClientImplicitCollectionNameAndVerifyClientOrg(ctx)
 	if err != nil {
 		return nil, err
 	}
@@ -136,9 +157,229 @@ func queryAgreementsByType(ctx contractapi.TransactionContextInterface, agreeTyp
 	return agreements, nil
 }
 
-// QueryCommodityHistory returns the chain of custody for a commodity since issuance
+// QueryCommodityPutAgreementsWithPagination returns a page of an organization's proposed Putting, see queryAgreementsWithPagination.
+// The counterparty of a Putting is the getter named by the agreement.
+func (s *SmartContract) QueryCommodityPutAgreementsWithPagination(ctx contractapi.TransactionContextInterface, commodityIDPrefix string, counterparty string, pageSize int32, bookmark string) (*AgreementQueryResult, error) {
+	return s.queryAgreementsWithPagination(ctx, typeCommodityForTransfer, commodityIDPrefix, counterparty, pageSize, bookmark)
+}
+
+// QueryCommodityGetAgreementsWithPagination returns a page of an organization's proposed Getting, see queryAgreementsWithPagination.
+// The counterparty of a Getting is the putter named by the agreement.
+func (s *SmartContract) QueryCommodityGetAgreementsWithPagination(ctx contractapi.TransactionContextInterface, commodityIDPrefix string, counterparty string, pageSize int32, bookmark string) (*AgreementQueryResult, error) {
+	return s.queryAgreementsWithPagination(ctx, typeCommodityKey, commodityIDPrefix, counterparty, pageSize, bookmark)
+}
+
+// queryAgreementsWithPagination returns a page of the agreements of the given type in caller's implicit private data collection,
+// ordered by commodity id. commodityIDPrefix and counterparty are optional filters, and bookmark is the one returned with
+// the previous page, empty for the first page. Private data cannot be paged by the peer, so the agreements are streamed
+// and only the requested page is kept in memory.
+func (s *SmartContract) queryAgreementsWithPagination(ctx contractapi.TransactionContextInterface, agreeType string, commodityIDPrefix string, counterparty string, pageSize int32, bookmark string) (*AgreementQueryResult, error) {
+	if pageSize <= 0 {
+		return nil, fmt.Errorf("page size must be positive: %d", pageSize)
+	}
+
+	collection, err := s.getClientImplicitCollectionNameAndVerifyClientOrg(ctx)
+	if err != nil {
+		return nil, err
+	}
+
+	agreementsIterator, err := ctx.GetStub().GetPrivateDataByPartialCompositeKey(collection, agreeType, []string{})
+	if err != nil {
+		return nil, fmt.Errorf("failed to read from private data collection: %v", err)
+	}
+	defer agreementsIterator.Close()
+
+	// The bookmark is the commodity id of the first agreement of the next page, agreements deleted since are skipped
+	page := &AgreementQueryResult{Records: []AgreementRecord{}}
+	for agreementsIterator.HasNext() {
+		resp, err := agreementsIterator.Next()
+		if err != nil {
+			return nil, err
+		}
+
+		_, keyParts, err := ctx.GetStub().SplitCompositeKey(resp.Key)
+		if err != nil {
+			return nil, fmt.Errorf("failed to split composite key: %v", err)
+		}
+		commodityID := keyParts[0]
+		if !strings.HasPrefix(commodityID, commodityIDPrefix) {
+			continue
+		}
+
+		var agreement Agreement
+		err = json.Unmarshal(resp.Value, &agreement)
+		if err != nil {
+			return nil, err
+		}
+		if counterparty != "" && agreement.counterparty(agreeType) != counterparty {
+			continue
+		}
+
+		page.TotalCount++
+		if commodityID < bookmark {
+			continue
+		}
+		if page.FetchedRecordsCount == pageSize {
+			if page.Bookmark == "" {
+				page.Bookmark = commodityID
+			}
+			continue
+		}
+
+		page.Records = append(page.Records, AgreementRecord{
+			CommodityID:  commodityID,
+			Counterparty: agreement.counterparty(agreeType),
+			Agreement:    agreement,
+		})
+		page.FetchedRecordsCount++
+	}
+
+	return page, nil
+}
+
+// QueryPutReceipts returns all receipts of the commodities an organization has transferred to a downstream company
+func (s *SmartContract) QueryPutReceipts(ctx contractapi.TransactionContextInterface) ([]Receipt, error) {
+	return s.queryReceiptsByType(ctx, typeCommodityPutReceipt)
+}
+
+// QueryGetReceipts returns all receipts of the commodities an organization has received from an upstream company
+func (s *SmartContract) QueryGetReceipts(ctx contractapi.TransactionContextInterface) ([]Receipt, error) {
+	return s.queryReceiptsByType(ctx, typeCommodityGetReceipt)
+}
+
+// GetReceipt returns the receipt of the transfer of a commodity in a given transaction from caller's implicit private data collection
+func (s *SmartContract) GetReceipt(ctx contractapi.TransactionContextInterface, commodityID string, txID string) (*Receipt, error) {
+	collection, err := s.getClientImplicitCollectionNameAndVerifyClientOrg(ctx)
+	if err != nil {
+		return nil, err
+	}
+
+	// The caller may have been either the upstream or the downstream company of the transfer
+	for _, receiptType := range []string{typeCommodityPutReceipt, typeCommodityGetReceipt} {
+		receiptKey, err := ctx.GetStub().CreateCompositeKey(receiptType, []string{commodityID, txID})
+		if err != nil {
+			return nil, fmt.Errorf("failed to create composite key: %v", err)
+		}
+
+		receiptJSON, err := ctx.GetStub().GetPrivateData(collection, receiptKey)
+		if err != nil {
+			return nil, fmt.Errorf("failed to read receipt from implicit private data collection: %v", err)
+		}
+		if receiptJSON == nil {
+			continue
+		}
+
+		var receipt *Receipt
+		err = json.Unmarshal(receiptJSON, &receipt)
+		if err != nil {
+			return nil, err
+		}
+		return receipt, nil
+	}
+
+	return nil, fmt.Errorf("receipt of commodity %s in transaction %s does not exist", commodityID, txID)
+}
+
+func (s *SmartContract) queryReceiptsByType(ctx contractapi.TransactionContextInterface, receiptType string) ([]Receipt, error) {
+	collection, err := s.getClientImplicitCollectionNameAndVerifyClientOrg(ctx)
+	if err != nil {
+		return nil, err
+	}
+
+	// Query for any object type starting with `receiptType`
+	receiptsIterator, err := ctx.GetStub().GetPrivateDataByPartialCompositeKey(collection, receiptType, []string{})
+	if err != nil {
+		return nil, fmt.Errorf("failed to read from private data collection: %v", err)
+	}
+	defer receiptsIterator.Close()
+
+	var receipts []Receipt
+	for receiptsIterator.HasNext() {
+		resp, err := receiptsIterator.Next()
+		if err != nil {
+			return nil, err
+		}
+
+		var receipt Receipt
+		err = json.Unmarshal(resp.Value, &receipt)
+		if err != nil {
+			return nil, err
+		}
+
+		receipts = append(receipts, receipt)
+	}
+
+	return receipts, nil
+}
+
+// QueryCommodityHistory returns the chain of custody for a commodity since issuance.
+// The history of a commodity split from a parent continues with the history of the parent, and so on.
 func (s *SmartContract) QueryCommodityHistory(ctx contractapi.TransactionContextInterface, assetID string) ([]QueryResult, error) {
-	resultsIterator, err := ctx.GetStub().GetHistoryForKey(assetID)
+	return getProvenanceHistory(ctx, assetID, make(map[string]bool))
+}
+
+// QueryCommodityHistoryWithPagination returns a page of the history of a commodity from oldest to newest.
+// fromTime and toTime are optional RFC 3339 timestamps bounding the modifications returned, both inclusive,
+// and bookmark is the one returned with the previous page, empty for the first page.
+func (s *SmartContract) QueryCommodityHistoryWithPagination(ctx contractapi.TransactionContextInterface, commodityID string, fromTime string, toTime string, pageSize int32, bookmark string) (*HistoryQueryResult, error) {
+	if pageSize <= 0 {
+		return nil, fmt.Errorf("page size must be positive: %d", pageSize)
+	}
+
+	from, err := parseOptionalTime(fromTime)
+	if err != nil {
+		return nil, fmt.Errorf("invalid fromTime: %v", err)
+	}
+	to, err := parseOptionalTime(toTime)
+	if err != nil {
+		return nil, fmt.Errorf("invalid toTime: %v", err)
+	}
+
+	history, err := getCommodityHistory(ctx, commodityID)
+	if err != nil {
+		return nil, err
+	}
+	sortHistory(history)
+
+	var filtered []QueryResult
+	for _, result := range history {
+		if (!from.IsZero() && result.Timestamp.Before(from)) || (!to.IsZero() && result.Timestamp.After(to)) {
+			continue
+		}
+		filtered = append(filtered, result)
+	}
+
+	// The bookmark is the txId of the first modification of the next page, which is stable as history only grows
+	start := 0
+	if bookmark != "" {
+		start = -1
+		for i, result := range filtered {
+			if result.TxId == bookmark {
+				start = i
+				break
+			}
+		}
+		if start < 0 {
+			return nil, fmt.Errorf("bookmark %s does not match the history of %s", bookmark, commodityID)
+		}
+	}
+
+	end := start + int(pageSize)
+	page := &HistoryQueryResult{}
+	if end < len(filtered) {
+		page.Bookmark = filtered[end].TxId
+	} else {
+		end = len(filtered)
+	}
+	page.Records = filtered[start:end]
+	page.FetchedRecordsCount = int32(len(page.Records))
+
+	return page, nil
+}
+
+// getCommodityHistory returns every modification of a commodity, including its deletion, in the order returned by the ledger
+func getCommodityHistory(ctx contractapi.TransactionContextInterface, commodityID string) ([]QueryResult, error) {
+	resultsIterator, err := ctx.GetStub().GetHistoryForKey(commodityID)
 	if err != nil {
 		return nil, err
 	}
@@ -151,10 +392,13 @@ func (s *SmartContract) QueryCommodityHistory(ctx contractapi.TransactionContext
 			return nil, err
 		}
 
+		// A deletion has no value to unmarshal
 		var commodity *Commodity
-		err = json.Unmarshal(response.Value, &commodity)
-		if err != nil {
-			return nil, err
+		if !response.IsDelete {
+			err = json.Unmarshal(response.Value, &commodity)
+			if err != nil {
+				return nil, err
+			}
 		}
 
 		timestamp, err := ptypes.Timestamp(response.Timestamp)
@@ -162,12 +406,139 @@ func (s *SmartContract) QueryCommodityHistory(ctx contractapi.TransactionContext
 			return nil, err
 		}
 		record := QueryResult{
-			TxId:      response.TxId,
-			Timestamp: timestamp,
-			Record:    commodity,
+			CommodityID: commodityID,
+			TxId:        response.TxId,
+			Timestamp:   timestamp,
+			Record:      commodity,
+			IsDelete:    response.IsDelete,
 		}
 		results = append(results, record)
 	}
 
 	return results, nil
 }
+
+// getProvenanceHistory returns the history of a commodity followed by the histories of the commodities it was made from,
+// each commodity is only listed once
+func getProvenanceHistory(ctx contractapi.TransactionContextInterface, commodityID string, listed map[string]bool) ([]QueryResult, error) {
+	listed[commodityID] = true
+
+	history, err := getCommodityHistory(ctx, commodityID)
+	if err != nil {
+		return nil, err
+	}
+
+	// The parents of a commodity never change, any record of it tells them
+	var parents []string
+	for _, result := range history {
+		if !result.IsDelete {
+			parents = result.Record.Parents
+			break
+		}
+	}
+
+	for _, parentID := range parents {
+		if listed[parentID] {
+			continue
+		}
+		parentHistory, err := getProvenanceHistory(ctx, parentID, listed)
+		if err != nil {
+			return nil, err
+		}
+		history = append(history, parentHistory...)
+	}
+
+	return history, nil
+}
+
+// sortHistory orders modifications from oldest to newest, as the ledger does not guarantee an order
+func sortHistory(history []QueryResult) {
+	sort.SliceStable(history, func(i, j int) bool {
+		return history[i].Timestamp.Before(history[j].Timestamp)
+	})
+}
+
+// parseOptionalTime parses an RFC 3339 timestamp, an empty string is the zero time
+func parseOptionalTime(value string) (time.Time, error) {
+	if value == "" {
+		return time.Time{}, nil
+	}
+	return time.Parse(time.RFC3339, value)
+}
+
+// CustodySegment is a period during which an org owned a commodity.
+// The segment of the current holder has no ToTxId and no ReleasedAt, its duration runs until the query.
+type CustodySegment struct {
+	Org             string    `json:"org"`
+	FromTxId        string    `json:"fromTxId"`
+	ToTxId          string    `json:"toTxId"`
+	AcquiredAt      time.Time `json:"acquiredAt"`
+	ReleasedAt      time.Time `json:"releasedAt"`
+	DurationSeconds int64     `json:"durationSeconds"`
+}
+
+// CustodyChain lists every org that owned a commodity, from the originating org to the current holder.
+// CurrentHolder is empty once the commodity was deleted.
+type CustodyChain struct {
+	CommodityID   string           `json:"commodityID"`
+	OriginOrg     string           `json:"originOrg"`
+	CurrentHolder string           `json:"currentHolder"`
+	Segments      []CustodySegment `json:"segments"`
+}
+
+// GetCustodyChain folds the history of a commodity into the ordered custody segments of its owners.
+// Only the commodity's own history is folded, the custody of the commodities it was split from or assembled of is not.
+func (s *SmartContract) GetCustodyChain(ctx contractapi.TransactionContextInterface, commodityID string) (*CustodyChain, error) {
+	history, err := getCommodityHistory(ctx, commodityID)
+	if err != nil {
+		return nil, err
+	}
+	if len(history) == 0 {
+		return nil, fmt.Errorf("%s does not exist", commodityID)
+	}
+
+	sortHistory(history)
+
+	txTime, err := getTxTime(ctx)
+	if err != nil {
+		return nil, err
+	}
+
+	chain := &CustodyChain{CommodityID: commodityID}
+	var current *CustodySegment
+	for _, result := range history {
+		if current != nil && !result.IsDelete && current.Org == result.Record.OwnerOrg {
+			// e.g. a description change, the custody does not change
+			continue
+		}
+
+		if current != nil {
+			current.ToTxId = result.TxId
+			current.ReleasedAt = result.Timestamp
+			current.DurationSeconds = int64(result.Timestamp.Sub(current.AcquiredAt).Seconds())
+			chain.Segments = append(chain.Segments, *current)
+			current = nil
+		}
+
+		// Nobody holds a deleted commodity
+		if result.IsDelete {
+			continue
+		}
+		if chain.OriginOrg == "" {
+			chain.OriginOrg = result.Record.OwnerOrg
+		}
+		current = &CustodySegment{
+			Org:        result.Record.OwnerOrg,
+			FromTxId:   result.TxId,
+			AcquiredAt: result.Timestamp,
+		}
+	}
+
+	if current != nil {
+		current.DurationSeconds = int64(txTime.Sub(current.AcquiredAt).Seconds())
+		chain.Segments = append(chain.Segments, *current)
+		chain.CurrentHolder = current.Org
+	}
+
+	return chain, nil
+}
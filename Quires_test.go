@@ -0,0 +1,228 @@
+package main
+
+import (
+	"fmt"
+	"sort"
+	"testing"
+	"time"
+
+	"SupplyChainTrackingChaincode/chaincodetest"
+)
+
+// handOver agrees on and performs the transfer of a commodity from the putter to the getter org
+func handOver(t *testing.T, ledger *chaincodetest.Ledger, putter, getter chaincodetest.Identity, commodityID string) {
+	t.Helper()
+
+	agree(t, ledger, putter, getter, commodityID, palletProperties, transferKeyBetween(commodityID, putter.MSPID, getter.MSPID))
+	if _, err := transfer(ledger, putter, getter.MSPID, commodityID, transferKeyBetween(commodityID, putter.MSPID, getter.MSPID)); err != nil {
+		t.Fatalf("TransferCommodity from %s to %s: %v", putter.MSPID, getter.MSPID, err)
+	}
+}
+
+func TestGetCustodyChain(t *testing.T) {
+	ledger := chaincodetest.NewLedger()
+	s := newContract()
+
+	commodityID := createCommodity(t, ledger, org1Client, palletProperties)
+	ledger.Advance(time.Hour)
+	handOver(t, ledger, org1Client, org2Client, commodityID)
+
+	ctx := ledger.NewTransaction(org2Client)
+	if err := s.ChangePublicDescription(ctx, commodityID, "repacked"); err != nil {
+		t.Fatalf("ChangePublicDescription: %v", err)
+	}
+	if err := ctx.Commit(); err != nil {
+		t.Fatalf("commit ChangePublicDescription: %v", err)
+	}
+
+	ledger.Advance(2 * time.Hour)
+	handOver(t, ledger, org2Client, org3Client, commodityID)
+
+	chain, err := s.GetCustodyChain(ledger.NewTransaction(org1Client), commodityID)
+	if err != nil {
+		t.Fatalf("GetCustodyChain: %v", err)
+	}
+	if chain.OriginOrg != org1MSP || chain.CurrentHolder != org3MSP {
+		t.Errorf("origin, holder = %s, %s, want %s, %s", chain.OriginOrg, chain.CurrentHolder, org1MSP, org3MSP)
+	}
+	if len(chain.Segments) != 3 {
+		t.Fatalf("segments = %+v, want 3", chain.Segments)
+	}
+	for i, org := range []string{org1MSP, org2MSP, org3MSP} {
+		if chain.Segments[i].Org != org {
+			t.Errorf("segment %d org = %s, want %s", i, chain.Segments[i].Org, org)
+		}
+	}
+	first, second, last := chain.Segments[0], chain.Segments[1], chain.Segments[2]
+	if first.ToTxId != second.FromTxId || !first.ReleasedAt.Equal(second.AcquiredAt) {
+		t.Errorf("segments are not contiguous: %+v, %+v", first, second)
+	}
+	if first.DurationSeconds < int64(time.Hour.Seconds()) || second.DurationSeconds < int64((2*time.Hour).Seconds()) {
+		t.Errorf("durations = %d, %d", first.DurationSeconds, second.DurationSeconds)
+	}
+	if last.ToTxId != "" || !last.ReleasedAt.IsZero() {
+		t.Errorf("current holder's segment is closed: %+v", last)
+	}
+
+	if _, err = s.GetCustodyChain(ledger.NewTransaction(org1Client), "unknown"); err == nil {
+		t.Error("GetCustodyChain succeeded for an unknown commodity")
+	}
+}
+
+func TestQueryCommodityHistoryWithDeletion(t *testing.T) {
+	ledger := chaincodetest.NewLedger()
+	s := newContract()
+
+	commodityID := createCommodity(t, ledger, org1Client, palletProperties)
+	for _, description := range []string{"first", "second", "third"} {
+		ledger.Advance(time.Hour)
+		ctx := ledger.NewTransaction(org1Client)
+		if err := s.ChangePublicDescription(ctx, commodityID, description); err != nil {
+			t.Fatalf("ChangePublicDescription: %v", err)
+		}
+		if err := ctx.Commit(); err != nil {
+			t.Fatalf("commit ChangePublicDescription: %v", err)
+		}
+	}
+	ledger.Advance(time.Hour)
+	ctx := ledger.NewTransaction(org1Client)
+	_ = ctx.GetStub().DelState(commodityID)
+	if err := ctx.Commit(); err != nil {
+		t.Fatalf("commit deletion: %v", err)
+	}
+
+	history, err := s.QueryCommodityHistory(ledger.NewTransaction(org1Client), commodityID)
+	if err != nil || len(history) != 5 {
+		t.Fatalf("QueryCommodityHistory = %v, %v, want 5 records", history, err)
+	}
+
+	var records []QueryResult
+	bookmark := ""
+	for {
+		page, err := s.QueryCommodityHistoryWithPagination(ledger.NewTransaction(org1Client), commodityID, "", "", 2, bookmark)
+		if err != nil {
+			t.Fatalf("QueryCommodityHistoryWithPagination: %v", err)
+		}
+		if page.FetchedRecordsCount != int32(len(page.Records)) || len(page.Records) > 2 {
+			t.Fatalf("page of %d records reports %d", len(page.Records), page.FetchedRecordsCount)
+		}
+		records = append(records, page.Records...)
+		if bookmark = page.Bookmark; bookmark == "" {
+			break
+		}
+	}
+	if len(records) != 5 {
+		t.Fatalf("paged records = %d, want 5", len(records))
+	}
+	last := records[len(records)-1]
+	if !last.IsDelete || last.Record != nil {
+		t.Errorf("newest record = %+v, want a deletion", last)
+	}
+	for i := 1; i < len(records); i++ {
+		if records[i].Timestamp.Before(records[i-1].Timestamp) {
+			t.Fatal("paged records are not ordered from oldest to newest")
+		}
+	}
+
+	from := records[1].Timestamp.Format(time.RFC3339)
+	to := records[3].Timestamp.Format(time.RFC3339)
+	page, err := s.QueryCommodityHistoryWithPagination(ledger.NewTransaction(org1Client), commodityID, from, to, 10, "")
+	if err != nil || len(page.Records) != 3 || page.Records[0].Record.PublicDescription != "first" {
+		t.Errorf("time range page = %+v, %v, want the 3 description changes", page, err)
+	}
+
+	chain, err := s.GetCustodyChain(ledger.NewTransaction(org1Client), commodityID)
+	if err != nil {
+		t.Fatalf("GetCustodyChain: %v", err)
+	}
+	if chain.CurrentHolder != "" || len(chain.Segments) != 1 || chain.Segments[0].ToTxId != last.TxId {
+		t.Errorf("custody chain of a deleted commodity = %+v", chain)
+	}
+}
+
+func TestGetCustodyChainOfSplitChild(t *testing.T) {
+	ledger := chaincodetest.NewLedger()
+	s := newContract()
+
+	palletID := createCommodity(t, ledger, org1Client, palletProperties)
+	handOver(t, ledger, org1Client, org2Client, palletID)
+	caseIDs := splitCommodity(t, ledger, org2Client, palletID, casesProperties)
+
+	// The custody of the pallet is not part of the one of its cases
+	chain, err := s.GetCustodyChain(ledger.NewTransaction(org1Client), caseIDs[0])
+	if err != nil {
+		t.Fatalf("GetCustodyChain: %v", err)
+	}
+	if chain.OriginOrg != org2MSP || chain.CurrentHolder != org2MSP || len(chain.Segments) != 1 || chain.Segments[0].Org != org2MSP {
+		t.Errorf("custody chain of a case = %+v", chain)
+	}
+}
+
+func TestQueryAgreementsWithPagination(t *testing.T) {
+	ledger := chaincodetest.NewLedger()
+	s := newContract()
+
+	var commodityIDs []string
+	for i, getter := range []string{org2MSP, org3MSP, org2MSP} {
+		commodityID := createCommodity(t, ledger, org1Client, fmt.Sprintf(`{"name":"pallet","salt":"%d"}`, i))
+		ctx := ledger.NewTransaction(org1Client).WithTransient("commodity_transferKey", transferKeyBetween(commodityID, org1MSP, getter))
+		if err := s.AgreeToPut(ctx, commodityID); err != nil {
+			t.Fatalf("AgreeToPut: %v", err)
+		}
+		if err := ctx.Commit(); err != nil {
+			t.Fatalf("commit AgreeToPut: %v", err)
+		}
+		commodityIDs = append(commodityIDs, commodityID)
+	}
+	sorted := append([]string{}, commodityIDs...)
+	sort.Strings(sorted)
+
+	ctx := ledger.NewTransaction(org1Client)
+	page, err := s.QueryCommodityPutAgreementsWithPagination(ctx, "", "", 2, "")
+	if err != nil {
+		t.Fatalf("QueryCommodityPutAgreementsWithPagination: %v", err)
+	}
+	if page.FetchedRecordsCount != 2 || page.TotalCount != 3 || page.Bookmark != sorted[2] {
+		t.Fatalf("first page = %+v", page)
+	}
+	if page.Records[0].CommodityID != sorted[0] || page.Records[0].Agreement.ID != sorted[0] {
+		t.Errorf("first record = %+v, want %s", page.Records[0], sorted[0])
+	}
+
+	page, err = s.QueryCommodityPutAgreementsWithPagination(ctx, "", "", 2, page.Bookmark)
+	if err != nil {
+		t.Fatalf("QueryCommodityPutAgreementsWithPagination: %v", err)
+	}
+	if page.FetchedRecordsCount != 1 || page.TotalCount != 3 || page.Bookmark != "" || page.Records[0].CommodityID != sorted[2] {
+		t.Errorf("last page = %+v", page)
+	}
+
+	// The counterparty of a Putting is the getter named by the agreement
+	page, err = s.QueryCommodityPutAgreementsWithPagination(ctx, "", org3MSP, 10, "")
+	if err != nil || page.TotalCount != 1 || page.Records[0].CommodityID != commodityIDs[1] || page.Records[0].Counterparty != org3MSP {
+		t.Errorf("Puttings to org3 = %+v, %v", page, err)
+	}
+	page, err = s.QueryCommodityPutAgreementsWithPagination(ctx, commodityIDs[2][:8], "", 10, "")
+	if err != nil || page.TotalCount != 1 || page.Records[0].CommodityID != commodityIDs[2] || page.Records[0].Counterparty != org2MSP {
+		t.Errorf("Puttings by prefix = %+v, %v", page, err)
+	}
+
+	// The counterparty of a Getting is the putter named by the agreement
+	getCtx := ledger.NewTransaction(org2Client).
+		WithTransient("commodity_properties", []byte(`{"name":"pallet","salt":"0"}`)).
+		WithTransient("commodity_transferKey", transferKeyOf(commodityIDs[0]))
+	if err = s.AgreeToGet(getCtx, commodityIDs[0]); err != nil {
+		t.Fatalf("AgreeToGet: %v", err)
+	}
+	if err = getCtx.Commit(); err != nil {
+		t.Fatalf("commit AgreeToGet: %v", err)
+	}
+	page, err = s.QueryCommodityGetAgreementsWithPagination(ledger.NewTransaction(org2Client), "", org1MSP, 10, "")
+	if err != nil || page.TotalCount != 1 || page.Records[0].CommodityID != commodityIDs[0] || page.Records[0].Counterparty != org1MSP {
+		t.Errorf("Gettings from org1 = %+v, %v", page, err)
+	}
+
+	if _, err = s.QueryCommodityPutAgreementsWithPagination(ctx, "", "", 0, ""); err == nil {
+		t.Error("page size 0 was accepted")
+	}
+}
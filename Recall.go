@@ -0,0 +1,277 @@
+package main
+
+import (
+	"encoding/json"
+	"fmt"
+	"strings"
+	"time"
+
+	"github.com/hyperledger/fabric-contract-api-go/contractapi"
+)
+
+const (
+	typeRecall     = "RC" // RC~recallID holds a Recall in public data
+	typeRecallMark = "RM" // RM~commodityID~recallID marks a commodity affected by a recall in public data
+)
+
+// Severities of a recall, from the least to the most hazardous
+var recallSeverities = []string{"low", "medium", "high", "critical"}
+
+// Recall flags commodities as unsafe, AffectedCommodityIDs includes every commodity derived from the recalled ones
+type Recall struct {
+	ObjectType           string    `json:"objectType"`
+	ID                   string    `json:"recallID"`
+	IssuerOrg            string    `json:"issuerOrg"`
+	Reason               string    `json:"reason"`
+	Severity             string    `json:"severity"`
+	CommodityIDs         []string  `json:"commodityIDs"`
+	AffectedCommodityIDs []string  `json:"affectedCommodityIDs"`
+	Timestamp            time.Time `json:"timestamp"`
+}
+
+// RecalledCommodity is a commodity under recall and the org currently holding it
+type RecalledCommodity struct {
+	CommodityID       string   `json:"commodityID"`
+	OwnerOrg          string   `json:"ownerCompany"`
+	PublicDescription string   `json:"publicDescription"`
+	Recalls           []Recall `json:"recalls"`
+}
+
+// IssueRecall recalls commodities and every commodity split or assembled from them, and returns the recall.
+// commodityIDs is a comma separated list, severity one of low, medium, high or critical.
+// The originating org of a commodity can recall it, the orgs granted the regulator role can recall any commodity.
+// Only the issuer can endorse later changes of the recall and of the marks of its commodities.
+// Recalled commodities can no longer be transferred, split or assembled.
+func (s *SmartContract) IssueRecall(ctx contractapi.TransactionContextInterface, commodityIDs string, reason string, severity string) (*Recall, error) {
+	recalledIDs, err := parseCommodityIDs(commodityIDs)
+	if err != nil {
+		return nil, err
+	}
+	if strings.TrimSpace(reason) == "" {
+		return nil, fmt.Errorf("a recall needs a reason")
+	}
+	if indexOf(recallSeverities, severity) < 0 {
+		return nil, fmt.Errorf("unknown severity %q, expected one of %s", severity, strings.Join(recallSeverities, ", "))
+	}
+
+	clientOrgID, err := getClientOrgID(ctx)
+	if err != nil {
+		return nil, err
+	}
+
+	regulator, err := hasOrgRole(ctx, orgRoleRegulator, clientOrgID)
+	if err != nil {
+		return nil, err
+	}
+	for _, commodityID := range recalledIDs {
+		originOrg, err := getOriginOrg(ctx, commodityID)
+		if err != nil {
+			return nil, err
+		}
+		if !regulator && clientOrgID != originOrg {
+			return nil, &AuthorizationError{ClientOrg: clientOrgID, Action: fmt.Sprintf("recall commodity %s originating from %s", commodityID, originOrg)}
+		}
+	}
+
+	affectedIDs, err := s.getDerivedCommodityIDs(ctx, recalledIDs)
+	if err != nil {
+		return nil, err
+	}
+
+	timestamp, err := getTxTime(ctx)
+	if err != nil {
+		return nil, err
+	}
+	recall := &Recall{
+		ObjectType:           "Recall",
+		ID:                   ctx.GetStub().GetTxID(),
+		IssuerOrg:            clientOrgID,
+		Reason:               reason,
+		Severity:             severity,
+		CommodityIDs:         recalledIDs,
+		AffectedCommodityIDs: affectedIDs,
+		Timestamp:            timestamp,
+	}
+	recallJSON, err := json.Marshal(recall)
+	if err != nil {
+		return nil, fmt.Errorf("failed to marshal recall: %v", err)
+	}
+	recallKey, err := ctx.GetStub().CreateCompositeKey(typeRecall, []string{recall.ID})
+	if err != nil {
+		return nil, fmt.Errorf("failed to create composite key: %v", err)
+	}
+	err = ctx.GetStub().PutState(recallKey, recallJSON)
+	if err != nil {
+		return nil, fmt.Errorf("failed to put recall in public data: %v", err)
+	}
+	issuerPolicy, err := ownerEndorsementPolicy([]string{clientOrgID})
+	if err != nil {
+		return nil, err
+	}
+	err = ctx.GetStub().SetStateValidationParameter(recallKey, issuerPolicy)
+	if err != nil {
+		return nil, fmt.Errorf("failed to set validation parameter on recall: %v", err)
+	}
+
+	// The marks are kept apart from the commodities, whose state-based endorsement policy would require every holder to endorse the recall
+	for _, commodityID := range affectedIDs {
+		markKey, err := ctx.GetStub().CreateCompositeKey(typeRecallMark, []string{commodityID, recall.ID})
+		if err != nil {
+			return nil, fmt.Errorf("failed to create composite key: %v", err)
+		}
+		err = ctx.GetStub().PutState(markKey, []byte(recall.ID))
+		if err != nil {
+			return nil, fmt.Errorf("failed to mark commodity %s as recalled: %v", commodityID, err)
+		}
+		err = ctx.GetStub().SetStateValidationParameter(markKey, issuerPolicy)
+		if err != nil {
+			return nil, fmt.Errorf("failed to set validation parameter on recall mark: %v", err)
+		}
+	}
+
+	err = setCommodityEvent(ctx, eventCommodityRecalled, CommodityEvent{
+		CommodityID:         recalledIDs[0],
+		RelatedCommodityIDs: affectedIDs,
+		RecallID:            recall.ID,
+		Severity:            severity,
+	})
+	if err != nil {
+		return nil, err
+	}
+
+	return recall, nil
+}
+
+// GetRecall returns a recall by its id, which is the id of the transaction that issued it
+func (s *SmartContract) GetRecall(ctx contractapi.TransactionContextInterface, recallID string) (*Recall, error) {
+	recallKey, err := ctx.GetStub().CreateCompositeKey(typeRecall, []string{recallID})
+	if err != nil {
+		return nil, fmt.Errorf("failed to create composite key: %v", err)
+	}
+	recallJSON, err := ctx.GetStub().GetState(recallKey)
+	if err != nil {
+		return nil, fmt.Errorf("failed to read from world state: %v", err)
+	}
+	if recallJSON == nil {
+		return nil, fmt.Errorf("recall %s does not exist", recallID)
+	}
+
+	var recall *Recall
+	err = json.Unmarshal(recallJSON, &recall)
+	if err != nil {
+		return nil, err
+	}
+	return recall, nil
+}
+
+// QueryRecalledCommodities lists the commodities under recall that are currently held, i.e. neither consumed nor retired,
+// by ownerOrg or by any org if ownerOrg is empty
+func (s *SmartContract) QueryRecalledCommodities(ctx contractapi.TransactionContextInterface, ownerOrg string) ([]RecalledCommodity, error) {
+	marksIterator, err := ctx.GetStub().GetStateByPartialCompositeKey(typeRecallMark, []string{})
+	if err != nil {
+		return nil, fmt.Errorf("failed to read from world state: %v", err)
+	}
+	defer marksIterator.Close()
+
+	// Marks are sorted by commodity id, so the recalls of a commodity are contiguous
+	var results []RecalledCommodity
+	var current *RecalledCommodity
+	for marksIterator.HasNext() {
+		mark, err := marksIterator.Next()
+		if err != nil {
+			return nil, err
+		}
+		_, attributes, err := ctx.GetStub().SplitCompositeKey(mark.Key)
+		if err != nil {
+			return nil, fmt.Errorf("failed to split composite key: %v", err)
+		}
+		commodityID, recallID := attributes[0], attributes[1]
+
+		if current == nil || current.CommodityID != commodityID {
+			if current != nil {
+				results = append(results, *current)
+				current = nil
+			}
+			commodity, err := s.ReadCommodity(ctx, commodityID)
+			if err != nil {
+				return nil, err
+			}
+			if commodity.Consumed || commodity.Status == statusDestroyed || (ownerOrg != "" && commodity.OwnerOrg != ownerOrg) {
+				continue
+			}
+			current = &RecalledCommodity{
+				CommodityID:       commodityID,
+				OwnerOrg:          commodity.OwnerOrg,
+				PublicDescription: commodity.PublicDescription,
+			}
+		}
+
+		recall, err := s.GetRecall(ctx, recallID)
+		if err != nil {
+			return nil, err
+		}
+		current.Recalls = append(current.Recalls, *recall)
+	}
+	if current != nil {
+		results = append(results, *current)
+	}
+
+	return results, nil
+}
+
+// getDerivedCommodityIDs returns the commodities and every commodity split or assembled from them, transitively
+func (s *SmartContract) getDerivedCommodityIDs(ctx contractapi.TransactionContextInterface, commodityIDs []string) ([]string, error) {
+	derivedIDs := append([]string{}, commodityIDs...)
+	for i := 0; i < len(derivedIDs); i++ {
+		commodity, err := s.ReadCommodity(ctx, derivedIDs[i])
+		if err != nil {
+			return nil, fmt.Errorf("failed to get commodity: %v", err)
+		}
+
+		next := commodity.Children
+		if commodity.AssembledInto != "" {
+			next = append(append([]string{}, next...), commodity.AssembledInto)
+		}
+		for _, derivedID := range next {
+			if indexOf(derivedIDs, derivedID) < 0 {
+				derivedIDs = append(derivedIDs, derivedID)
+			}
+		}
+	}
+
+	return derivedIDs, nil
+}
+
+// getOriginOrg returns the org that created a commodity, or the commodity it was split from
+func getOriginOrg(ctx contractapi.TransactionContextInterface, commodityID string) (string, error) {
+	history, err := getProvenanceHistory(ctx, commodityID, make(map[string]bool))
+	if err != nil {
+		return "", err
+	}
+	sortHistory(history)
+
+	for _, result := range history {
+		if !result.IsDelete {
+			return result.Record.OwnerOrg, nil
+		}
+	}
+	return "", fmt.Errorf("%s does not exist", commodityID)
+}
+
+// verifyNotRecalled checks that no recall affects a commodity
+func verifyNotRecalled(ctx contractapi.TransactionContextInterface, commodityID string) error {
+	marksIterator, err := ctx.GetStub().GetStateByPartialCompositeKey(typeRecallMark, []string{commodityID})
+	if err != nil {
+		return fmt.Errorf("failed to read from world state: %v", err)
+	}
+	defer marksIterator.Close()
+
+	if marksIterator.HasNext() {
+		mark, err := marksIterator.Next()
+		if err != nil {
+			return err
+		}
+		return fmt.Errorf("commodity %s is under recall %s", commodityID, mark.Value)
+	}
+	return nil
+}
@@ -0,0 +1,132 @@
+package main
+
+import (
+	"encoding/json"
+	"strings"
+	"testing"
+
+	"SupplyChainTrackingChaincode/chaincodetest"
+)
+
+// issueRecall recalls commodities on behalf of the client's org and returns the recall
+func issueRecall(s *SmartContract, ledger *chaincodetest.Ledger, client chaincodetest.Identity, commodityIDs ...string) (*Recall, error) {
+	ctx := ledger.NewTransaction(client)
+	recall, err := s.IssueRecall(ctx, strings.Join(commodityIDs, ","), "contaminated", "high")
+	if err != nil {
+		return nil, err
+	}
+	return recall, ctx.Commit()
+}
+
+func TestIssueRecallAffectsDerivedCommodities(t *testing.T) {
+	ledger := chaincodetest.NewLedger()
+	s := newContract()
+
+	// A pallet of org1 is split into two cases, one is sold to org2, the other assembled into a kit
+	palletID := createCommodity(t, ledger, org1Client, palletProperties)
+	caseIDs := splitCommodity(t, ledger, org1Client, palletID, casesProperties)
+	var cases []json.RawMessage
+	if err := json.Unmarshal([]byte(casesProperties), &cases); err != nil {
+		t.Fatal(err)
+	}
+	agree(t, ledger, org1Client, org2Client, caseIDs[0], string(cases[0]), transferKeyOf(caseIDs[0]))
+	if _, err := transfer(ledger, org1Client, org2MSP, caseIDs[0], transferKeyOf(caseIDs[0])); err != nil {
+		t.Fatalf("TransferCommodity: %v", err)
+	}
+	bellID := createCommodity(t, ledger, org1Client, `{"name":"bell"}`)
+	kitID := assembleCommodity(t, ledger, org1Client, `{"name":"kit"}`, caseIDs[1], bellID)
+
+	// Only the originating org can recall, org2 merely holds a case
+	if _, err := issueRecall(s, ledger, org2Client, caseIDs[0]); err == nil {
+		t.Fatal("IssueRecall by a holder succeeded")
+	}
+
+	recall, err := issueRecall(s, ledger, org1Client, palletID)
+	if err != nil {
+		t.Fatalf("IssueRecall: %v", err)
+	}
+	want := []string{palletID, caseIDs[0], caseIDs[1], kitID}
+	if strings.Join(recall.AffectedCommodityIDs, ",") != strings.Join(want, ",") {
+		t.Errorf("affected = %v, want %v", recall.AffectedCommodityIDs, want)
+	}
+
+	event := ledger.Events()[len(ledger.Events())-1]
+	if event.Name != "CommodityRecalled" || !strings.Contains(string(event.Payload), kitID) {
+		t.Errorf("event = %s %s", event.Name, event.Payload)
+	}
+
+	// The pallet and the second case were consumed, what is still held is the first case and the kit
+	recalled, err := s.QueryRecalledCommodities(ledger.NewTransaction(org3Client), "")
+	if err != nil {
+		t.Fatalf("QueryRecalledCommodities: %v", err)
+	}
+	held := map[string]string{}
+	for _, commodity := range recalled {
+		held[commodity.CommodityID] = commodity.OwnerOrg
+		if len(commodity.Recalls) != 1 || commodity.Recalls[0].ID != recall.ID {
+			t.Errorf("recalls of %s = %+v", commodity.CommodityID, commodity.Recalls)
+		}
+	}
+	if len(held) != 2 || held[caseIDs[0]] != org2MSP || held[kitID] != org1MSP {
+		t.Errorf("recalled commodities = %v", held)
+	}
+
+	recalled, err = s.QueryRecalledCommodities(ledger.NewTransaction(org2Client), org2MSP)
+	if err != nil || len(recalled) != 1 || recalled[0].CommodityID != caseIDs[0] {
+		t.Errorf("QueryRecalledCommodities of org2 = %+v, %v", recalled, err)
+	}
+
+	// Recalled commodities can no longer move, the bell was not affected
+	ctx := ledger.NewTransaction(org2Client).WithTransient("commodity_transferKey", transferKeyOf(caseIDs[0]))
+	if err = s.AgreeToPut(ctx, caseIDs[0]); err == nil || !strings.Contains(err.Error(), "recall") {
+		t.Errorf("AgreeToPut of a recalled commodity: err = %v", err)
+	}
+	if _, err = transfer(ledger, org2Client, org3MSP, caseIDs[0], transferKeyOf(caseIDs[0])); err == nil || !strings.Contains(err.Error(), "recall") {
+		t.Errorf("TransferCommodity of a recalled commodity: err = %v", err)
+	}
+	if err = verifyNotRecalled(ledger.NewTransaction(org1Client), bellID); err != nil {
+		t.Errorf("the bell is under recall: %v", err)
+	}
+}
+
+func TestIssueRecallByRegulator(t *testing.T) {
+	ledger := chaincodetest.NewLedger()
+	s := newContract()
+	commodityID := createCommodity(t, ledger, org1Client, palletProperties)
+
+	if _, err := issueRecall(s, ledger, org3Client, commodityID); err == nil {
+		t.Fatal("IssueRecall by another org succeeded")
+	}
+
+	grantOrgRole(t, ledger, orgRoleRegulator, org3MSP)
+	recall, err := issueRecall(s, ledger, org3Client, commodityID)
+	if err != nil {
+		t.Fatalf("IssueRecall by a regulator: %v", err)
+	}
+	if recall.IssuerOrg != org3MSP {
+		t.Errorf("issuer = %s", recall.IssuerOrg)
+	}
+
+	// Only the regulator can endorse changes of the recall mark, e.g. lifting it
+	ctx := ledger.NewTransaction(org1Client)
+	markKey, err := ctx.Stub().CreateCompositeKey(typeRecallMark, []string{commodityID, recall.ID})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err = ctx.Stub().DelState(markKey); err != nil {
+		t.Fatal(err)
+	}
+	if err = ctx.Commit(); err == nil {
+		t.Error("the owner lifted the recall mark of a regulator")
+	}
+
+	stored, err := s.GetRecall(ledger.NewTransaction(org2Client), recall.ID)
+	if err != nil || stored.Reason != "contaminated" || stored.Severity != "high" {
+		t.Errorf("GetRecall = %+v, %v", stored, err)
+	}
+
+	ctx = ledger.NewTransaction(org1Client)
+	if _, err = s.IssueRecall(ctx, commodityID, "contaminated", "catastrophic"); err == nil {
+		t.Error("IssueRecall with an unknown severity succeeded")
+	}
+}
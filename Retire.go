@@ -0,0 +1,161 @@
+package main
+
+import (
+	"encoding/hex"
+	"encoding/json"
+	"fmt"
+	"strings"
+	"time"
+
+	"github.com/hyperledger/fabric-contract-api-go/contractapi"
+)
+
+// typeRetirementReceipt is the prefix of RR~commodityID, the retirement receipt in the last owner's implicit private data collection
+const typeRetirementReceipt = "RR"
+
+// RetirementReceipt is kept in the last owner's implicit private data collection as proof that it retired a commodity.
+// PropertiesHash is the on-chain hash of the private properties that were purged.
+type RetirementReceipt struct {
+	ObjectType     string    `json:"objectType"`
+	CommodityID    string    `json:"commodityID"`
+	TxID           string    `json:"txId"`
+	OwnerOrg       string    `json:"ownerCompany"`
+	Reason         string    `json:"reason"`
+	PropertiesHash string    `json:"propertiesHash"`
+	Timestamp      time.Time `json:"timestamp"`
+}
+
+// RetireCommodity marks a commodity as Destroyed when it was consumed, sold to end consumers or destroyed.
+// The public record is kept for provenance, while the owner's private properties, detailed information and
+// agreements and current terms on the commodity are purged from its implicit private data collection and replaced by a retirement receipt.
+// Agreements of other companies are left to them, see CancelGetAgreement and PurgeExpiredAgreements.
+// A commodity lost in transit is retired by its upstream company, the shipment is cancelled like by CancelShipment.
+// RetireCommodity can only be called by current owner
+func (s *SmartContract) RetireCommodity(ctx contractapi.TransactionContextInterface, commodityID string, reason string) error {
+	clientOrgID, err := getClientOrgID(ctx)
+	if err != nil {
+		return err
+	}
+
+	if strings.TrimSpace(reason) == "" {
+		return fmt.Errorf("a retirement needs a reason")
+	}
+
+	commodity, err := s.ReadCommodity(ctx, commodityID)
+	if err != nil {
+		return fmt.Errorf("failed to get commodity: %v", err)
+	}
+
+	// Auth check to ensure that client's org actually owns the commodity
+	if clientOrgID != commodity.OwnerOrg {
+		return &AuthorizationError{ClientOrg: clientOrgID, Action: fmt.Sprintf("retire a commodity owned by %s", commodity.OwnerOrg)}
+	}
+
+	// The owner's collection is updated, therefore the peer must belong to the client's org, or to the endorsers or
+	// the getter of a commodity lost in transit, which endorse too: only hashes and deletes of the owner's collection
+	// are needed to retire it
+	_, err = s.verifyPeerEndorsesCommodities(ctx, clientOrgID, commodity)
+	if err != nil {
+		return err
+	}
+
+	err = transitionStatus(ctx, commodity, statusDestroyed)
+	if err != nil {
+		return err
+	}
+	if commodity.Shipment != nil {
+		err = cancelShipment(ctx, commodity)
+		if err != nil {
+			return err
+		}
+	}
+
+	collection := buildCollectionName(clientOrgID)
+	propertiesHash, err := ctx.GetStub().GetPrivateDataHash(collection, commodityID)
+	if err != nil {
+		return fmt.Errorf("failed to read commodity private properties hash: %v", err)
+	}
+
+	err = ctx.GetStub().DelPrivateData(collection, commodityID)
+	if err != nil {
+		return fmt.Errorf("failed to delete commodity private details: %v", err)
+	}
+	detailsKey, err := ctx.GetStub().CreateCompositeKey(typeCommodityDetails, []string{commodityID})
+	if err != nil {
+		return fmt.Errorf("failed to create composite key: %v", err)
+	}
+	err = ctx.GetStub().DelPrivateData(collection, detailsKey)
+	if err != nil {
+		return fmt.Errorf("failed to delete detailed information: %v", err)
+	}
+	for _, agreementType := range []string{typeCommodityForTransfer, typeCommodityKey} {
+		err = deleteAgreement(ctx, collection, commodityID, agreementType)
+		if err != nil {
+			return err
+		}
+	}
+	err = deleteTerms(ctx, collection, commodityID)
+	if err != nil {
+		return err
+	}
+
+	timestamp, err := getTxTime(ctx)
+	if err != nil {
+		return fmt.Errorf("failed to create timestamp for receipt: %v", err)
+	}
+	receipt := RetirementReceipt{
+		ObjectType:     "RetirementReceipt",
+		CommodityID:    commodityID,
+		TxID:           ctx.GetStub().GetTxID(),
+		OwnerOrg:       clientOrgID,
+		Reason:         reason,
+		PropertiesHash: hex.EncodeToString(propertiesHash),
+		Timestamp:      timestamp,
+	}
+	receiptJSON, err := json.Marshal(receipt)
+	if err != nil {
+		return fmt.Errorf("failed to marshal retirement receipt: %v", err)
+	}
+	receiptKey, err := ctx.GetStub().CreateCompositeKey(typeRetirementReceipt, []string{commodityID})
+	if err != nil {
+		return fmt.Errorf("failed to create composite key for receipt: %v", err)
+	}
+	err = ctx.GetStub().PutPrivateData(collection, receiptKey, receiptJSON)
+	if err != nil {
+		return fmt.Errorf("failed to put retirement receipt: %v", err)
+	}
+
+	err = putCommodity(ctx, commodity)
+	if err != nil {
+		return err
+	}
+
+	return setCommodityEvent(ctx, eventCommodityRetired, CommodityEvent{CommodityID: commodityID, OwnerOrg: clientOrgID})
+}
+
+// GetRetirementReceipt returns the retirement receipt of a commodity from caller's implicit private data collection
+func (s *SmartContract) GetRetirementReceipt(ctx contractapi.TransactionContextInterface, commodityID string) (*RetirementReceipt, error) {
+	collection, err := s.getClientImplicitCollectionNameAndVerifyClientOrg(ctx)
+	if err != nil {
+		return nil, err
+	}
+
+	receiptKey, err := ctx.GetStub().CreateCompositeKey(typeRetirementReceipt, []string{commodityID})
+	if err != nil {
+		return nil, fmt.Errorf("failed to create composite key: %v", err)
+	}
+	receiptJSON, err := ctx.GetStub().GetPrivateData(collection, receiptKey)
+	if err != nil {
+		return nil, fmt.Errorf("failed to read receipt from implicit private data collection: %v", err)
+	}
+	if receiptJSON == nil {
+		return nil, fmt.Errorf("retirement receipt of commodity %s does not exist", commodityID)
+	}
+
+	var receipt *RetirementReceipt
+	err = json.Unmarshal(receiptJSON, &receipt)
+	if err != nil {
+		return nil, err
+	}
+	return receipt, nil
+}
@@ -0,0 +1,76 @@
+package main
+
+import (
+	"errors"
+	"testing"
+
+	"SupplyChainTrackingChaincode/chaincodetest"
+)
+
+func TestRetireCommodity(t *testing.T) {
+	ledger := chaincodetest.NewLedger()
+	s := newContract()
+	commodityID := createCommodity(t, ledger, org1Client, palletProperties)
+	agree(t, ledger, org1Client, org2Client, commodityID, palletProperties, transferKeyOf(commodityID))
+
+	ctx := ledger.NewTransaction(org2Client)
+	var denied *AuthorizationError
+	if err := s.RetireCommodity(ctx, commodityID, "destroyed"); !errors.As(err, &denied) {
+		t.Errorf("RetireCommodity by a non-owner: err = %v, want an AuthorizationError", err)
+	}
+	ctx = ledger.NewTransaction(org1Client)
+	if err := s.RetireCommodity(ctx, commodityID, " "); err == nil {
+		t.Error("RetireCommodity without a reason succeeded")
+	}
+
+	// A listed commodity can be retired, its agreement is purged
+	ctx = ledger.NewTransaction(org1Client)
+	if err := s.RetireCommodity(ctx, commodityID, "sold to end consumer"); err != nil {
+		t.Fatalf("RetireCommodity: %v", err)
+	}
+	if err := ctx.Commit(); err != nil {
+		t.Fatalf("commit RetireCommodity: %v", err)
+	}
+	if event := ctx.Stub().Event(); event == nil || event.Name != eventCommodityRetired {
+		t.Errorf("event = %+v", event)
+	}
+
+	// The public record is kept
+	commodity, err := s.ReadCommodity(ledger.NewTransaction(org3Client), commodityID)
+	if err != nil {
+		t.Fatalf("ReadCommodity: %v", err)
+	}
+	if commodity.Status != statusDestroyed || commodity.OwnerOrg != org1MSP {
+		t.Errorf("retired commodity = %+v", commodity)
+	}
+
+	collection := buildCollectionName(org1MSP)
+	if ledger.PrivateData(collection, commodityID) != nil {
+		t.Error("commodity properties were not purged")
+	}
+	agreementKey, err := ledger.NewTransaction(org1Client).Stub().CreateCompositeKey(typeCommodityForTransfer, []string{commodityID})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if ledger.PrivateData(collection, agreementKey) != nil {
+		t.Error("agreement to put was not purged")
+	}
+
+	receipt, err := s.GetRetirementReceipt(ledger.NewTransaction(org1Client), commodityID)
+	if err != nil {
+		t.Fatalf("GetRetirementReceipt: %v", err)
+	}
+	// The id of a created commodity is the hash of its properties
+	if receipt.Reason != "sold to end consumer" || receipt.PropertiesHash != commodityID || receipt.TxID != ctx.Stub().GetTxID() {
+		t.Errorf("receipt = %+v", receipt)
+	}
+
+	// Destroyed is terminal
+	if _, err = transfer(ledger, org1Client, org2MSP, commodityID, transferKeyOf(commodityID)); err == nil {
+		t.Error("TransferCommodity of a retired commodity succeeded")
+	}
+	ctx = ledger.NewTransaction(org1Client)
+	if err = s.RetireCommodity(ctx, commodityID, "destroyed"); err == nil {
+		t.Error("second RetireCommodity succeeded")
+	}
+}
@@ -0,0 +1,134 @@
+package main
+
+import (
+	"fmt"
+	"strings"
+
+	"github.com/hyperledger/fabric-contract-api-go/contractapi"
+)
+
+// RouteStatus shows the progress of a commodity along its planned route
+type RouteStatus struct {
+	CommodityID string   `json:"commodityID"`
+	OwnerOrg    string   `json:"ownerCompany"`
+	Route       []string `json:"route"`
+	Visited     []string `json:"visited"`
+	Remaining   []string `json:"remaining"`
+	NextOrg     string   `json:"nextOrg"`
+	Completed   bool     `json:"completed"`
+}
+
+// AmendRoute replaces the part of the planned route the commodity has not gone through yet.
+// Only the current owner can amend the route, route is a comma separated list of orgs ending with the final destination.
+func (s *SmartContract) AmendRoute(ctx contractapi.TransactionContextInterface, commodityID string, route string) error {
+	clientOrgID, err := getClientOrgID(ctx)
+	if err != nil {
+		return err
+	}
+
+	remaining, err := parseRoute(route)
+	if err != nil {
+		return err
+	}
+
+	commodity, err := s.ReadCommodity(ctx, commodityID)
+	if err != nil {
+		return fmt.Errorf("failed to get commodity: %v", err)
+	}
+
+	// Auth check to ensure that client's org actually owns the commodity
+	if clientOrgID != commodity.OwnerOrg {
+		return &AuthorizationError{ClientOrg: clientOrgID, Action: fmt.Sprintf("amend the route of a commodity owned by %s", commodity.OwnerOrg)}
+	}
+
+	err = verifyStatus(ctx, commodity, "have its route amended", activeStatuses...)
+	if err != nil {
+		return err
+	}
+
+	visited := commodity.Route[:commodity.RouteProgress]
+	commodity.Route = append(append([]string{}, visited...), remaining...)
+	commodity.Target = routeDestination(commodity.Route)
+
+	err = putCommodity(ctx, commodity)
+	if err != nil {
+		return err
+	}
+
+	return setCommodityEvent(ctx, eventRouteAmended, CommodityEvent{CommodityID: commodityID, OwnerOrg: clientOrgID})
+}
+
+// GetRouteProgress returns the orgs a commodity went through and still has to go through on its planned route
+func (s *SmartContract) GetRouteProgress(ctx contractapi.TransactionContextInterface, commodityID string) (*RouteStatus, error) {
+	commodity, err := s.ReadCommodity(ctx, commodityID)
+	if err != nil {
+		return nil, fmt.Errorf("failed to get commodity: %v", err)
+	}
+
+	status := &RouteStatus{
+		CommodityID: commodity.ID,
+		OwnerOrg:    commodity.OwnerOrg,
+		Route:       commodity.Route,
+		Visited:     commodity.Route[:commodity.RouteProgress],
+		Remaining:   commodity.Route[commodity.RouteProgress:],
+		NextOrg:     commodity.nextRouteOrg(),
+		Completed:   len(commodity.Route) > 0 && commodity.RouteProgress == len(commodity.Route),
+	}
+
+	return status, nil
+}
+
+// verifyRoute checks that the downstream company is the next stop of the planned route of the commodity.
+// Commodities without a route, including those created before routes were enforced, can go anywhere.
+func verifyRoute(commodity *Commodity, downstreamOrgID string) error {
+	if len(commodity.Route) == 0 {
+		return nil
+	}
+
+	next := commodity.nextRouteOrg()
+	if next == "" {
+		return fmt.Errorf("commodity %s already reached its destination %s, amend its route to transfer it further", commodity.ID, commodity.Target)
+	}
+	if downstreamOrgID != next {
+		return fmt.Errorf("transfer of %s to %s deviates from its route, next planned stop is %s", commodity.ID, downstreamOrgID, next)
+	}
+
+	return nil
+}
+
+// nextRouteOrg returns the next org of the planned route, or an empty string if the route is completed or not set
+func (commodity *Commodity) nextRouteOrg() string {
+	if commodity.RouteProgress >= len(commodity.Route) {
+		return ""
+	}
+	return commodity.Route[commodity.RouteProgress]
+}
+
+// parseRoute splits a comma separated list of orgs into a route, an empty list is no route
+func parseRoute(route string) ([]string, error) {
+	if strings.TrimSpace(route) == "" {
+		return nil, nil
+	}
+
+	var orgs []string
+	for _, org := range strings.Split(route, ",") {
+		org = strings.TrimSpace(org)
+		if org == "" {
+			return nil, fmt.Errorf("route %q contains an empty org", route)
+		}
+		if len(orgs) > 0 && orgs[len(orgs)-1] == org {
+			return nil, fmt.Errorf("route %q contains %s twice in a row", route, org)
+		}
+		orgs = append(orgs, org)
+	}
+
+	return orgs, nil
+}
+
+// routeDestination returns the final destination of a route
+func routeDestination(route []string) string {
+	if len(route) == 0 {
+		return ""
+	}
+	return route[len(route)-1]
+}
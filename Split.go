@@ -0,0 +1,122 @@
+package main
+
+import (
+	"crypto/sha256"
+	"encoding/hex"
+	"fmt"
+
+	"github.com/hyperledger/fabric-contract-api-go/contractapi"
+)
+
+// SplitCommodity splits a commodity into child commodities owned by the same org and returns their ids.
+// The properties of the children are passed by transient field as a JSON array, the id of each child is the hash of its
+// properties as passed. Children inherit the route and public description of the parent, which is marked as consumed.
+// Only the current owner can split a commodity.
+func (s *SmartContract) SplitCommodity(ctx contractapi.TransactionContextInterface, parentID string) ([]string, error) {
+	clientOrgID, err := getClientOrgID(ctx)
+	if err != nil {
+		return nil, err
+	}
+
+	// Children properties must be retrieved from the transient field as they are private
+	childrenProperties, err := getTransientList(ctx, commodityChildrenInput)
+	if err != nil {
+		return nil, err
+	}
+
+	parent, err := s.ReadCommodity(ctx, parentID)
+	if err != nil {
+		return nil, fmt.Errorf("failed to get commodity: %v", err)
+	}
+
+	// Auth check to ensure that client's org actually owns the commodity
+	if clientOrgID != parent.OwnerOrg {
+		return nil, &AuthorizationError{ClientOrg: clientOrgID, Action: fmt.Sprintf("split a commodity owned by %s", parent.OwnerOrg)}
+	}
+
+	// The properties of the children are only written to the owner's collection, so the peers of the endorsers of the
+	// parent can endorse too
+	_, err = s.verifyPeerEndorsesCommodities(ctx, clientOrgID, parent)
+	if err != nil {
+		return nil, err
+	}
+
+	// Children of a recalled commodity would escape the recall, and a listed commodity must be cancelled first
+	err = transitionStatus(ctx, parent, statusConsumed)
+	if err != nil {
+		return nil, err
+	}
+
+	collection := buildCollectionName(clientOrgID)
+	var childIDs []string
+	for i, propertiesJSON := range childrenProperties {
+		hash := sha256.New()
+		hash.Write(propertiesJSON)
+		childID := hex.EncodeToString(hash.Sum(nil))
+
+		// Writes are not visible before commit, so children with the same properties must be caught here
+		if j := indexOf(childIDs, childID); j >= 0 {
+			return nil, fmt.Errorf("children %d and %d have the same properties, add a unique %q member to tell them apart",
+				j, i, commoditySaltMember)
+		}
+		err = verifyCommodityDoesNotExist(ctx, childID)
+		if err != nil {
+			return nil, err
+		}
+
+		child := &Commodity{
+			ObjectType:        "Commodity",
+			ID:                childID,
+			OwnerOrg:          clientOrgID,
+			Source:            clientOrgID,
+			Target:            parent.Target,
+			Route:             parent.Route,
+			RouteProgress:     parent.RouteProgress,
+			PublicDescription: parent.PublicDescription,
+			Parents:           []string{parentID},
+			Endorsers:         parent.Endorsers,
+			EndorsersRequired: parent.EndorsersRequired,
+			Status:            statusCreated,
+		}
+		err = putCommodity(ctx, child)
+		if err != nil {
+			return nil, err
+		}
+
+		err = setCommodityStateBasedEndorsement(ctx, child)
+		if err != nil {
+			return nil, fmt.Errorf("failed setting state based endorsement for child commodity: %v", err)
+		}
+
+		err = ctx.GetStub().PutPrivateData(collection, childID, propertiesJSON)
+		if err != nil {
+			return nil, fmt.Errorf("failed to put child commodity private details: %v", err)
+		}
+
+		childIDs = append(childIDs, childID)
+	}
+
+	parent.Children = childIDs
+	parent.Consumed = true
+	err = putCommodity(ctx, parent)
+	if err != nil {
+		return nil, err
+	}
+
+	err = setCommodityEvent(ctx, eventCommoditySplit, CommodityEvent{CommodityID: parentID, OwnerOrg: clientOrgID, RelatedCommodityIDs: childIDs})
+	if err != nil {
+		return nil, err
+	}
+
+	return childIDs, nil
+}
+
+// indexOf returns the position of a value in a list, or -1
+func indexOf(values []string, value string) int {
+	for i, v := range values {
+		if v == value {
+			return i
+		}
+	}
+	return -1
+}
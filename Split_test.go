@@ -0,0 +1,147 @@
+package main
+
+import (
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"errors"
+	"strings"
+	"testing"
+
+	"SupplyChainTrackingChaincode/chaincodetest"
+)
+
+const casesProperties = `[{"name":"case","weight":50,"salt":"a"},{"name":"case","weight":50,"salt":"b"}]`
+
+// splitCommodity splits a commodity owned by the client's org and returns the ids of the children
+func splitCommodity(t *testing.T, ledger *chaincodetest.Ledger, client chaincodetest.Identity, parentID string, children string) []string {
+	t.Helper()
+
+	ctx := ledger.NewTransaction(client).WithTransient("commodity_children", []byte(children))
+	childIDs, err := newContract().SplitCommodity(ctx, parentID)
+	if err != nil {
+		t.Fatalf("SplitCommodity: %v", err)
+	}
+	if err = ctx.Commit(); err != nil {
+		t.Fatalf("commit SplitCommodity: %v", err)
+	}
+
+	return childIDs
+}
+
+func TestSplitCommodity(t *testing.T) {
+	ledger := chaincodetest.NewLedger()
+	s := newContract()
+
+	parentID := createCommodityOnRoute(t, ledger, org1Client, palletProperties, org2MSP)
+	childIDs := splitCommodity(t, ledger, org1Client, parentID, casesProperties)
+	if len(childIDs) != 2 {
+		t.Fatalf("children = %v, want 2", childIDs)
+	}
+
+	var elements []json.RawMessage
+	if err := json.Unmarshal([]byte(casesProperties), &elements); err != nil {
+		t.Fatal(err)
+	}
+	if hash := sha256.Sum256(elements[0]); childIDs[0] != hex.EncodeToString(hash[:]) {
+		t.Errorf("child id = %s, want the hash of its properties", childIDs[0])
+	}
+
+	parent, err := s.ReadCommodity(ledger.NewTransaction(org1Client), parentID)
+	if err != nil {
+		t.Fatalf("ReadCommodity: %v", err)
+	}
+	if !parent.Consumed || len(parent.Children) != 2 {
+		t.Errorf("parent = %+v, want consumed with 2 children", parent)
+	}
+
+	child, err := s.ReadCommodity(ledger.NewTransaction(org1Client), childIDs[1])
+	if err != nil {
+		t.Fatalf("ReadCommodity: %v", err)
+	}
+	if child.OwnerOrg != org1MSP || child.Target != org2MSP || len(child.Parents) != 1 || child.Parents[0] != parentID {
+		t.Errorf("child = %+v", child)
+	}
+	if got := ledger.PrivateData("_implicit_org_"+org1MSP, childIDs[1]); string(got) != string(elements[1]) {
+		t.Errorf("child properties = %s, want %s", got, elements[1])
+	}
+
+	// The parent can no longer be split nor transferred, the children can
+	ctx := ledger.NewTransaction(org1Client).WithTransient("commodity_children", []byte(casesProperties))
+	if _, err = s.SplitCommodity(ctx, parentID); err == nil || !strings.Contains(err.Error(), "consumed") {
+		t.Errorf("SplitCommodity of a consumed commodity: err = %v", err)
+	}
+	ctx = ledger.NewTransaction(org1Client).WithTransient("commodity_transferKey", transferKeyOf(parentID))
+	if err = s.AgreeToPut(ctx, parentID); err == nil || !strings.Contains(err.Error(), "consumed") {
+		t.Errorf("AgreeToPut of a consumed commodity: err = %v", err)
+	}
+
+	agree(t, ledger, org1Client, org2Client, childIDs[0], string(elements[0]), transferKeyOf(childIDs[0]))
+	if _, err = transfer(ledger, org1Client, org2MSP, childIDs[0], transferKeyOf(childIDs[0])); err != nil {
+		t.Errorf("TransferCommodity of a child: %v", err)
+	}
+
+	event := ledger.Events()[1]
+	if event.Name != "CommoditySplit" || !strings.Contains(string(event.Payload), childIDs[0]) {
+		t.Errorf("event = %s %s", event.Name, event.Payload)
+	}
+}
+
+func TestSplitCommodityRejectsInvalidChildren(t *testing.T) {
+	ledger := chaincodetest.NewLedger()
+	s := newContract()
+	parentID := createCommodity(t, ledger, org1Client, palletProperties)
+
+	for name, children := range map[string]string{
+		"not an array":      palletProperties,
+		"empty":             `[]`,
+		"not objects":       `["case"]`,
+		"same properties":   `[{"name":"case"},{"name":"case"}]`,
+		"existing parent":   `[` + palletProperties + `]`,
+		"salt not a string": `[{"name":"case","salt":1}]`,
+	} {
+		ctx := ledger.NewTransaction(org1Client).WithTransient("commodity_children", []byte(children))
+		if _, err := s.SplitCommodity(ctx, parentID); err == nil {
+			t.Errorf("%s: SplitCommodity succeeded", name)
+		}
+	}
+
+	ctx := ledger.NewTransaction(org1Client).WithTransient("commodity_children", []byte(`[1]`))
+	var invalid *InvalidTransientValueError
+	if _, err := s.SplitCommodity(ctx, parentID); !errors.As(err, &invalid) {
+		t.Errorf("err = %v, want an InvalidTransientValueError", err)
+	}
+
+	ctx = ledger.NewTransaction(org2Client).WithTransient("commodity_children", []byte(casesProperties))
+	if _, err := s.SplitCommodity(ctx, parentID); err == nil {
+		t.Error("SplitCommodity by another org succeeded")
+	}
+}
+
+func TestHistoryContinuesAcrossSplit(t *testing.T) {
+	ledger := chaincodetest.NewLedger()
+	s := newContract()
+
+	parentID := createCommodity(t, ledger, org1Client, palletProperties)
+	childIDs := splitCommodity(t, ledger, org1Client, parentID, casesProperties)
+
+	history, err := s.QueryCommodityHistory(ledger.NewTransaction(org1Client), childIDs[0])
+	if err != nil {
+		t.Fatalf("QueryCommodityHistory: %v", err)
+	}
+	if len(history) != 3 {
+		t.Fatalf("history = %+v, want the child's creation and the parent's creation and split", history)
+	}
+	if history[0].CommodityID != childIDs[0] || history[1].CommodityID != parentID || history[2].CommodityID != parentID {
+		t.Errorf("history spans %s, %s, %s", history[0].CommodityID, history[1].CommodityID, history[2].CommodityID)
+	}
+
+	chain, err := s.GetCustodyChain(ledger.NewTransaction(org1Client), childIDs[0])
+	if err != nil {
+		t.Fatalf("GetCustodyChain: %v", err)
+	}
+	// The custody chain only covers the child, which was created by the split
+	if len(chain.Segments) != 1 || chain.OriginOrg != org1MSP || chain.Segments[0].FromTxId != history[0].TxId {
+		t.Errorf("chain = %+v, want a single segment since the creation of the child", chain)
+	}
+}
@@ -0,0 +1,229 @@
+package main
+
+import (
+	"encoding/json"
+	"fmt"
+
+	"github.com/hyperledger/fabric-contract-api-go/contractapi"
+)
+
+// Lifecycle statuses of a commodity
+const (
+	statusCreated   = "Created"   // created, split from another commodity or assembled, never transferred
+	statusListed    = "Listed"    // the owner agreed to put it, only ever derived from its agreement, see AgreeToPut
+	statusInTransit = "InTransit" // shipped to the downstream company, see ShipCommodity
+	statusDelivered = "Delivered" // transferred to its current owner
+	statusConsumed  = "Consumed"  // split or assembled into other commodities, terminal
+	statusRecalled  = "Recalled"  // under recall, only ever derived from the recall marks
+	statusDestroyed = "Destroyed" // retired by its owner, see RetireCommodity, terminal
+)
+
+// statusTransitions lists the statuses a commodity can go to from each status
+var statusTransitions = map[string][]string{
+	statusCreated:   {statusListed, statusConsumed, statusDestroyed},
+	statusListed:    {statusListed, statusCreated, statusDelivered, statusInTransit, statusDestroyed},
+	statusInTransit: {statusDelivered, statusCreated, statusDestroyed}, // received, cancelled or lost, see CancelShipment
+	statusDelivered: {statusListed, statusConsumed, statusDestroyed},
+	statusRecalled:  {statusDelivered, statusCreated, statusDestroyed}, // a recalled shipment can still be received or cancelled
+	statusConsumed:  {},
+	statusDestroyed: {},
+}
+
+// activeStatuses are the statuses in which the owner can update the description, route, details and endorsers of a commodity
+var activeStatuses = []string{statusCreated, statusListed, statusDelivered}
+
+// CommodityStatus is the lifecycle status of a commodity and the statuses it can go to next
+type CommodityStatus struct {
+	CommodityID  string   `json:"commodityID"`
+	OwnerOrg     string   `json:"ownerCompany"`
+	Status       string   `json:"status"`
+	Stored       bool     `json:"stored"` // Stored is false when the status was derived for a record created before statuses existed
+	NextStatuses []string `json:"nextStatuses"`
+}
+
+// GetCommodityStatus returns the lifecycle status of a commodity
+func (s *SmartContract) GetCommodityStatus(ctx contractapi.TransactionContextInterface, commodityID string) (*CommodityStatus, error) {
+	commodity, err := s.ReadCommodity(ctx, commodityID)
+	if err != nil {
+		return nil, fmt.Errorf("failed to get commodity: %v", err)
+	}
+
+	status, err := getCommodityStatus(ctx, commodity)
+	if err != nil {
+		return nil, err
+	}
+
+	return &CommodityStatus{
+		CommodityID:  commodityID,
+		OwnerOrg:     commodity.OwnerOrg,
+		Status:       status,
+		Stored:       commodity.Status != "",
+		NextStatuses: statusTransitions[status],
+	}, nil
+}
+
+// StatusMigrationResult lists the commodities migrated by a page of MigrateCommodityStatuses, Bookmark is empty on the last page
+type StatusMigrationResult struct {
+	Migrated            []string `json:"migrated"`
+	FetchedRecordsCount int32    `json:"fetchedRecordsCount"`
+	Bookmark            string   `json:"bookmark"`
+}
+
+// MigrateCommodityStatuses stores the derived status of the commodities owned by the client's org that were created
+// before statuses existed. Records without a status keep working, their status is derived when needed.
+// The world state is scanned by pages of pageSize keys, bookmark is the one returned with the previous page, empty for
+// the first page. The peer only pages read-only transactions, so the pages are bounded here.
+func (s *SmartContract) MigrateCommodityStatuses(ctx contractapi.TransactionContextInterface, pageSize int32, bookmark string) (*StatusMigrationResult, error) {
+	if pageSize <= 0 {
+		return nil, fmt.Errorf("page size must be positive: %d", pageSize)
+	}
+
+	clientOrgID, err := getClientOrgID(ctx)
+	if err != nil {
+		return nil, err
+	}
+
+	// Composite keys, e.g. recalls, are not part of a range query of simple keys
+	resultsIterator, err := ctx.GetStub().GetStateByRange(bookmark, "")
+	if err != nil {
+		return nil, fmt.Errorf("failed to read from world state: %v", err)
+	}
+
+	// Collect the commodities to migrate first, the iterator is closed before updating them.
+	// The bookmark is the first key of the next page.
+	page := &StatusMigrationResult{Migrated: []string{}}
+	var unmigrated []*Commodity
+	for resultsIterator.HasNext() {
+		response, err := resultsIterator.Next()
+		if err != nil {
+			resultsIterator.Close()
+			return nil, err
+		}
+		if page.FetchedRecordsCount == pageSize {
+			page.Bookmark = response.Key
+			break
+		}
+		page.FetchedRecordsCount++
+
+		// Values that are not commodities are skipped
+		var commodity *Commodity
+		if json.Unmarshal(response.Value, &commodity) != nil || commodity == nil || commodity.ObjectType != "Commodity" {
+			continue
+		}
+		if commodity.OwnerOrg == clientOrgID && commodity.Status == "" {
+			unmigrated = append(unmigrated, commodity)
+		}
+	}
+	resultsIterator.Close()
+
+	for _, commodity := range unmigrated {
+		commodity.Status = deriveCommodityStatus(commodity)
+		err = putCommodity(ctx, commodity)
+		if err != nil {
+			return nil, err
+		}
+		page.Migrated = append(page.Migrated, commodity.ID)
+	}
+
+	return page, nil
+}
+
+// getCommodityStatus returns the current status of a commodity.
+// Recalls and agreements to put are not written to the commodity, as its endorsers would have to endorse them,
+// so a commodity that is neither consumed nor destroyed is Recalled if a recall affects it, and Listed if its owner agreed to put it.
+func getCommodityStatus(ctx contractapi.TransactionContextInterface, commodity *Commodity) (string, error) {
+	status := commodity.Status
+	if status == "" {
+		status = deriveCommodityStatus(commodity)
+	}
+	if status == statusConsumed || status == statusDestroyed {
+		return status, nil
+	}
+
+	if verifyNotRecalled(ctx, commodity.ID) != nil {
+		return statusRecalled, nil
+	}
+	if status != statusCreated && status != statusDelivered {
+		return status, nil
+	}
+
+	// The owner's agreement to put is private, but its hash can be read on any peer
+	agreementKey, err := ctx.GetStub().CreateCompositeKey(typeCommodityForTransfer, []string{commodity.ID})
+	if err != nil {
+		return "", fmt.Errorf("failed to create composite key: %v", err)
+	}
+	agreementHash, err := ctx.GetStub().GetPrivateDataHash(buildCollectionName(commodity.OwnerOrg), agreementKey)
+	if err != nil {
+		return "", fmt.Errorf("failed to read agreement hash: %v", err)
+	}
+	if agreementHash != nil {
+		return statusListed, nil
+	}
+	return status, nil
+}
+
+// deriveCommodityStatus returns the stored status of a commodity created before statuses existed
+func deriveCommodityStatus(commodity *Commodity) string {
+	if commodity.Consumed {
+		return statusConsumed
+	}
+	if commodity.Shipment != nil {
+		return statusInTransit
+	}
+	if commodity.Source != commodity.OwnerOrg {
+		return statusDelivered
+	}
+	return statusCreated
+}
+
+// transitionStatus checks that a commodity can go from its current status to the next stored one and sets it
+func transitionStatus(ctx contractapi.TransactionContextInterface, commodity *Commodity, next string) error {
+	err := verifyTransition(ctx, commodity, next)
+	if err != nil {
+		return err
+	}
+
+	commodity.Status = next
+	return nil
+}
+
+// verifyTransition checks that a commodity can go from its current status to the next one
+func verifyTransition(ctx contractapi.TransactionContextInterface, commodity *Commodity, next string) error {
+	status, err := getCommodityStatus(ctx, commodity)
+	if err != nil {
+		return err
+	}
+	if indexOf(statusTransitions[status], next) < 0 {
+		return statusError(ctx, commodity, status, "become "+next)
+	}
+	return nil
+}
+
+// verifyStatus checks that the current status of a commodity is one of the allowed statuses for an action
+func verifyStatus(ctx contractapi.TransactionContextInterface, commodity *Commodity, action string, allowed ...string) error {
+	status, err := getCommodityStatus(ctx, commodity)
+	if err != nil {
+		return err
+	}
+	if indexOf(allowed, status) < 0 {
+		return statusError(ctx, commodity, status, action)
+	}
+	return nil
+}
+
+// statusError explains why a commodity in the given status cannot go through an action
+func statusError(ctx contractapi.TransactionContextInterface, commodity *Commodity, status string, action string) error {
+	var err error
+	switch status {
+	case statusConsumed:
+		err = verifyNotConsumed(commodity)
+	case statusInTransit:
+		err = verifyNotInTransit(commodity)
+	case statusRecalled:
+		err = verifyNotRecalled(ctx, commodity.ID)
+	}
+	if err != nil {
+		return fmt.Errorf("%v, it cannot %s", err, action)
+	}
+	return fmt.Errorf("commodity %s is %s, it cannot %s", commodity.ID, status, action)
+}
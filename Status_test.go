@@ -0,0 +1,194 @@
+package main
+
+import (
+	"encoding/json"
+	"strings"
+	"testing"
+
+	"SupplyChainTrackingChaincode/chaincodetest"
+
+	"github.com/hyperledger/fabric-contract-api-go/contractapi"
+)
+
+// commodityStatus returns the status of a commodity as seen by a third org
+func commodityStatus(t *testing.T, ledger *chaincodetest.Ledger, commodityID string) string {
+	t.Helper()
+
+	status, err := newContract().GetCommodityStatus(ledger.NewTransaction(org3Client), commodityID)
+	if err != nil {
+		t.Fatalf("GetCommodityStatus: %v", err)
+	}
+	return status.Status
+}
+
+func TestCommodityStatusLifecycle(t *testing.T) {
+	ledger := chaincodetest.NewLedger()
+	s := newContract()
+	commodityID := createCommodity(t, ledger, org1Client, palletProperties)
+	if status := commodityStatus(t, ledger, commodityID); status != statusCreated {
+		t.Errorf("status after creation = %s, want %s", status, statusCreated)
+	}
+
+	agree(t, ledger, org1Client, org2Client, commodityID, palletProperties, transferKeyOf(commodityID))
+	if status := commodityStatus(t, ledger, commodityID); status != statusListed {
+		t.Errorf("status after AgreeToPut = %s, want %s", status, statusListed)
+	}
+
+	// A listed commodity must be cancelled before it is split
+	ctx := ledger.NewTransaction(org1Client).WithTransient("commodity_children", []byte(casesProperties))
+	if _, err := s.SplitCommodity(ctx, commodityID); err == nil || !strings.Contains(err.Error(), statusListed) {
+		t.Errorf("SplitCommodity of a listed commodity: err = %v", err)
+	}
+
+	shipCommodity(t, ledger, org1Client, org2Client, commodityID)
+	if status := commodityStatus(t, ledger, commodityID); status != statusInTransit {
+		t.Errorf("status after ShipCommodity = %s, want %s", status, statusInTransit)
+	}
+	ctx = ledger.NewTransaction(org1Client)
+	if err := s.ChangePublicDescription(ctx, commodityID, "repacked"); err == nil {
+		t.Error("ChangePublicDescription of a commodity in transit succeeded")
+	}
+
+	ctx = ledger.NewTransaction(org2Client).EndorsedBy(org1MSP, org2MSP)
+	err := ctx.Endorse(func(ctx contractapi.TransactionContextInterface) error {
+		return s.ConfirmReceipt(ctx, commodityID)
+	})
+	if err != nil {
+		t.Fatalf("ConfirmReceipt: %v", err)
+	}
+	if err = ctx.Commit(); err != nil {
+		t.Fatalf("commit ConfirmReceipt: %v", err)
+	}
+
+	status, err := s.GetCommodityStatus(ledger.NewTransaction(org3Client), commodityID)
+	if err != nil {
+		t.Fatalf("GetCommodityStatus: %v", err)
+	}
+	if status.Status != statusDelivered || !status.Stored || status.OwnerOrg != org2MSP {
+		t.Errorf("status after ConfirmReceipt = %+v", status)
+	}
+
+	splitCommodity(t, ledger, org2Client, commodityID, casesProperties)
+	if status := commodityStatus(t, ledger, commodityID); status != statusConsumed {
+		t.Errorf("status after SplitCommodity = %s, want %s", status, statusConsumed)
+	}
+	ctx = ledger.NewTransaction(org2Client).WithTransient("commodity_transferKey", transferKeyOf(commodityID))
+	if err = s.AgreeToPut(ctx, commodityID); err == nil || !strings.Contains(err.Error(), "split into") {
+		t.Errorf("AgreeToPut of a consumed commodity: err = %v", err)
+	}
+}
+
+func TestCancelPutAgreementUnlistsCommodity(t *testing.T) {
+	ledger := chaincodetest.NewLedger()
+	commodityID := createCommodity(t, ledger, org1Client, palletProperties)
+	agree(t, ledger, org1Client, org2Client, commodityID, palletProperties, transferKeyOf(commodityID))
+
+	ctx := ledger.NewTransaction(org1Client)
+	if err := newContract().CancelPutAgreement(ctx, commodityID); err != nil {
+		t.Fatalf("CancelPutAgreement: %v", err)
+	}
+	if err := ctx.Commit(); err != nil {
+		t.Fatalf("commit CancelPutAgreement: %v", err)
+	}
+
+	if status := commodityStatus(t, ledger, commodityID); status != statusCreated {
+		t.Errorf("status after CancelPutAgreement = %s, want %s", status, statusCreated)
+	}
+}
+
+func TestRecalledCommodityStatus(t *testing.T) {
+	ledger := chaincodetest.NewLedger()
+	s := newContract()
+	commodityID := createCommodity(t, ledger, org1Client, palletProperties)
+	if _, err := issueRecall(s, ledger, org1Client, commodityID); err != nil {
+		t.Fatalf("IssueRecall: %v", err)
+	}
+
+	status, err := s.GetCommodityStatus(ledger.NewTransaction(org3Client), commodityID)
+	if err != nil {
+		t.Fatalf("GetCommodityStatus: %v", err)
+	}
+	if status.Status != statusRecalled || len(status.NextStatuses) != 3 {
+		t.Errorf("status of a recalled commodity = %+v", status)
+	}
+
+	ctx := ledger.NewTransaction(org1Client)
+	if err = s.AmendRoute(ctx, commodityID, org2MSP); err == nil || !strings.Contains(err.Error(), "recall") {
+		t.Errorf("AmendRoute of a recalled commodity: err = %v", err)
+	}
+}
+
+func TestMigrateCommodityStatuses(t *testing.T) {
+	ledger := chaincodetest.NewLedger()
+	s := newContract()
+	commodityID := createCommodity(t, ledger, org1Client, palletProperties)
+	handOver(t, ledger, org1Client, org2Client, commodityID)
+
+	// Drop the status, as if the commodity was transferred before statuses existed
+	var commodity Commodity
+	if err := json.Unmarshal(ledger.State(commodityID), &commodity); err != nil {
+		t.Fatal(err)
+	}
+	commodity.Status = ""
+	legacyJSON, err := json.Marshal(commodity)
+	if err != nil {
+		t.Fatal(err)
+	}
+	ctx := ledger.NewTransaction(org2Client)
+	if err = ctx.Stub().PutState(commodityID, legacyJSON); err != nil {
+		t.Fatal(err)
+	}
+	if err = ctx.Commit(); err != nil {
+		t.Fatalf("commit legacy commodity: %v", err)
+	}
+
+	status, err := s.GetCommodityStatus(ledger.NewTransaction(org3Client), commodityID)
+	if err != nil {
+		t.Fatalf("GetCommodityStatus: %v", err)
+	}
+	if status.Status != statusDelivered || status.Stored {
+		t.Errorf("derived status = %+v", status)
+	}
+
+	// A value that is not a commodity is skipped
+	ctx = ledger.NewTransaction(org2Client)
+	if err = ctx.Stub().PutState("~not a commodity", []byte("42")); err != nil {
+		t.Fatal(err)
+	}
+	if err = ctx.Commit(); err != nil {
+		t.Fatalf("commit other value: %v", err)
+	}
+
+	// Only the owner migrates its commodities
+	ctx = ledger.NewTransaction(org1Client)
+	page, err := s.MigrateCommodityStatuses(ctx, 10, "")
+	if err != nil || len(page.Migrated) != 0 {
+		t.Errorf("MigrateCommodityStatuses by a former owner = %+v, %v", page, err)
+	}
+
+	// The commodity is on the first page of a single key, the other value on the second one
+	ctx = ledger.NewTransaction(org2Client)
+	page, err = s.MigrateCommodityStatuses(ctx, 1, "")
+	if err != nil {
+		t.Fatalf("MigrateCommodityStatuses: %v", err)
+	}
+	if len(page.Migrated) != 1 || page.Migrated[0] != commodityID || page.Bookmark != "~not a commodity" {
+		t.Errorf("first page = %+v, want [%s] and a bookmark", page, commodityID)
+	}
+	if err = ctx.Commit(); err != nil {
+		t.Fatalf("commit MigrateCommodityStatuses: %v", err)
+	}
+
+	page, err = s.MigrateCommodityStatuses(ledger.NewTransaction(org2Client), 1, page.Bookmark)
+	if err != nil || len(page.Migrated) != 0 || page.FetchedRecordsCount != 1 || page.Bookmark != "" {
+		t.Errorf("last page = %+v, %v", page, err)
+	}
+	if _, err = s.MigrateCommodityStatuses(ledger.NewTransaction(org2Client), 0, ""); err == nil {
+		t.Error("MigrateCommodityStatuses accepted an empty page")
+	}
+
+	status, err = s.GetCommodityStatus(ledger.NewTransaction(org3Client), commodityID)
+	if err != nil || status.Status != statusDelivered || !status.Stored {
+		t.Errorf("migrated status = %+v, %v", status, err)
+	}
+}
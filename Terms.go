@@ -0,0 +1,315 @@
+package main
+
+import (
+	"bytes"
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"fmt"
+	"regexp"
+	"time"
+
+	"github.com/hyperledger/fabric-contract-api-go/contractapi"
+)
+
+const (
+	typeCommodityTerms = "TT" // TT~commodityID holds the current commercial terms of a company for a commodity in its implicit collection
+	typeTermsRevision  = "TR" // TR~commodityID~revision holds every terms a company proposed for a commodity in its implicit collection
+)
+
+// Sides of a negotiation
+const (
+	sidePut = "put" // the owner of the commodity
+	sideGet = "get" // a company that wants to get the commodity
+)
+
+// incoterms are the Incoterms 2020 rules accepted in commercial terms
+var incoterms = []string{"EXW", "FCA", "CPT", "CIP", "DAP", "DPU", "DDP", "FAS", "FOB", "CFR", "CIF"}
+
+var currencyPattern = regexp.MustCompile(`^[A-Z]{3}$`)
+
+// CommercialTerms are the private terms of a transfer, UnitPrice is in minor units of Currency, e.g. cents of EUR
+type CommercialTerms struct {
+	UnitPrice    int64  `json:"unitPrice"`
+	Currency     string `json:"currency"`
+	Quantity     int64  `json:"quantity"`
+	Incoterm     string `json:"incoterm"`
+	DeliveryDate string `json:"deliveryDate"` // DeliveryDate is a date like 2006-01-02
+}
+
+// TermsRevision is one of the terms a company proposed for a commodity, its history is kept after the transfer
+type TermsRevision struct {
+	ObjectType  string          `json:"objectType"`
+	CommodityID string          `json:"commodityID"`
+	Revision    int             `json:"revision"`
+	Side        string          `json:"side"`
+	Terms       CommercialTerms `json:"terms"`
+	TermsHash   string          `json:"termsHash"`
+	TxID        string          `json:"txId"`
+	Timestamp   time.Time       `json:"timestamp"`
+}
+
+// ProposedTerms identifies the revision stored by ProposeTerms. Like any transaction response it is written to the block,
+// so it holds no terms, the caller reads them with GetTermsHistory.
+type ProposedTerms struct {
+	CommodityID string `json:"commodityID"`
+	Revision    int    `json:"revision"`
+	TermsHash   string `json:"termsHash"`
+}
+
+// TermsMatch tells whether the current terms of the caller and of a counterparty for a commodity are the same
+type TermsMatch struct {
+	CommodityID  string `json:"commodityID"`
+	Counterparty string `json:"counterparty"`
+	Proposed     bool   `json:"proposed"`            // Proposed is false if the counterparty has no current terms
+	Matching     bool   `json:"matching"`            // Matching is set when both companies hold byte-identical terms
+	TermsHash    string `json:"termsHash,omitempty"` // TermsHash is the hash of the caller's terms if they match
+}
+
+// ProposeTerms stores the commercial terms passed by transient field as the caller's current terms for a commodity,
+// and adds them to the caller's history of revisions. The owner proposes the terms it puts the commodity at,
+// any other company the terms it gets it at. Either side answers an offer by proposing its own revision, until both hold
+// the same terms; the transfer of the commodity then only proceeds if their hashes match, like the transferKey ones.
+// Terms are compared byte for byte, so both companies must pass the same JSON.
+func (s *SmartContract) ProposeTerms(ctx contractapi.TransactionContextInterface, commodityID string) (*ProposedTerms, error) {
+	clientOrgID, err := getClientOrgID(ctx)
+	if err != nil {
+		return nil, err
+	}
+
+	// The history is read from and the terms are written to the client's collection
+	err = s.verifyClientOrgMatchesPeerOrg(ctx, clientOrgID)
+	if err != nil {
+		return nil, err
+	}
+
+	termsJSON, err := getTransientInput(ctx, commodityTermsInput)
+	if err != nil {
+		return nil, err
+	}
+	terms, err := parseTerms(termsJSON)
+	if err != nil {
+		return nil, err
+	}
+
+	commodity, err := s.ReadCommodity(ctx, commodityID)
+	if err != nil {
+		return nil, fmt.Errorf("failed to get commodity: %v", err)
+	}
+	err = verifyStatus(ctx, commodity, "be negotiated", activeStatuses...)
+	if err != nil {
+		return nil, err
+	}
+
+	side := sideGet
+	if clientOrgID == commodity.OwnerOrg {
+		side = sidePut
+	}
+
+	collection := buildCollectionName(clientOrgID)
+	revision, err := countTermsRevisions(ctx, collection, commodityID)
+	if err != nil {
+		return nil, err
+	}
+
+	// The terms are persisted as is, so that their private data hash is the one of the passed JSON
+	termsKey, err := ctx.GetStub().CreateCompositeKey(typeCommodityTerms, []string{commodityID})
+	if err != nil {
+		return nil, fmt.Errorf("failed to create composite key: %v", err)
+	}
+	err = ctx.GetStub().PutPrivateData(collection, termsKey, termsJSON)
+	if err != nil {
+		return nil, fmt.Errorf("failed to put terms: %v", err)
+	}
+
+	timestamp, err := getTxTime(ctx)
+	if err != nil {
+		return nil, err
+	}
+	hash := sha256.Sum256(termsJSON)
+	termsRevision := &TermsRevision{
+		ObjectType:  "TermsRevision",
+		CommodityID: commodityID,
+		Revision:    revision + 1,
+		Side:        side,
+		Terms:       *terms,
+		TermsHash:   hex.EncodeToString(hash[:]),
+		TxID:        ctx.GetStub().GetTxID(),
+		Timestamp:   timestamp,
+	}
+	revisionJSON, err := json.Marshal(termsRevision)
+	if err != nil {
+		return nil, fmt.Errorf("failed to marshal terms revision: %v", err)
+	}
+	// Revisions are zero padded, so that the history is returned in order
+	revisionKey, err := ctx.GetStub().CreateCompositeKey(typeTermsRevision, []string{commodityID, fmt.Sprintf("%06d", termsRevision.Revision)})
+	if err != nil {
+		return nil, fmt.Errorf("failed to create composite key: %v", err)
+	}
+	err = ctx.GetStub().PutPrivateData(collection, revisionKey, revisionJSON)
+	if err != nil {
+		return nil, fmt.Errorf("failed to put terms revision: %v", err)
+	}
+
+	err = setCommodityEvent(ctx, eventTermsProposed, CommodityEvent{CommodityID: commodityID, OwnerOrg: commodity.OwnerOrg})
+	if err != nil {
+		return nil, err
+	}
+
+	return &ProposedTerms{CommodityID: commodityID, Revision: termsRevision.Revision, TermsHash: termsRevision.TermsHash}, nil
+}
+
+// GetTermsHistory returns every terms the caller proposed for a commodity, from the first to the last revision
+func (s *SmartContract) GetTermsHistory(ctx contractapi.TransactionContextInterface, commodityID string) ([]TermsRevision, error) {
+	collection, err := s.getClientImplicitCollectionNameAndVerifyClientOrg(ctx)
+	if err != nil {
+		return nil, err
+	}
+
+	revisionsIterator, err := ctx.GetStub().GetPrivateDataByPartialCompositeKey(collection, typeTermsRevision, []string{commodityID})
+	if err != nil {
+		return nil, fmt.Errorf("failed to read from private data collection: %v", err)
+	}
+	defer revisionsIterator.Close()
+
+	revisions := []TermsRevision{}
+	for revisionsIterator.HasNext() {
+		resp, err := revisionsIterator.Next()
+		if err != nil {
+			return nil, err
+		}
+
+		var revision TermsRevision
+		err = json.Unmarshal(resp.Value, &revision)
+		if err != nil {
+			return nil, err
+		}
+		revisions = append(revisions, revision)
+	}
+
+	return revisions, nil
+}
+
+// CompareTerms tells the caller whether a counterparty currently holds the same terms for a commodity
+func (s *SmartContract) CompareTerms(ctx contractapi.TransactionContextInterface, commodityID string, counterpartyOrgID string) (*TermsMatch, error) {
+	clientOrgID, err := getClientOrgID(ctx)
+	if err != nil {
+		return nil, err
+	}
+
+	termsHash, counterpartyTermsHash, err := getTermsHashes(ctx, commodityID, clientOrgID, counterpartyOrgID)
+	if err != nil {
+		return nil, err
+	}
+
+	match := &TermsMatch{
+		CommodityID:  commodityID,
+		Counterparty: counterpartyOrgID,
+		Proposed:     counterpartyTermsHash != nil,
+		Matching:     termsHash != nil && bytes.Equal(termsHash, counterpartyTermsHash),
+	}
+	if match.Matching {
+		match.TermsHash = hex.EncodeToString(termsHash)
+	}
+	return match, nil
+}
+
+// verifyTermsMatch checks that the putter and getter of a commodity hold the same terms, if any of them proposed terms.
+// Transfers negotiated with the transferKey only do not need terms.
+func verifyTermsMatch(ctx contractapi.TransactionContextInterface, commodityID string, putterOrgID string, getterOrgID string) error {
+	putterTermsHash, getterTermsHash, err := getTermsHashes(ctx, commodityID, putterOrgID, getterOrgID)
+	if err != nil {
+		return err
+	}
+	if putterTermsHash == nil && getterTermsHash == nil {
+		return nil
+	}
+
+	if !bytes.Equal(putterTermsHash, getterTermsHash) {
+		return fmt.Errorf("terms of %s for %s with hash %x do not match terms of %s with hash %x, propose the agreed terms first",
+			putterOrgID, commodityID, putterTermsHash, getterOrgID, getterTermsHash)
+	}
+	return nil
+}
+
+// getTermsHashes returns the hashes of the current terms of two companies for a commodity, nil for a company without terms
+func getTermsHashes(ctx contractapi.TransactionContextInterface, commodityID string, orgID string, otherOrgID string) ([]byte, []byte, error) {
+	termsKey, err := ctx.GetStub().CreateCompositeKey(typeCommodityTerms, []string{commodityID})
+	if err != nil {
+		return nil, nil, fmt.Errorf("failed to create composite key: %v", err)
+	}
+
+	termsHash, err := ctx.GetStub().GetPrivateDataHash(buildCollectionName(orgID), termsKey)
+	if err != nil {
+		return nil, nil, fmt.Errorf("failed to read terms hash of %s: %v", orgID, err)
+	}
+	otherTermsHash, err := ctx.GetStub().GetPrivateDataHash(buildCollectionName(otherOrgID), termsKey)
+	if err != nil {
+		return nil, nil, fmt.Errorf("failed to read terms hash of %s: %v", otherOrgID, err)
+	}
+
+	return termsHash, otherTermsHash, nil
+}
+
+// deleteTerms deletes the current terms of a company for a commodity, its history of revisions is kept
+func deleteTerms(ctx contractapi.TransactionContextInterface, collection string, commodityID string) error {
+	termsKey, err := ctx.GetStub().CreateCompositeKey(typeCommodityTerms, []string{commodityID})
+	if err != nil {
+		return fmt.Errorf("failed to create composite key: %v", err)
+	}
+	err = ctx.GetStub().DelPrivateData(collection, termsKey)
+	if err != nil {
+		return fmt.Errorf("failed to delete terms: %v", err)
+	}
+	return nil
+}
+
+// countTermsRevisions returns the number of terms a company proposed for a commodity
+func countTermsRevisions(ctx contractapi.TransactionContextInterface, collection string, commodityID string) (int, error) {
+	revisionsIterator, err := ctx.GetStub().GetPrivateDataByPartialCompositeKey(collection, typeTermsRevision, []string{commodityID})
+	if err != nil {
+		return 0, fmt.Errorf("failed to read from private data collection: %v", err)
+	}
+	defer revisionsIterator.Close()
+
+	count := 0
+	for revisionsIterator.HasNext() {
+		_, err := revisionsIterator.Next()
+		if err != nil {
+			return 0, err
+		}
+		count++
+	}
+	return count, nil
+}
+
+// parseTerms unmarshals commercial terms and checks their values
+func parseTerms(termsJSON []byte) (*CommercialTerms, error) {
+	var terms CommercialTerms
+	err := json.Unmarshal(termsJSON, &terms)
+	if err != nil {
+		return nil, &InvalidTransientValueError{Key: commodityTermsInput.key, Reason: err.Error()}
+	}
+
+	reason := ""
+	switch {
+	case terms.UnitPrice < 0:
+		reason = "unitPrice must not be negative"
+	case terms.Quantity <= 0:
+		reason = "quantity must be positive"
+	case !currencyPattern.MatchString(terms.Currency):
+		reason = fmt.Sprintf("currency %q must be an ISO 4217 code like EUR", terms.Currency)
+	case indexOf(incoterms, terms.Incoterm) < 0:
+		reason = fmt.Sprintf("unknown incoterm %q", terms.Incoterm)
+	}
+	if reason == "" {
+		if _, err = time.Parse("2006-01-02", terms.DeliveryDate); err != nil {
+			reason = fmt.Sprintf("deliveryDate %q must be a date like 2006-01-02", terms.DeliveryDate)
+		}
+	}
+	if reason != "" {
+		return nil, &InvalidTransientValueError{Key: commodityTermsInput.key, Reason: reason}
+	}
+
+	return &terms, nil
+}
@@ -0,0 +1,118 @@
+package main
+
+import (
+	"crypto/sha256"
+	"encoding/hex"
+	"errors"
+	"strings"
+	"testing"
+
+	"SupplyChainTrackingChaincode/chaincodetest"
+)
+
+const (
+	offeredTerms = `{"unitPrice":1250,"currency":"EUR","quantity":40,"incoterm":"FCA","deliveryDate":"2024-06-01"}`
+	counterTerms = `{"unitPrice":1100,"currency":"EUR","quantity":40,"incoterm":"FCA","deliveryDate":"2024-06-01"}`
+)
+
+// proposeTerms proposes commercial terms for a commodity on behalf of the client's org
+func proposeTerms(t *testing.T, ledger *chaincodetest.Ledger, client chaincodetest.Identity, commodityID string, terms string) *ProposedTerms {
+	t.Helper()
+
+	ctx := ledger.NewTransaction(client).WithTransient("commodity_terms", []byte(terms))
+	revision, err := newContract().ProposeTerms(ctx, commodityID)
+	if err != nil {
+		t.Fatalf("ProposeTerms: %v", err)
+	}
+	if err = ctx.Commit(); err != nil {
+		t.Fatalf("commit ProposeTerms: %v", err)
+	}
+
+	return revision
+}
+
+func TestTermsNegotiation(t *testing.T) {
+	ledger := chaincodetest.NewLedger()
+	s := newContract()
+	commodityID := createCommodity(t, ledger, org1Client, palletProperties)
+	agree(t, ledger, org1Client, org2Client, commodityID, palletProperties, transferKeyOf(commodityID))
+
+	offer := proposeTerms(t, ledger, org1Client, commodityID, offeredTerms)
+	if offer.Revision != 1 {
+		t.Errorf("offer = %+v", offer)
+	}
+	history, err := s.GetTermsHistory(ledger.NewTransaction(org1Client), commodityID)
+	if err != nil || len(history) != 1 || history[0].Side != sidePut || history[0].Terms.UnitPrice != 1250 || history[0].TermsHash != offer.TermsHash {
+		t.Errorf("history of the offer = %+v, %v", history, err)
+	}
+	counter := proposeTerms(t, ledger, org2Client, commodityID, counterTerms)
+	if counter.Revision != 1 {
+		t.Errorf("counter-offer = %+v", counter)
+	}
+
+	match, err := s.CompareTerms(ledger.NewTransaction(org1Client), commodityID, org2MSP)
+	if err != nil || !match.Proposed || match.Matching {
+		t.Errorf("CompareTerms of different terms = %+v, %v", match, err)
+	}
+	if _, err = transfer(ledger, org1Client, org2MSP, commodityID, transferKeyOf(commodityID)); err == nil || !strings.Contains(err.Error(), "terms") {
+		t.Fatalf("TransferCommodity with different terms: err = %v", err)
+	}
+
+	// The owner accepts the counter-offer by proposing the same terms
+	revision := proposeTerms(t, ledger, org1Client, commodityID, counterTerms)
+	if revision.Revision != 2 {
+		t.Errorf("revision = %d, want 2", revision.Revision)
+	}
+	match, err = s.CompareTerms(ledger.NewTransaction(org2Client), commodityID, org1MSP)
+	if err != nil || !match.Matching || match.TermsHash != counter.TermsHash {
+		t.Errorf("CompareTerms of the same terms = %+v, %v", match, err)
+	}
+
+	fund(t, ledger, org2MSP, "EUR", 44000)
+	ctx, err := transferWithTerms(ledger, org1Client, org2MSP, commodityID, transferKeyOf(commodityID), counterTerms)
+	if err != nil {
+		t.Fatalf("TransferCommodity: %v", err)
+	}
+	receipt, err := s.GetReceipt(ledger.NewTransaction(org2Client), commodityID, ctx.GetStub().GetTxID())
+	hash := sha256.Sum256([]byte(counterTerms))
+	if err != nil || receipt.TermsHash != hex.EncodeToString(hash[:]) {
+		t.Errorf("receipt = %+v, %v", receipt, err)
+	}
+
+	// The terms are settled, their history is kept
+	match, err = s.CompareTerms(ledger.NewTransaction(org2Client), commodityID, org1MSP)
+	if err != nil || match.Proposed || match.Matching {
+		t.Errorf("CompareTerms after the transfer = %+v, %v", match, err)
+	}
+	history, err = s.GetTermsHistory(ledger.NewTransaction(org1Client), commodityID)
+	if err != nil || len(history) != 2 || history[0].Terms.UnitPrice != 1250 || history[1].Terms.UnitPrice != 1100 {
+		t.Errorf("history of org1 = %+v, %v", history, err)
+	}
+	history, err = s.GetTermsHistory(ledger.NewTransaction(org2Client), commodityID)
+	if err != nil || len(history) != 1 || history[0].Side != sideGet {
+		t.Errorf("history of org2 = %+v, %v", history, err)
+	}
+}
+
+func TestProposeTermsRejectsInvalidTerms(t *testing.T) {
+	ledger := chaincodetest.NewLedger()
+	s := newContract()
+	commodityID := createCommodity(t, ledger, org1Client, palletProperties)
+
+	for name, terms := range map[string]string{
+		"missing currency":  `{"unitPrice":1250,"quantity":40,"incoterm":"FCA","deliveryDate":"2024-06-01"}`,
+		"negative price":    `{"unitPrice":-1,"currency":"EUR","quantity":40,"incoterm":"FCA","deliveryDate":"2024-06-01"}`,
+		"no quantity":       `{"unitPrice":1250,"currency":"EUR","quantity":0,"incoterm":"FCA","deliveryDate":"2024-06-01"}`,
+		"unknown currency":  `{"unitPrice":1250,"currency":"euro","quantity":40,"incoterm":"FCA","deliveryDate":"2024-06-01"}`,
+		"unknown incoterm":  `{"unitPrice":1250,"currency":"EUR","quantity":40,"incoterm":"XYZ","deliveryDate":"2024-06-01"}`,
+		"invalid date":      `{"unitPrice":1250,"currency":"EUR","quantity":40,"incoterm":"FCA","deliveryDate":"June 1st"}`,
+		"fractional amount": `{"unitPrice":12.5,"currency":"EUR","quantity":40,"incoterm":"FCA","deliveryDate":"2024-06-01"}`,
+	} {
+		ctx := ledger.NewTransaction(org1Client).WithTransient("commodity_terms", []byte(terms))
+		_, err := s.ProposeTerms(ctx, commodityID)
+		var invalid *InvalidTransientValueError
+		if !errors.As(err, &invalid) || invalid.Key != "commodity_terms" {
+			t.Errorf("%s: err = %v, want an InvalidTransientValueError for commodity_terms", name, err)
+		}
+	}
+}
@@ -0,0 +1,242 @@
+package main
+
+import (
+	"bytes"
+	"crypto/sha256"
+	"encoding/json"
+	"fmt"
+	"math"
+
+	"github.com/hyperledger/fabric-contract-api-go/contractapi"
+)
+
+// typeTokenBalance is the prefix of TB~currency~orgID, the settlement token balance of a company in public data
+const typeTokenBalance = "TB"
+
+// TokenBalance is the amount of settlement tokens a company holds in one currency, in minor units like CommercialTerms.
+// Balances are public, they are only debited by transactions of their company or by the transfer of a commodity
+// whose agreed terms the company holds. Each balance has a state-based endorsement policy requiring a peer of its company,
+// so no balance changes without the endorsement of its company, e.g. a paid transfer needs the getter's endorsement.
+type TokenBalance struct {
+	ObjectType string `json:"objectType"`
+	OrgID      string `json:"org"`
+	Currency   string `json:"currency"`
+	Amount     int64  `json:"amount"`
+}
+
+// Payment is an amount of settlement tokens paid for a commodity
+type Payment struct {
+	Currency string `json:"currency"`
+	Amount   int64  `json:"amount"`
+}
+
+// InsufficientFundsError is returned when a company does not hold enough tokens for a payment, nothing is debited
+type InsufficientFundsError struct {
+	OrgID    string
+	Currency string
+	Balance  int64
+	Amount   int64
+}
+
+func (e *InsufficientFundsError) Error() string {
+	return fmt.Sprintf("%s holds %d %s tokens, %d are needed", e.OrgID, e.Balance, e.Currency, e.Amount)
+}
+
+// MintTokens creates settlement tokens in the caller's balance.
+// MintTokens can only be called by the orgs granted the token issuer role, see SetOrgRole
+func (s *SmartContract) MintTokens(ctx contractapi.TransactionContextInterface, currency string, amount int64) (*TokenBalance, error) {
+	clientOrgID, err := getClientOrgID(ctx)
+	if err != nil {
+		return nil, err
+	}
+	issuer, err := hasOrgRole(ctx, orgRoleTokenIssuer, clientOrgID)
+	if err != nil {
+		return nil, err
+	}
+	if !issuer {
+		return nil, &AuthorizationError{ClientOrg: clientOrgID, Action: "mint settlement tokens"}
+	}
+
+	err = verifyTokenAmount(currency, amount)
+	if err != nil {
+		return nil, err
+	}
+
+	balance, err := getTokenBalance(ctx, clientOrgID, currency)
+	if err != nil {
+		return nil, err
+	}
+	err = balance.credit(amount)
+	if err != nil {
+		return nil, err
+	}
+	err = putTokenBalance(ctx, balance)
+	if err != nil {
+		return nil, err
+	}
+
+	return balance, nil
+}
+
+// GetTokenBalance returns the settlement tokens a company holds in a currency
+func (s *SmartContract) GetTokenBalance(ctx contractapi.TransactionContextInterface, orgID string, currency string) (*TokenBalance, error) {
+	return getTokenBalance(ctx, orgID, currency)
+}
+
+// TransferTokens moves settlement tokens from the caller's balance to the balance of another company,
+// both companies endorse it as each one's balance changes
+func (s *SmartContract) TransferTokens(ctx contractapi.TransactionContextInterface, recipientOrgID string, currency string, amount int64) error {
+	clientOrgID, err := getClientOrgID(ctx)
+	if err != nil {
+		return err
+	}
+
+	err = verifyTokenAmount(currency, amount)
+	if err != nil {
+		return err
+	}
+
+	return moveTokens(ctx, currency, clientOrgID, recipientOrgID, amount)
+}
+
+// payAgreedPrice debits the getter and credits the putter of a commodity with the price of the terms they agreed on,
+// the transfer then needs the endorsement of both companies.
+// The putter passes its terms by transient field, as the peers of the other endorsers cannot read them, and they
+// are checked against the hash of the terms both companies hold. Transfers without terms are not paid, nil is returned.
+// payAgreedPrice must be called after verifyTransferConditions and before settleTransferAgreement deletes the terms.
+func payAgreedPrice(ctx contractapi.TransactionContextInterface, commodityID string, putterOrgID string, getterOrgID string) (*Payment, error) {
+	termsHash, _, err := getTermsHashes(ctx, commodityID, putterOrgID, getterOrgID)
+	if err != nil {
+		return nil, err
+	}
+	if termsHash == nil {
+		return nil, nil
+	}
+
+	termsJSON, err := getTransientInput(ctx, commodityTermsInput)
+	if err != nil {
+		return nil, err
+	}
+	calculatedTermsHash := sha256.Sum256(termsJSON)
+	if !bytes.Equal(calculatedTermsHash[:], termsHash) {
+		return nil, fmt.Errorf("hash %x for passed terms %s does not match on-chain hash %x of the terms agreed on for %s",
+			calculatedTermsHash, termsJSON, termsHash, commodityID)
+	}
+	terms, err := parseTerms(termsJSON)
+	if err != nil {
+		return nil, err
+	}
+
+	if terms.UnitPrice != 0 && terms.Quantity > math.MaxInt64/terms.UnitPrice {
+		return nil, fmt.Errorf("price of %d x %d %s overflows", terms.Quantity, terms.UnitPrice, terms.Currency)
+	}
+	price := terms.UnitPrice * terms.Quantity
+	if price == 0 {
+		return nil, nil
+	}
+
+	err = moveTokens(ctx, terms.Currency, getterOrgID, putterOrgID, price)
+	if err != nil {
+		return nil, err
+	}
+	return &Payment{Currency: terms.Currency, Amount: price}, nil
+}
+
+// moveTokens debits one company and credits another one, it fails with an InsufficientFundsError before writing anything
+func moveTokens(ctx contractapi.TransactionContextInterface, currency string, fromOrgID string, toOrgID string, amount int64) error {
+	if fromOrgID == toOrgID {
+		return fmt.Errorf("%s cannot transfer tokens to itself", fromOrgID)
+	}
+
+	from, err := getTokenBalance(ctx, fromOrgID, currency)
+	if err != nil {
+		return err
+	}
+	if from.Amount < amount {
+		return &InsufficientFundsError{OrgID: fromOrgID, Currency: currency, Balance: from.Amount, Amount: amount}
+	}
+	to, err := getTokenBalance(ctx, toOrgID, currency)
+	if err != nil {
+		return err
+	}
+
+	from.Amount -= amount
+	err = to.credit(amount)
+	if err != nil {
+		return err
+	}
+
+	err = putTokenBalance(ctx, from)
+	if err != nil {
+		return err
+	}
+	return putTokenBalance(ctx, to)
+}
+
+// credit adds tokens to a balance
+func (balance *TokenBalance) credit(amount int64) error {
+	if balance.Amount > math.MaxInt64-amount {
+		return fmt.Errorf("balance of %s in %s would overflow", balance.OrgID, balance.Currency)
+	}
+	balance.Amount += amount
+	return nil
+}
+
+// verifyTokenAmount checks that an amount of tokens to mint or transfer is positive and that its currency is valid
+func verifyTokenAmount(currency string, amount int64) error {
+	if !currencyPattern.MatchString(currency) {
+		return fmt.Errorf("currency %q must be an ISO 4217 code like EUR", currency)
+	}
+	if amount <= 0 {
+		return fmt.Errorf("amount must be positive, got %d", amount)
+	}
+	return nil
+}
+
+// getTokenBalance returns the balance of a company in a currency, which is empty if the company never held any token
+func getTokenBalance(ctx contractapi.TransactionContextInterface, orgID string, currency string) (*TokenBalance, error) {
+	balanceKey, err := ctx.GetStub().CreateCompositeKey(typeTokenBalance, []string{currency, orgID})
+	if err != nil {
+		return nil, fmt.Errorf("failed to create composite key: %v", err)
+	}
+	balanceJSON, err := ctx.GetStub().GetState(balanceKey)
+	if err != nil {
+		return nil, fmt.Errorf("failed to read from world state: %v", err)
+	}
+
+	balance := &TokenBalance{ObjectType: "TokenBalance", OrgID: orgID, Currency: currency}
+	if balanceJSON == nil {
+		return balance, nil
+	}
+	err = json.Unmarshal(balanceJSON, balance)
+	if err != nil {
+		return nil, err
+	}
+	return balance, nil
+}
+
+// putTokenBalance writes the balance of a company in public data, only a peer of the company can endorse its next update
+func putTokenBalance(ctx contractapi.TransactionContextInterface, balance *TokenBalance) error {
+	balanceKey, err := ctx.GetStub().CreateCompositeKey(typeTokenBalance, []string{balance.Currency, balance.OrgID})
+	if err != nil {
+		return fmt.Errorf("failed to create composite key: %v", err)
+	}
+	balanceJSON, err := json.Marshal(balance)
+	if err != nil {
+		return fmt.Errorf("failed to marshal token balance: %v", err)
+	}
+
+	err = ctx.GetStub().PutState(balanceKey, balanceJSON)
+	if err != nil {
+		return fmt.Errorf("failed to put token balance in public data: %v", err)
+	}
+	ownerPolicy, err := ownerEndorsementPolicy([]string{balance.OrgID})
+	if err != nil {
+		return err
+	}
+	err = ctx.GetStub().SetStateValidationParameter(balanceKey, ownerPolicy)
+	if err != nil {
+		return fmt.Errorf("failed to set validation parameter on token balance: %v", err)
+	}
+	return nil
+}
@@ -0,0 +1,223 @@
+package main
+
+import (
+	"errors"
+	"testing"
+
+	"SupplyChainTrackingChaincode/chaincodetest"
+
+	"github.com/hyperledger/fabric-contract-api-go/contractapi"
+)
+
+// fund mints settlement tokens by the issuer org3 and transfers them to an org
+func fund(t *testing.T, ledger *chaincodetest.Ledger, orgID string, currency string, amount int64) {
+	t.Helper()
+	s := newContract()
+	grantOrgRole(t, ledger, orgRoleTokenIssuer, org3MSP)
+
+	ctx := ledger.NewTransaction(org3Client)
+	if _, err := s.MintTokens(ctx, currency, amount); err != nil {
+		t.Fatalf("MintTokens: %v", err)
+	}
+	if err := ctx.Commit(); err != nil {
+		t.Fatalf("commit MintTokens: %v", err)
+	}
+
+	ctx = ledger.NewTransaction(org3Client).EndorsedBy(org3MSP, orgID)
+	err := ctx.Endorse(func(ctx contractapi.TransactionContextInterface) error {
+		return s.TransferTokens(ctx, orgID, currency, amount)
+	})
+	if err != nil {
+		t.Fatalf("TransferTokens: %v", err)
+	}
+	if err = ctx.Commit(); err != nil {
+		t.Fatalf("commit TransferTokens: %v", err)
+	}
+}
+
+// transferWithTerms transfers a commodity whose terms were agreed on from the putter to the getter org,
+// both orgs endorse the transfer as it pays the price
+func transferWithTerms(ledger *chaincodetest.Ledger, putter chaincodetest.Identity, getterOrg, commodityID string, transferKey []byte, terms string) (*chaincodetest.TransactionContext, error) {
+	ctx := ledger.NewTransaction(putter).
+		WithTransient("commodity_transferKey", transferKey).
+		WithTransient("commodity_terms", []byte(terms)).
+		EndorsedBy(putter.MSPID, getterOrg)
+	err := ctx.Endorse(func(ctx contractapi.TransactionContextInterface) error {
+		return newContract().TransferCommodity(ctx, commodityID, getterOrg)
+	})
+	if err != nil {
+		return ctx, err
+	}
+	return ctx, ctx.Commit()
+}
+
+// balanceOf returns the committed balance of an org
+func balanceOf(t *testing.T, ledger *chaincodetest.Ledger, orgID string, currency string) int64 {
+	t.Helper()
+	balance, err := newContract().GetTokenBalance(ledger.NewTransaction(org1Client), orgID, currency)
+	if err != nil {
+		t.Fatalf("GetTokenBalance: %v", err)
+	}
+	return balance.Amount
+}
+
+// agreeOnTerms lists a commodity of org1 for org2 with the counter-offer as the terms of both
+func agreeOnTerms(t *testing.T, ledger *chaincodetest.Ledger) string {
+	t.Helper()
+	commodityID := createCommodity(t, ledger, org1Client, palletProperties)
+	agree(t, ledger, org1Client, org2Client, commodityID, palletProperties, transferKeyOf(commodityID))
+	proposeTerms(t, ledger, org1Client, commodityID, counterTerms)
+	proposeTerms(t, ledger, org2Client, commodityID, counterTerms)
+	return commodityID
+}
+
+func TestMintAndTransferTokens(t *testing.T) {
+	ledger := chaincodetest.NewLedger()
+	s := newContract()
+	grantOrgRole(t, ledger, orgRoleTokenIssuer, org3MSP)
+
+	var authErr *AuthorizationError
+	if _, err := s.MintTokens(ledger.NewTransaction(org1Client), "EUR", 100); !errors.As(err, &authErr) {
+		t.Errorf("MintTokens by a company that is not an issuer: err = %v, want an AuthorizationError", err)
+	}
+	for _, invalid := range []struct {
+		currency string
+		amount   int64
+	}{{"EUR", 0}, {"EUR", -5}, {"euro", 100}} {
+		if _, err := s.MintTokens(ledger.NewTransaction(org3Client), invalid.currency, invalid.amount); err == nil {
+			t.Errorf("MintTokens(%q, %d) succeeded", invalid.currency, invalid.amount)
+		}
+	}
+
+	fund(t, ledger, org1MSP, "EUR", 500)
+	if balance := balanceOf(t, ledger, org1MSP, "EUR"); balance != 500 {
+		t.Errorf("balance of org1 = %d, want 500", balance)
+	}
+	if balance := balanceOf(t, ledger, org3MSP, "EUR"); balance != 0 {
+		t.Errorf("balance of the issuer = %d, want 0", balance)
+	}
+
+	var insufficient *InsufficientFundsError
+	err := s.TransferTokens(ledger.NewTransaction(org1Client), org2MSP, "EUR", 501)
+	if !errors.As(err, &insufficient) || insufficient.Balance != 500 {
+		t.Errorf("TransferTokens beyond the balance: err = %v, want an InsufficientFundsError", err)
+	}
+	if err = s.TransferTokens(ledger.NewTransaction(org1Client), org2MSP, "USD", 1); !errors.As(err, &insufficient) {
+		t.Errorf("TransferTokens in another currency: err = %v, want an InsufficientFundsError", err)
+	}
+
+	ctx := ledger.NewTransaction(org1Client).EndorsedBy(org1MSP, org2MSP)
+	err = ctx.Endorse(func(ctx contractapi.TransactionContextInterface) error {
+		return s.TransferTokens(ctx, org2MSP, "EUR", 200)
+	})
+	if err != nil {
+		t.Fatalf("TransferTokens: %v", err)
+	}
+	if err = ctx.Commit(); err != nil {
+		t.Fatalf("commit TransferTokens: %v", err)
+	}
+	if balance := balanceOf(t, ledger, org1MSP, "EUR"); balance != 300 {
+		t.Errorf("balance of org1 = %d, want 300", balance)
+	}
+	if balance := balanceOf(t, ledger, org2MSP, "EUR"); balance != 200 {
+		t.Errorf("balance of org2 = %d, want 200", balance)
+	}
+
+	// A company cannot debit the balance of another one on its own
+	ctx = ledger.NewTransaction(org1Client)
+	balance, err := s.GetTokenBalance(ctx, org2MSP, "EUR")
+	if err != nil {
+		t.Fatalf("GetTokenBalance: %v", err)
+	}
+	balance.Amount = 0
+	if err = putTokenBalance(ctx, balance); err != nil {
+		t.Fatalf("putTokenBalance: %v", err)
+	}
+	if err = ctx.Commit(); err == nil {
+		t.Error("balance of org2 updated without its endorsement")
+	}
+}
+
+func TestTransferCommodityPaysAgreedPrice(t *testing.T) {
+	ledger := chaincodetest.NewLedger()
+	commodityID := agreeOnTerms(t, ledger)
+	fund(t, ledger, org2MSP, "EUR", 50000)
+
+	var missing *MissingTransientKeyError
+	if _, err := transfer(ledger, org1Client, org2MSP, commodityID, transferKeyOf(commodityID)); !errors.As(err, &missing) {
+		t.Errorf("TransferCommodity without the terms: err = %v, want a MissingTransientKeyError", err)
+	}
+	if _, err := transferWithTerms(ledger, org1Client, org2MSP, commodityID, transferKeyOf(commodityID), offeredTerms); err == nil {
+		t.Errorf("TransferCommodity with other terms than the agreed ones succeeded")
+	}
+
+	// The getter endorses the debit of its balance
+	ctx := ledger.NewTransaction(org1Client).
+		WithTransient("commodity_transferKey", transferKeyOf(commodityID)).
+		WithTransient("commodity_terms", []byte(counterTerms))
+	if err := newContract().TransferCommodity(ctx, commodityID, org2MSP); err != nil {
+		t.Fatalf("TransferCommodity: %v", err)
+	}
+	if err := ctx.Commit(); err == nil {
+		t.Fatal("paid transfer committed without the endorsement of the getter")
+	}
+
+	if _, err := transferWithTerms(ledger, org1Client, org2MSP, commodityID, transferKeyOf(commodityID), counterTerms); err != nil {
+		t.Fatalf("TransferCommodity: %v", err)
+	}
+	if balance := balanceOf(t, ledger, org1MSP, "EUR"); balance != 44000 {
+		t.Errorf("balance of the putter = %d, want 44000", balance)
+	}
+	if balance := balanceOf(t, ledger, org2MSP, "EUR"); balance != 6000 {
+		t.Errorf("balance of the getter = %d, want 6000", balance)
+	}
+}
+
+func TestTransferCommodityRollsBackOnInsufficientFunds(t *testing.T) {
+	ledger := chaincodetest.NewLedger()
+	commodityID := agreeOnTerms(t, ledger)
+	fund(t, ledger, org2MSP, "EUR", 43999)
+
+	_, err := transferWithTerms(ledger, org1Client, org2MSP, commodityID, transferKeyOf(commodityID), counterTerms)
+	var insufficient *InsufficientFundsError
+	if !errors.As(err, &insufficient) || insufficient.OrgID != org2MSP || insufficient.Amount != 44000 {
+		t.Fatalf("TransferCommodity: err = %v, want an InsufficientFundsError of org2", err)
+	}
+
+	commodity, err := newContract().ReadCommodity(ledger.NewTransaction(org1Client), commodityID)
+	if err != nil || commodity.OwnerOrg != org1MSP || commodity.Status != statusCreated {
+		t.Errorf("commodity after the failed transfer = %+v, %v", commodity, err)
+	}
+	if balance := balanceOf(t, ledger, org2MSP, "EUR"); balance != 43999 {
+		t.Errorf("balance of the getter = %d, want 43999", balance)
+	}
+
+	// The transfer succeeds once the getter holds enough tokens
+	fund(t, ledger, org2MSP, "EUR", 1)
+	if _, err = transferWithTerms(ledger, org1Client, org2MSP, commodityID, transferKeyOf(commodityID), counterTerms); err != nil {
+		t.Fatalf("TransferCommodity: %v", err)
+	}
+}
+
+func TestShipCommodityPaysAgreedPrice(t *testing.T) {
+	ledger := chaincodetest.NewLedger()
+	commodityID := agreeOnTerms(t, ledger)
+	fund(t, ledger, org2MSP, "EUR", 44000)
+
+	ctx := ledger.NewTransaction(org1Client).
+		WithTransient("commodity_transferKey", transferKeyOf(commodityID)).
+		WithTransient("commodity_terms", []byte(counterTerms)).
+		EndorsedBy(org1MSP, org2MSP)
+	err := ctx.Endorse(func(ctx contractapi.TransactionContextInterface) error {
+		return newContract().ShipCommodity(ctx, commodityID, org2MSP)
+	})
+	if err != nil {
+		t.Fatalf("ShipCommodity: %v", err)
+	}
+	if err = ctx.Commit(); err != nil {
+		t.Fatalf("commit ShipCommodity: %v", err)
+	}
+	if balance := balanceOf(t, ledger, org1MSP, "EUR"); balance != 44000 {
+		t.Errorf("balance of the putter = %d, want 44000", balance)
+	}
+}
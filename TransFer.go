@@ -7,9 +7,8 @@ import (
 	"encoding/json"
 	"fmt"
 	"github.com/golang/protobuf/ptypes"
-	"github.com/hyperledger/fabric-chaincode-go/pkg/statebased"
-	"github.com/hyperledger/fabric-chaincode-go/shim"
 	"log"
+	"strings"
 	"time"
 
 	"github.com/hyperledger/fabric-contract-api-go/contractapi"
@@ -20,39 +19,83 @@ const (
 	typeCommodityKey         = "K"
 	typeCommodityPutReceipt  = "PR"
 	typeCommodityGetReceipt  = "GR"
+	typeCommodityDetails     = "D"
 )
 
 type SmartContract struct {
 	contractapi.Contract
+	// PeerIdentity tells which org the peer executing the chaincode belongs to, defaults to EnvPeerIdentity
+	PeerIdentity PeerIdentityProvider
+	// Permissions are the roles allowed to call each function, roles are not checked if nil
+	Permissions PermissionMatrix
 }
 
 // Commodity struct and properties must be exported (start with capitals) to work with contract api metadata
 type Commodity struct {
-	ObjectType          string `json:"objectType"` // ObjectType is used to distinguish different object types in the same chaincode namespace
-	ID                  string `json:"commodityID"`
-	OwnerOrg            string `json:"ownerCompany"`
-	Source              string `json:"source"`
-	Target              string `json:"target"`
-	PublicDescription   string `json:"publicDescription"`
-	DetailedInformation string `json:"detailedInformation"`
+	ObjectType              string    `json:"objectType"` // ObjectType is used to distinguish different object types in the same chaincode namespace
+	ID                      string    `json:"commodityID"`
+	OwnerOrg                string    `json:"ownerCompany"`
+	Source                  string    `json:"source"`
+	Target                  string    `json:"target"` // Target is the final destination of the route
+	Route                   []string  `json:"route"`  // Route is the ordered list of downstream companies the commodity is planned to go through
+	RouteProgress           int       `json:"routeProgress"`
+	PublicDescription       string    `json:"publicDescription"`
+	DetailedInformationHash string    `json:"detailedInformationHash"` // DetailedInformationHash anchors the detailed information kept in private data
+	DetailsSharedWith       []string  `json:"detailsSharedWith"`       // DetailsSharedWith lists the counterparties the owner shared the detailed information with
+	Parents                 []string  `json:"parents"`                 // Parents lists the commodities this commodity was split from
+	Children                []string  `json:"children"`                // Children lists the commodities this commodity was split into
+	Components              []string  `json:"components"`              // Components lists the commodities this commodity was assembled from
+	AssembledInto           string    `json:"assembledInto"`           // AssembledInto is the commodity this commodity is a component of
+	Consumed                bool      `json:"consumed"`                // Consumed is set once the commodity was split or assembled, it can no longer be transferred
+	Endorsers               []string  `json:"endorsers"`               // Endorsers are the third parties that must endorse updates along with the owner
+	EndorsersRequired       int       `json:"endorsersRequired"`       // EndorsersRequired is how many of the endorsers must endorse, 0 for all of them
+	Shipment                *Shipment `json:"shipment"`                // Shipment is set while the commodity is in transit to its next owner
+	Status                  string    `json:"status"`                  // Status is the stored lifecycle status, empty for commodities created before statuses existed
 }
-type receipt struct {
-	transferKey int
-	timestamp   time.Time
+
+// Receipt is kept in both upstream and downstream companies' implicit private data collection as proof of a completed transfer,
+// or of a shipment, whose transferKey is settled when the commodity is shipped
+type Receipt struct {
+	ObjectType  string      `json:"objectType"`
+	CommodityID string      `json:"commodityID"`
+	TxID        string      `json:"txId"`
+	PutterOrg   string      `json:"putterOrg"`
+	GetterOrg   string      `json:"getterOrg"`
+	TransferKey TransferKey `json:"transferKey"`
+	TermsHash   string      `json:"termsHash,omitempty"` // TermsHash is the hash of the commercial terms both companies agreed on, if any
+	Timestamp   time.Time   `json:"timestamp"`
+}
+
+// CommodityExistsError is returned when a commodity with the same id, i.e. with the same properties, was already created
+type CommodityExistsError struct {
+	ID       string
+	OwnerOrg string
+}
+
+func (e *CommodityExistsError) Error() string {
+	return fmt.Sprintf("commodity %s already exists and is owned by %s, add a unique %q member to the commodity properties to create a distinct commodity",
+		e.ID, e.OwnerOrg, commoditySaltMember)
 }
 
 // CreateAsset creates a Commodity, sets it as owned by the client's org and returns its id
 // the id of the commodity corresponds to the hash of the properties of the commodity that are  passed by transient field
+// creating a commodity whose id already exists fails with a CommodityExistsError
+// target is the planned route, a comma separated list of the downstream companies' orgs ending with the final destination
 func (s *SmartContract) CreateAsset(ctx contractapi.TransactionContextInterface, target string, publicDescription string) (string, error) {
-	transientMap, err := ctx.GetStub().GetTransient()
+	return s.createCommodity(ctx, target, publicDescription, nil, 0)
+}
+
+// createCommodity creates a Commodity owned by the client's org whose updates must also be endorsed by the endorsers
+func (s *SmartContract) createCommodity(ctx contractapi.TransactionContextInterface, target string, publicDescription string, endorsers []string, endorsersRequired int) (string, error) {
+	route, err := parseRoute(target)
 	if err != nil {
-		return "", fmt.Errorf("error getting transient: %v", err)
+		return "", err
 	}
 
 	// Commodity properties must be retrieved from the transient field as they are private
-	immutablePropertiesJSON, ok := transientMap["commodity_properties"]
-	if !ok {
-		return "", fmt.Errorf("commodity_properties key not found in the transient map")
+	immutablePropertiesJSON, err := getTransientInput(ctx, commodityPropertiesInput)
+	if err != nil {
+		return "", err
 	}
 
 	// CommodityID will be the hash of the commodity's properties
@@ -67,33 +110,39 @@ func (s *SmartContract) CreateAsset(ctx contractapi.TransactionContextInterface,
 	}
 
 	// In the test, client is only authorized to read/write private data from its own peer, therefore verify client org id matches peer org id.
-	err = verifyClientOrgMatchesPeerOrg(clientOrgID)
+	err = s.verifyClientOrgMatchesPeerOrg(ctx, clientOrgID)
 	if err != nil {
 		return "", err
 	}
 
+	err = verifyCommodityDoesNotExist(ctx, commodityID)
+	if err != nil {
+		return "", err
+	}
+
+	if indexOf(endorsers, clientOrgID) >= 0 {
+		return "", fmt.Errorf("the owner %s always endorses, it cannot be one of the endorsers", clientOrgID)
+	}
+
 	commodity := Commodity{
 		ObjectType:        "Commodity",
 		ID:                commodityID,
 		OwnerOrg:          clientOrgID,
 		Source:            clientOrgID,
-		Target:            target,
+		Target:            routeDestination(route),
+		Route:             route,
 		PublicDescription: publicDescription,
+		Endorsers:         endorsers,
+		EndorsersRequired: endorsersRequired,
+		Status:            statusCreated,
 	}
-	commodityBytes, err := json.Marshal(commodity)
-	if err != nil {
-		return "", fmt.Errorf("failed to create commodity JSON: %v", err)
-	}
-
-	err = ctx.GetStub().PutState(commodityID, commodityBytes)
+	err = putCommodity(ctx, &commodity)
 	if err != nil {
-		return "", fmt.Errorf("failed to put commodity in public data: %v", err)
+		return "", err
 	}
 
-	// Set the endorsement policy such that an owner org peer is required to endorse future updates.
-	// Actually, consider additional endorsers such as a trusted third party to further secure transfers.
-	endorsingOrges := []string{clientOrgID}
-	err = setCommodityStateBasedEndorsement(ctx, commodity.ID, endorsingOrges)
+	// Set the endorsement policy such that an owner org peer, and the third party endorsers if any, are required to endorse future updates.
+	err = setCommodityStateBasedEndorsement(ctx, &commodity)
 	if err != nil {
 		return "", fmt.Errorf("failed setting state based endorsement for upstream and downstream companies: %v", err)
 	}
@@ -105,6 +154,11 @@ func (s *SmartContract) CreateAsset(ctx contractapi.TransactionContextInterface,
 		return "", fmt.Errorf("failed to put Commodity private details: %v", err)
 	}
 
+	err = setCommodityEvent(ctx, eventCommodityCreated, CommodityEvent{CommodityID: commodityID, OwnerOrg: clientOrgID})
+	if err != nil {
+		return "", err
+	}
+
 	return commodityID, nil
 }
 
@@ -123,16 +177,21 @@ func (s *SmartContract) ChangePublicDescription(ctx contractapi.TransactionConte
 
 	// Auth check to ensure that client's org actually owns the commodity
 	if clientOrgID != commodity.OwnerOrg {
-		return fmt.Errorf("a client from %s cannot update the description of a commodity owned by %s", clientOrgID, commodity.OwnerOrg)
+		return &AuthorizationError{ClientOrg: clientOrgID, Action: fmt.Sprintf("update the description of a commodity owned by %s", commodity.OwnerOrg)}
+	}
+
+	err = verifyStatus(ctx, commodity, "change its description", activeStatuses...)
+	if err != nil {
+		return err
 	}
 
 	commodity.PublicDescription = newDescription
-	updatedAssetJSON, err := json.Marshal(commodity)
+	err = putCommodity(ctx, commodity)
 	if err != nil {
-		return fmt.Errorf("failed to marshal commodity: %v", err)
+		return err
 	}
 
-	return ctx.GetStub().PutState(commodityID, updatedAssetJSON)
+	return setCommodityEvent(ctx, eventDescriptionChanged, CommodityEvent{CommodityID: commodityID, OwnerOrg: clientOrgID})
 }
 
 // AgreeToPut adds upstream company's TransferKey and Commodity its implicit private data collection.
@@ -148,41 +207,56 @@ func (s *SmartContract) AgreeToPut(ctx contractapi.TransactionContextInterface,
 	}
 
 	// Verify that this client belongs to the peer's org
-	err = verifyClientOrgMatchesPeerOrg(clientOrgID)
+	err = s.verifyClientOrgMatchesPeerOrg(ctx, clientOrgID)
 	if err != nil {
 		return err
 	}
 
 	// Verify that this clientOrgId actually owns the commodity.
 	if clientOrgID != asset.OwnerOrg {
-		return fmt.Errorf("a client from %s cannot update a commodity owned by %s", clientOrgID, asset.OwnerOrg)
+		return &AuthorizationError{ClientOrg: clientOrgID, Action: fmt.Sprintf("update a commodity owned by %s", asset.OwnerOrg)}
 	}
 
-	return agreeToTransfer(ctx, commodityID, typeCommodityForTransfer)
-}
+	// The commodity is Listed as long as the transferKey exists, its public record is not updated
+	err = verifyTransition(ctx, asset, statusListed)
+	if err != nil {
+		return err
+	}
 
-// AgreeToGet adds downstream company's transferKey and Commodity to its implicit private data collection
-func (s *SmartContract) AgreeToGet(ctx contractapi.TransactionContextInterface, CommodityID string) error {
-	transientMap, err := ctx.GetStub().GetTransient()
+	err = agreeToTransfer(ctx, commodityID, typeCommodityForTransfer, asset.OwnerOrg)
 	if err != nil {
-		return fmt.Errorf("error getting transient: %v", err)
+		return err
 	}
 
+	return setCommodityEvent(ctx, eventTransferProposed, CommodityEvent{CommodityID: commodityID, OwnerOrg: asset.OwnerOrg, PutterOrg: clientOrgID})
+}
+
+// AgreeToGet adds downstream company's transferKey and Commodity to its implicit private data collection
+func (s *SmartContract) AgreeToGet(ctx contractapi.TransactionContextInterface, CommodityID string) error {
 	clientOrgID, err := getClientOrgID(ctx)
 	if err != nil {
 		return err
 	}
 
 	// Verify that this client belongs to the peer's org
-	err = verifyClientOrgMatchesPeerOrg(clientOrgID)
+	err = s.verifyClientOrgMatchesPeerOrg(ctx, clientOrgID)
 	if err != nil {
 		return err
 	}
 
 	// Commodity properties must be retrieved from the transient field as they are private
-	immutablePropertiesJSON, ok := transientMap["Commodity_properties"]
-	if !ok {
-		return fmt.Errorf("commodity_properties key not found in the transient map")
+	immutablePropertiesJSON, err := getTransientInput(ctx, commodityPropertiesInput)
+	if err != nil {
+		return err
+	}
+
+	commodity, err := s.ReadCommodity(ctx, CommodityID)
+	if err != nil {
+		return fmt.Errorf("failed to get commodity: %v", err)
+	}
+	err = verifyStatus(ctx, commodity, "be agreed to get", activeStatuses...)
+	if err != nil {
+		return err
 	}
 
 	// Persist private immutable asset properties to seller's private data collection
@@ -192,26 +266,50 @@ func (s *SmartContract) AgreeToGet(ctx contractapi.TransactionContextInterface,
 		return fmt.Errorf("failed to put Asset private details: %v", err)
 	}
 
-	return agreeToTransfer(ctx, CommodityID, typeCommodityKey)
+	err = agreeToTransfer(ctx, CommodityID, typeCommodityKey, commodity.OwnerOrg)
+	if err != nil {
+		return err
+	}
+
+	return setCommodityEvent(ctx, eventTransferAccepted, CommodityEvent{CommodityID: CommodityID, GetterOrg: clientOrgID})
 }
 
-// agreeToTransfer adds a transferKey to caller's implicit private data collection
-func agreeToTransfer(ctx contractapi.TransactionContextInterface, commodityID string, transferType string) error {
+// agreeToTransfer adds a transferKey to caller's implicit private data collection.
+// The agreement must name the owner as its putter and, for a Getting, the caller as its getter, so that the record
+// of each side tells its counterparty.
+func agreeToTransfer(ctx contractapi.TransactionContextInterface, commodityID string, transferType string, ownerOrgID string) error {
 	// In this scenario, both Upstream and downstream companies are authored to read/write private about transfer after Upstream agrees to put.
 	clientOrgID, err := getClientOrgID(ctx)
 	if err != nil {
 		return err
 	}
 
-	transMap, err := ctx.GetStub().GetTransient()
+	// Asset transferKey must be retrieved from the transient field as they are private
+	transferKey, err := getTransientInput(ctx, commodityTransferKeyInput)
 	if err != nil {
-		return fmt.Errorf("error getting transient: %v", err)
+		return err
 	}
 
-	// Asset transferKey must be retrieved from the transient field as they are private
-	transferKey, ok := transMap["commodity_transferKey"]
-	if !ok {
-		return fmt.Errorf("commodity_transferKey not found in the transient map")
+	// The agreement is checked before it is stored, as it is only read again at transfer time
+	agreement, err := parseNewAgreement(transferKey, commodityID)
+	if err != nil {
+		return err
+	}
+
+	txTime, err := getTxTime(ctx)
+	if err != nil {
+		return err
+	}
+	if agreement.expiredAt(txTime) {
+		return fmt.Errorf("agreement on the transfer of %s already expired at %s", commodityID, agreement.Expires)
+	}
+	if agreement.PutterOrg != ownerOrgID {
+		return &InvalidTransientValueError{Key: commodityTransferKeyInput.key,
+			Reason: fmt.Sprintf("agreement names %s as putter, the commodity is owned by %s", agreement.PutterOrg, ownerOrgID)}
+	}
+	if transferType == typeCommodityKey && agreement.GetterOrg != clientOrgID {
+		return &InvalidTransientValueError{Key: commodityTransferKeyInput.key,
+			Reason: fmt.Sprintf("agreement names %s as getter, not %s", agreement.GetterOrg, clientOrgID)}
 	}
 
 	collection := buildCollectionName(clientOrgID)
@@ -233,19 +331,148 @@ func agreeToTransfer(ctx contractapi.TransactionContextInterface, commodityID st
 	return nil
 }
 
+// CancelPutAgreement removes upstream company's transferKey of a commodity from its implicit private data collection
+func (s *SmartContract) CancelPutAgreement(ctx contractapi.TransactionContextInterface, commodityID string) error {
+	return s.cancelAgreement(ctx, commodityID, typeCommodityForTransfer)
+}
+
+// CancelGetAgreement removes downstream company's transferKey of a commodity, and the commodity properties it received,
+// from its implicit private data collection
+func (s *SmartContract) CancelGetAgreement(ctx contractapi.TransactionContextInterface, commodityID string) error {
+	return s.cancelAgreement(ctx, commodityID, typeCommodityKey)
+}
+
+// cancelAgreement deletes an existing transferKey of the given type from caller's implicit private data collection
+func (s *SmartContract) cancelAgreement(ctx contractapi.TransactionContextInterface, commodityID string, agreementType string) error {
+	collection, err := s.getClientImplicitCollectionNameAndVerifyClientOrg(ctx)
+	if err != nil {
+		return err
+	}
+
+	agreementKey, err := ctx.GetStub().CreateCompositeKey(agreementType, []string{commodityID})
+	if err != nil {
+		return fmt.Errorf("failed to create composite key: %v", err)
+	}
+	agreementJSON, err := ctx.GetStub().GetPrivateData(collection, agreementKey)
+	if err != nil {
+		return fmt.Errorf("failed to read agreement from implicit private data collection: %v", err)
+	}
+	if agreementJSON == nil {
+		return fmt.Errorf("agreement on the transfer of %s does not exist", commodityID)
+	}
+
+	return deleteAgreement(ctx, collection, commodityID, agreementType)
+}
+
+// PurgeExpiredAgreements deletes all of an organization's expired transferKeys from its implicit private data collection
+// and returns the ids of their commodities. The agreements themselves are not returned, as the response of a transaction
+// is recorded in the block for every channel member to read.
+func (s *SmartContract) PurgeExpiredAgreements(ctx contractapi.TransactionContextInterface) ([]string, error) {
+	collection, err := s.getClientImplicitCollectionNameAndVerifyClientOrg(ctx)
+	if err != nil {
+		return nil, err
+	}
+
+	txTime, err := getTxTime(ctx)
+	if err != nil {
+		return nil, err
+	}
+
+	purgedIDs := []string{}
+	for _, agreementType := range []string{typeCommodityForTransfer, typeCommodityKey} {
+		// Query for any object type starting with `agreementType`
+		agreementsIterator, err := ctx.GetStub().GetPrivateDataByPartialCompositeKey(collection, agreementType, []string{})
+		if err != nil {
+			return nil, fmt.Errorf("failed to read from private data collection: %v", err)
+		}
+
+		// Collect the expired agreements first, the iterator is closed before deleting them
+		var expiredIDs []string
+		for agreementsIterator.HasNext() {
+			resp, err := agreementsIterator.Next()
+			if err != nil {
+				agreementsIterator.Close()
+				return nil, err
+			}
+
+			var agreement Agreement
+			err = json.Unmarshal(resp.Value, &agreement)
+			if err != nil {
+				agreementsIterator.Close()
+				return nil, err
+			}
+			if !agreement.expiredAt(txTime) {
+				continue
+			}
+
+			_, keyParts, err := ctx.GetStub().SplitCompositeKey(resp.Key)
+			if err != nil {
+				agreementsIterator.Close()
+				return nil, fmt.Errorf("failed to split composite key: %v", err)
+			}
+			expiredIDs = append(expiredIDs, keyParts[0])
+		}
+		agreementsIterator.Close()
+
+		for _, commodityID := range expiredIDs {
+			err = deleteAgreement(ctx, collection, commodityID, agreementType)
+			if err != nil {
+				return nil, err
+			}
+			purgedIDs = append(purgedIDs, commodityID)
+		}
+	}
+
+	return purgedIDs, nil
+}
+
+// deleteAgreement deletes a transferKey from an implicit private data collection.
+// A downstream company's copy of the commodity properties is deleted as well, unless it owns the commodity.
+func deleteAgreement(ctx contractapi.TransactionContextInterface, collection string, commodityID string, agreementType string) error {
+	agreementKey, err := ctx.GetStub().CreateCompositeKey(agreementType, []string{commodityID})
+	if err != nil {
+		return fmt.Errorf("failed to create composite key: %v", err)
+	}
+	err = ctx.GetStub().DelPrivateData(collection, agreementKey)
+	if err != nil {
+		return fmt.Errorf("failed to delete transferKey: %v", err)
+	}
+
+	if agreementType != typeCommodityKey {
+		return nil
+	}
+
+	commodityJSON, err := ctx.GetStub().GetState(commodityID)
+	if err != nil {
+		return fmt.Errorf("failed to read from world state: %v", err)
+	}
+	if commodityJSON != nil {
+		var commodity Commodity
+		err = json.Unmarshal(commodityJSON, &commodity)
+		if err != nil {
+			return err
+		}
+		if buildCollectionName(commodity.OwnerOrg) == collection {
+			return nil
+		}
+	}
+
+	err = ctx.GetStub().DelPrivateData(collection, commodityID)
+	if err != nil {
+		return fmt.Errorf("failed to delete commodity private details: %v", err)
+	}
+
+	return nil
+}
+
 // VerifyCommodityProperties allows an upstream company to validate the properties of
 // a commodity they intend to get from the owner's implicit private data collection
 // and verifies that the commodity properties never changed from the origin of the commodity by checking their hash against the commodityID
 func (s *SmartContract) VerifyCommodityProperties(ctx contractapi.TransactionContextInterface, commodityID string) (bool, error) {
-	transMap, err := ctx.GetStub().GetTransient()
-	if err != nil {
-		return false, fmt.Errorf("error getting transient: %v", err)
-	}
-
 	// Commodity properties must be retrieved from the transient field as they are private
-	immutablePropertiesJSON, ok := transMap["Commodity_properties"]
-	if !ok {
-		return false, fmt.Errorf("commodity_properties key not found in the transient map")
+	immutablePropertiesJSON, err := getTransientInput(ctx, commodityPropertiesInput)
+	if err != nil {
+		return false, err
 	}
 
 	commodity, err := s.ReadCommodity(ctx, commodityID)
@@ -253,13 +480,24 @@ func (s *SmartContract) VerifyCommodityProperties(ctx contractapi.TransactionCon
 		return false, fmt.Errorf("failed to get commodity: %v", err)
 	}
 
+	err = verifyCommodityProperties(ctx, commodity, immutablePropertiesJSON)
+	if err != nil {
+		return false, err
+	}
+
+	return true, nil
+}
+
+// verifyCommodityProperties checks properties against the hash of the ones in the owner's implicit private data collection
+// and against the commodityID, which tells that they never changed from the origin of the commodity
+func verifyCommodityProperties(ctx contractapi.TransactionContextInterface, commodity *Commodity, immutablePropertiesJSON []byte) error {
 	collectionOwner := buildCollectionName(commodity.OwnerOrg)
-	immutablePropertiesOnChainHash, err := ctx.GetStub().GetPrivateDataHash(collectionOwner, commodityID)
+	immutablePropertiesOnChainHash, err := ctx.GetStub().GetPrivateDataHash(collectionOwner, commodity.ID)
 	if err != nil {
-		return false, fmt.Errorf("failed to read commodity private properties hash from upstream company's collection: %v", err)
+		return fmt.Errorf("failed to read commodity private properties hash from upstream company's collection: %v", err)
 	}
 	if immutablePropertiesOnChainHash == nil {
-		return false, fmt.Errorf("commodity private properties hash does not exist: %s", commodityID)
+		return fmt.Errorf("commodity private properties hash does not exist: %s", commodity.ID)
 	}
 
 	hash := sha256.New()
@@ -268,7 +506,7 @@ func (s *SmartContract) VerifyCommodityProperties(ctx contractapi.TransactionCon
 
 	// verify that the hash of the passed immutable properties matches the on-chain hash
 	if !bytes.Equal(immutablePropertiesOnChainHash, calculatedPropertiesHash) {
-		return false, fmt.Errorf("hash %x for passed immutable properties %s does not match on-chain hash %x",
+		return fmt.Errorf("hash %x for passed immutable properties %s does not match on-chain hash %x",
 			calculatedPropertiesHash,
 			immutablePropertiesJSON,
 			immutablePropertiesOnChainHash,
@@ -276,18 +514,20 @@ func (s *SmartContract) VerifyCommodityProperties(ctx contractapi.TransactionCon
 	}
 
 	// verify that the hash of the passed immutable properties and on chain hash matches the commodityID
-	if !(hex.EncodeToString(immutablePropertiesOnChainHash) == commodityID) {
-		return false, fmt.Errorf("hash %x for passed immutable properties %s does match on-chain hash %x but do not match commodityID %s: commodity was altered from its initial form",
+	if !(hex.EncodeToString(immutablePropertiesOnChainHash) == commodity.ID) {
+		return fmt.Errorf("hash %x for passed immutable properties %s does match on-chain hash %x but do not match commodityID %s: commodity was altered from its initial form",
 			calculatedPropertiesHash,
 			immutablePropertiesJSON,
 			immutablePropertiesOnChainHash,
-			commodityID)
+			commodity.ID)
 	}
 
-	return true, nil
+	return nil
 }
 
 // TransferCommodity checks transfer conditions and then transfers commodity state to buyer.
+// If both companies agreed on terms, the buyer pays their price in settlement tokens in the same transaction,
+// the owner passes the terms by transient field.
 // TransferCommodity can only be called by current owner
 func (s *SmartContract) TransferCommodity(ctx contractapi.TransactionContextInterface, commodityID string, downStreamOrgID string) error {
 	clientOrgID, err := getClientOrgID(ctx)
@@ -295,20 +535,14 @@ func (s *SmartContract) TransferCommodity(ctx contractapi.TransactionContextInte
 		return err
 	}
 
-	transMap, err := ctx.GetStub().GetTransient()
+	transferKeyJSON, err := getTransientInput(ctx, commodityTransferKeyInput)
 	if err != nil {
-		return fmt.Errorf("error getting transient data: %v", err)
-	}
-
-	transferKeyJSON, ok := transMap["Commodity_transferKey"]
-	if !ok {
-		return fmt.Errorf("commodity_transferKey key not found in the transient map")
+		return err
 	}
 
-	var agreement Agreement
-	err = json.Unmarshal(transferKeyJSON, &agreement)
+	agreement, err := parseAgreement(transferKeyJSON, commodityID)
 	if err != nil {
-		return fmt.Errorf("failed to unmarshal price JSON: %v", err)
+		return err
 	}
 
 	commodity, err := s.ReadCommodity(ctx, commodityID)
@@ -318,7 +552,17 @@ func (s *SmartContract) TransferCommodity(ctx contractapi.TransactionContextInte
 
 	err = verifyTransferConditions(ctx, commodity, clientOrgID, downStreamOrgID, transferKeyJSON)
 	if err != nil {
-		return fmt.Errorf("failed transfer verification: %v", err)
+		return fmt.Errorf("failed transfer verification: %w", err)
+	}
+
+	err = transitionStatus(ctx, commodity, statusDelivered)
+	if err != nil {
+		return err
+	}
+
+	_, err = payAgreedPrice(ctx, commodityID, clientOrgID, downStreamOrgID)
+	if err != nil {
+		return fmt.Errorf("failed payment of the agreed price: %w", err)
 	}
 
 	err = transferCommodityState(ctx, commodity, clientOrgID, downStreamOrgID, agreement.TransferKey)
@@ -326,7 +570,12 @@ func (s *SmartContract) TransferCommodity(ctx contractapi.TransactionContextInte
 		return fmt.Errorf("failed commodity transfer: %v", err)
 	}
 
-	return nil
+	return setCommodityEvent(ctx, eventCommodityTransferred, CommodityEvent{
+		CommodityID: commodityID,
+		OwnerOrg:    commodity.OwnerOrg,
+		PutterOrg:   clientOrgID,
+		GetterOrg:   downStreamOrgID,
+	})
 
 }
 
@@ -340,10 +589,27 @@ func verifyTransferConditions(ctx contractapi.TransactionContextInterface,
 	// CHECK1: Auth check to ensure that client's org actually owns the commodity
 
 	if clientOrgID != commodity.OwnerOrg {
-		return fmt.Errorf("a client from %s cannot transfer a commodity owned by %s", clientOrgID, commodity.OwnerOrg)
+		return &AuthorizationError{ClientOrg: clientOrgID, Action: fmt.Sprintf("transfer a commodity owned by %s", commodity.OwnerOrg)}
+	}
+
+	// CHECK2: Verify that the commodity is neither consumed, in transit, recalled nor destroyed, that the downstream company
+	// is the next stop of its planned route and that it is not one of the endorsers. The agreement that lists the commodity
+	// is verified by CHECK4.
+
+	err := verifyStatus(ctx, commodity, "be transferred", activeStatuses...)
+	if err != nil {
+		return err
+	}
+	err = verifyRoute(commodity, upstreamOrgID)
+	if err != nil {
+		return err
+	}
+	if indexOf(commodity.Endorsers, upstreamOrgID) >= 0 {
+		return fmt.Errorf("%s is one of the endorsers of commodity %s and the owner always endorses, change the endorsers before the transfer",
+			upstreamOrgID, commodity.ID)
 	}
 
-	// CHECK2: Verify that upstream and downstream companies on-chain commodity definition hash matches
+	// CHECK3: Verify that upstream and downstream companies on-chain commodity definition hash matches
 
 	collectionPutter := buildCollectionName(clientOrgID)
 	collectionGetter := buildCollectionName(upstreamOrgID)
@@ -370,7 +636,7 @@ func verifyTransferConditions(ctx contractapi.TransactionContextInterface,
 		)
 	}
 
-	// CHECK3: Verify that upstream and downstream companies have the same transferKey
+	// CHECK4: Verify that upstream and downstream companies have the same transferKey, that it has not expired and that it is between them
 
 	// Get upstream company's transferKay
 	commodityForPutKey, err := ctx.GetStub().CreateCompositeKey(typeCommodityForTransfer, []string{commodity.ID})
@@ -420,30 +686,63 @@ func verifyTransferConditions(ctx contractapi.TransactionContextInterface,
 		)
 	}
 
-	return nil
+	// As both hashes match, the expiry both companies agreed on is the one of the passed key
+	agreement, err := parseAgreement(transferKayJSON, commodity.ID)
+	if err != nil {
+		return err
+	}
+	txTime, err := getTxTime(ctx)
+	if err != nil {
+		return err
+	}
+	if agreement.expiredAt(txTime) {
+		return fmt.Errorf("agreement on the transfer of %s expired at %s", commodity.ID, agreement.Expires)
+	}
+	// Agreements before version 3 do not name the companies of the transfer
+	if agreement.PutterOrg != "" && (agreement.PutterOrg != clientOrgID || agreement.GetterOrg != upstreamOrgID) {
+		return fmt.Errorf("agreement on the transfer of %s is between %s and %s, not %s and %s",
+			commodity.ID, agreement.PutterOrg, agreement.GetterOrg, clientOrgID, upstreamOrgID)
+	}
+
+	// CHECK5: Verify that upstream and downstream companies hold the same commercial terms, if they negotiated any
+
+	return verifyTermsMatch(ctx, commodity.ID, clientOrgID, upstreamOrgID)
 }
 
 // transferCommodityState performs the public and private state updates for the transferred commodity
 // changes the endorsement for the transferred commodity sbe to the new owner org
 // save the old owner as source
-func transferCommodityState(ctx contractapi.TransactionContextInterface, commodity *Commodity, clientOrgID string, upstreamOrgID string, transferKey int) error {
+func transferCommodityState(ctx contractapi.TransactionContextInterface, commodity *Commodity, clientOrgID string, upstreamOrgID string, transferKey TransferKey) error {
+	err := handOverCommodity(ctx, commodity, clientOrgID, upstreamOrgID)
+	if err != nil {
+		return err
+	}
+
+	return settleTransferAgreement(ctx, commodity.ID, clientOrgID, upstreamOrgID, transferKey)
+}
+
+// handOverCommodity makes the downstream company the owner of the commodity in public state and deletes the commodity
+// properties and detailed information from the upstream company's collection
+func handOverCommodity(ctx contractapi.TransactionContextInterface, commodity *Commodity, clientOrgID string, upstreamOrgID string) error {
 
-	// Update ownership and source in public state
+	// Update ownership, source and progress along the route in public state
 	commodity.Source = commodity.OwnerOrg
 	commodity.OwnerOrg = upstreamOrgID
-
-	updatedCommodity, err := json.Marshal(commodity)
-	if err != nil {
-		return err
+	if commodity.nextRouteOrg() == upstreamOrgID {
+		commodity.RouteProgress++
 	}
-	err = ctx.GetStub().PutState(commodity.ID, updatedCommodity)
+
+	// The detailed information belongs to the upstream company, the downstream company sets and shares its own
+	commodity.DetailedInformationHash = ""
+	commodity.DetailsSharedWith = nil
+
+	err := putCommodity(ctx, commodity)
 	if err != nil {
 		return fmt.Errorf("failed to write commodity for upstream: %v", err)
 	}
 
-	// Changes the endorsement policy to the new owner org
-	endorsingOrges := []string{upstreamOrgID}
-	err = setCommodityStateBasedEndorsement(ctx, commodity.ID, endorsingOrges)
+	// Changes the endorsement policy to the new owner org, the third party endorsers are kept
+	err = setCommodityStateBasedEndorsement(ctx, commodity)
 	if err != nil {
 		return fmt.Errorf("failed setting state based endorsement for new owner: %v", err)
 	}
@@ -454,9 +753,24 @@ func transferCommodityState(ctx contractapi.TransactionContextInterface, commodi
 	if err != nil {
 		return fmt.Errorf("failed to delete commodity private details from upstream: %v", err)
 	}
+	detailsKey, err := ctx.GetStub().CreateCompositeKey(typeCommodityDetails, []string{commodity.ID})
+	if err != nil {
+		return fmt.Errorf("failed to create composite key: %v", err)
+	}
+	err = ctx.GetStub().DelPrivateData(collectionPutter, detailsKey)
+	if err != nil {
+		return fmt.Errorf("failed to delete detailed information from upstream: %v", err)
+	}
+
+	return nil
+}
+
+// settleTransferAgreement deletes the transferKey records of both companies and keeps a receipt of the agreed transfer in their collections
+func settleTransferAgreement(ctx contractapi.TransactionContextInterface, commodityID string, clientOrgID string, upstreamOrgID string, transferKey TransferKey) error {
 
 	// Delete the transferKey records for upstream
-	commodityTransferKey, err := ctx.GetStub().CreateCompositeKey(typeCommodityForTransfer, []string{commodity.ID})
+	collectionPutter := buildCollectionName(clientOrgID)
+	commodityTransferKey, err := ctx.GetStub().CreateCompositeKey(typeCommodityForTransfer, []string{commodityID})
 	if err != nil {
 		return fmt.Errorf("failed to create composite key for upstream: %v", err)
 	}
@@ -467,7 +781,7 @@ func transferCommodityState(ctx contractapi.TransactionContextInterface, commodi
 
 	// Delete the transferKey records for Getter
 	collectionGetter := buildCollectionName(upstreamOrgID)
-	commodityTransferKey, err = ctx.GetStub().CreateCompositeKey(typeCommodityKey, []string{commodity.ID})
+	commodityTransferKey, err = ctx.GetStub().CreateCompositeKey(typeCommodityKey, []string{commodityID})
 	if err != nil {
 		return fmt.Errorf("failed to create composite key for Getter: %v", err)
 	}
@@ -476,42 +790,57 @@ func transferCommodityState(ctx contractapi.TransactionContextInterface, commodi
 		return fmt.Errorf("failed to delete commodity transferKey from implicit private data collection for Getter: %v", err)
 	}
 
+	// The terms are settled as well, their history is kept
+	termsHash, _, err := getTermsHashes(ctx, commodityID, clientOrgID, upstreamOrgID)
+	if err != nil {
+		return err
+	}
+	for _, collection := range []string{collectionPutter, collectionGetter} {
+		err = deleteTerms(ctx, collection, commodityID)
+		if err != nil {
+			return err
+		}
+	}
+
 	// Keep record for a 'receipt' in both upstream and downstream companies' private data collection to record the sale transferKey and date.
 	// Persist the agreed to transferKey in a collection sub-namespace based on receipt key prefix.
-	receiptGetKey, err := ctx.GetStub().CreateCompositeKey(typeCommodityGetReceipt, []string{commodity.ID, ctx.GetStub().GetTxID()})
+	txID := ctx.GetStub().GetTxID()
+	receiptGetKey, err := ctx.GetStub().CreateCompositeKey(typeCommodityGetReceipt, []string{commodityID, txID})
 	if err != nil {
 		return fmt.Errorf("failed to create composite key for receipt: %v", err)
 	}
 
-	txTimestamp, err := ctx.GetStub().GetTxTimestamp()
+	timestamp, err := getTxTime(ctx)
 	if err != nil {
 		return fmt.Errorf("failed to create timestamp for receipt: %v", err)
 	}
-
-	timestamp, err := ptypes.Timestamp(txTimestamp)
-	if err != nil {
-		return err
-	}
-	commodityReceipt := receipt{
-		transferKey: transferKey,
-		timestamp:   timestamp,
-	}
-	receipt, err := json.Marshal(commodityReceipt)
+	commodityReceipt := Receipt{
+		ObjectType:  "Receipt",
+		CommodityID: commodityID,
+		TxID:        txID,
+		PutterOrg:   clientOrgID,
+		GetterOrg:   upstreamOrgID,
+		TransferKey: transferKey,
+		TermsHash:   hex.EncodeToString(termsHash),
+		Timestamp:   timestamp,
+	}
+	receiptJSON, err := json.Marshal(commodityReceipt)
 	if err != nil {
 		return fmt.Errorf("failed to marshal receipt: %v", err)
 	}
 
-	err = ctx.GetStub().PutPrivateData(collectionGetter, receiptGetKey, receipt)
+	err = ctx.GetStub().PutPrivateData(collectionGetter, receiptGetKey, receiptJSON)
 	if err != nil {
 		return fmt.Errorf("failed to put private commodity receipt for Getter: %v", err)
 	}
 
-	receiptPutKey, err := ctx.GetStub().CreateCompositeKey(typeCommodityPutReceipt, []string{ctx.GetStub().GetTxID(), commodity.ID})
+	// Both receipt keys are built from commodityID and txID in the same order, so that they can be looked up alike
+	receiptPutKey, err := ctx.GetStub().CreateCompositeKey(typeCommodityPutReceipt, []string{commodityID, txID})
 	if err != nil {
 		return fmt.Errorf("failed to create composite key for receipt: %v", err)
 	}
 
-	err = ctx.GetStub().PutPrivateData(collectionPutter, receiptPutKey, receipt)
+	err = ctx.GetStub().PutPrivateData(collectionPutter, receiptPutKey, receiptJSON)
 	if err != nil {
 		return fmt.Errorf("failed to put private commodity receipt for Putter: %v", err)
 	}
@@ -519,6 +848,73 @@ func transferCommodityState(ctx contractapi.TransactionContextInterface, commodi
 	return nil
 }
 
+// verifyCommodityDoesNotExist fails with a CommodityExistsError if a commodity was already created with that id.
+// An existing commodity is never overwritten, its owner, source and endorsement policy must be kept.
+func verifyCommodityDoesNotExist(ctx contractapi.TransactionContextInterface, commodityID string) error {
+	existingCommodityJSON, err := ctx.GetStub().GetState(commodityID)
+	if err != nil {
+		return fmt.Errorf("failed to read from world state: %v", err)
+	}
+	if existingCommodityJSON == nil {
+		return nil
+	}
+
+	var existing Commodity
+	err = json.Unmarshal(existingCommodityJSON, &existing)
+	if err != nil {
+		return err
+	}
+	return &CommodityExistsError{ID: commodityID, OwnerOrg: existing.OwnerOrg}
+}
+
+// verifyNotConsumed checks that a commodity was neither split into other commodities nor assembled into another commodity
+func verifyNotConsumed(commodity *Commodity) error {
+	if !commodity.Consumed {
+		return nil
+	}
+	if commodity.AssembledInto != "" {
+		return fmt.Errorf("commodity %s was consumed, it was assembled into %s", commodity.ID, commodity.AssembledInto)
+	}
+	return fmt.Errorf("commodity %s was consumed, it was split into %s", commodity.ID, strings.Join(commodity.Children, ", "))
+}
+
+// putCommodity writes the public data of a commodity and updates its owner and source indexes
+func putCommodity(ctx contractapi.TransactionContextInterface, commodity *Commodity) error {
+	previousJSON, err := ctx.GetStub().GetState(commodity.ID)
+	if err != nil {
+		return fmt.Errorf("failed to read from world state: %v", err)
+	}
+	var previous *Commodity
+	if previousJSON != nil {
+		err = json.Unmarshal(previousJSON, &previous)
+		if err != nil {
+			return err
+		}
+	}
+
+	commodityJSON, err := json.Marshal(commodity)
+	if err != nil {
+		return fmt.Errorf("failed to marshal commodity: %v", err)
+	}
+
+	err = ctx.GetStub().PutState(commodity.ID, commodityJSON)
+	if err != nil {
+		return fmt.Errorf("failed to put commodity in public data: %v", err)
+	}
+
+	return updateCommodityIndexes(ctx, previous, commodity)
+}
+
+// getTxTime gets the timestamp of the transaction, which is the same on every endorsing peer
+func getTxTime(ctx contractapi.TransactionContextInterface) (time.Time, error) {
+	txTimestamp, err := ctx.GetStub().GetTxTimestamp()
+	if err != nil {
+		return time.Time{}, fmt.Errorf("failed to get transaction timestamp: %v", err)
+	}
+
+	return ptypes.Timestamp(txTimestamp)
+}
+
 // getClientOrgID gets the client org ID.
 func getClientOrgID(ctx contractapi.TransactionContextInterface) (string, error) {
 	clientOrgID, err := ctx.GetClientIdentity().GetMSPID()
@@ -530,13 +926,13 @@ func getClientOrgID(ctx contractapi.TransactionContextInterface) (string, error)
 }
 
 // getClientImplicitCollectionNameAndVerifyClientOrg gets the implicit collection for the client and checks that the client is from the same org as the peer
-func getClientImplicitCollectionNameAndVerifyClientOrg(ctx contractapi.TransactionContextInterface) (string, error) {
+func (s *SmartContract) getClientImplicitCollectionNameAndVerifyClientOrg(ctx contractapi.TransactionContextInterface) (string, error) {
 	clientOrgID, err := getClientOrgID(ctx)
 	if err != nil {
 		return "", err
 	}
 
-	err = verifyClientOrgMatchesPeerOrg(clientOrgID)
+	err = s.verifyClientOrgMatchesPeerOrg(ctx, clientOrgID)
 	if err != nil {
 		return "", err
 	}
@@ -545,42 +941,65 @@ func getClientImplicitCollectionNameAndVerifyClientOrg(ctx contractapi.Transacti
 }
 
 // verifyClientOrgMatchesPeerOrg checks that the client is from the same org as the peer
-func verifyClientOrgMatchesPeerOrg(clientOrgID string) error {
-	peerOrgID, err := shim.GetMSPID()
+func (s *SmartContract) verifyClientOrgMatchesPeerOrg(ctx contractapi.TransactionContextInterface, clientOrgID string) error {
+	peerOrgID, err := s.peerIdentity().GetPeerMSPID(ctx)
 	if err != nil {
 		return fmt.Errorf("failed getting peer's orgID: %v", err)
 	}
 
 	if clientOrgID != peerOrgID {
-		return fmt.Errorf("client from org %s is not authorized to read or write private data from an org %s peer",
-			clientOrgID,
-			peerOrgID,
-		)
+		return &AuthorizationError{ClientOrg: clientOrgID, Action: fmt.Sprintf("read or write private data from an org %s peer", peerOrgID)}
 	}
 
 	return nil
 }
 
+// verifyPeerEndorsesCommodities checks that the client is from the same org as the peer, or that the peer belongs to an org
+// whose endorsement updates of one of the commodities require: one of its endorsers or the getter of its shipment.
+// The peers of those orgs cannot read the owner's collection, it returns whether the peer belongs to the client's org.
+func (s *SmartContract) verifyPeerEndorsesCommodities(ctx contractapi.TransactionContextInterface, clientOrgID string, commodities ...*Commodity) (bool, error) {
+	peerOrgID, err := s.peerIdentity().GetPeerMSPID(ctx)
+	if err != nil {
+		return false, fmt.Errorf("failed getting peer's orgID: %v", err)
+	}
+
+	if clientOrgID == peerOrgID {
+		return true, nil
+	}
+	for _, commodity := range commodities {
+		if indexOf(commodity.Endorsers, peerOrgID) >= 0 || (commodity.Shipment != nil && commodity.Shipment.GetterOrg == peerOrgID) {
+			return false, nil
+		}
+	}
+
+	return false, &AuthorizationError{ClientOrg: clientOrgID, Action: fmt.Sprintf("update a commodity from an org %s peer, which does not endorse it", peerOrgID)}
+}
+
 // buildCollectionName returns the implicit collection name for an org
 func buildCollectionName(clientOrgID string) string {
 	return fmt.Sprintf("_implicit_org_%s", clientOrgID)
 }
 
-// setCommodityStateBasedEndorsement adds an endorsement policy to an asset so that the passed orges need to agree upon transfer
-func setCommodityStateBasedEndorsement(ctx contractapi.TransactionContextInterface, assetID string, orgesToEndorse []string) error {
-	endorsementPolicy, err := statebased.NewStateEP(nil)
-	if err != nil {
-		return err
+// setCommodityStateBasedEndorsement sets the endorsement policy of a commodity such that a peer of the owner org, of the
+// receiver while the commodity is in transit, and the required number of peers of its endorsers are required to endorse future updates
+func setCommodityStateBasedEndorsement(ctx contractapi.TransactionContextInterface, commodity *Commodity) error {
+	owners := []string{commodity.OwnerOrg}
+	if commodity.Shipment != nil {
+		owners = append(owners, commodity.Shipment.GetterOrg)
 	}
-	err = endorsementPolicy.AddOrgs(statebased.RoleTypePeer, orgesToEndorse...)
-	if err != nil {
-		return fmt.Errorf("failed to add org to endorsement policy: %v", err)
+
+	var policy []byte
+	var err error
+	if len(commodity.Endorsers) == 0 {
+		policy, err = ownerEndorsementPolicy(owners)
+	} else {
+		policy, err = coEndorsementPolicy(owners, commodity.Endorsers, commodity.requiredEndorsers())
 	}
-	policy, err := endorsementPolicy.Policy()
 	if err != nil {
-		return fmt.Errorf("failed to create endorsement policy bytes from org: %v", err)
+		return err
 	}
-	err = ctx.GetStub().SetStateValidationParameter(assetID, policy)
+
+	err = ctx.GetStub().SetStateValidationParameter(commodity.ID, policy)
 	if err != nil {
 		return fmt.Errorf("failed to set validation parameter on asset: %v", err)
 	}
@@ -590,15 +1009,10 @@ func setCommodityStateBasedEndorsement(ctx contractapi.TransactionContextInterfa
 
 // GetCommodityHashId allows a potential downstream to validate the properties of a commodity against the commodityId hash on chain and returns the hash
 func (s *SmartContract) GetCommodityHashId(ctx contractapi.TransactionContextInterface) (string, error) {
-	transientMap, err := ctx.GetStub().GetTransient()
-	if err != nil {
-		return "", fmt.Errorf("error getting transient: %v", err)
-	}
-
 	// Asset properties must be retrieved from the transient field as they are private
-	propertiesJSON, ok := transientMap["Commodity_properties"]
-	if !ok {
-		return "", fmt.Errorf("commodity_properties key not found in the transient map")
+	propertiesJSON, err := getTransientInput(ctx, commodityPropertiesInput)
+	if err != nil {
+		return "", err
 	}
 
 	hash := sha256.New()
@@ -616,7 +1030,15 @@ func (s *SmartContract) GetCommodityHashId(ctx contractapi.TransactionContextInt
 }
 
 func main() {
-	chaincode, err := contractapi.NewChaincode(new(SmartContract))
+	permissions, err := permissionsFromEnv()
+	if err != nil {
+		log.Panicf("Error reading permissions: %v", err)
+	}
+
+	chaincode, err := contractapi.NewChaincode(&SmartContract{
+		PeerIdentity: peerIdentityFromEnv(),
+		Permissions:  permissions,
+	})
 	if err != nil {
 		log.Panicf("Error create transfer asset chaincode: %v", err)
 	}
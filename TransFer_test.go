@@ -0,0 +1,502 @@
+package main
+
+import (
+	"crypto/sha256"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"reflect"
+	"strings"
+	"testing"
+	"time"
+
+	"SupplyChainTrackingChaincode/chaincodetest"
+
+	"github.com/hyperledger/fabric-chaincode-go/pkg/statebased"
+)
+
+const (
+	org1MSP = "Org1MSP"
+	org2MSP = "Org2MSP"
+	org3MSP = "Org3MSP"
+
+	palletProperties = `{"name":"pallet","weight":100}`
+)
+
+var (
+	org1Client = chaincodetest.Identity{MSPID: org1MSP}
+	org2Client = chaincodetest.Identity{MSPID: org2MSP}
+	org3Client = chaincodetest.Identity{MSPID: org3MSP}
+)
+
+// newContract returns the contract as deployed on the peers of a chaincodetest ledger
+func newContract() *SmartContract {
+	return &SmartContract{PeerIdentity: chaincodetest.PeerIdentity{}}
+}
+
+// transferKeyOf returns the transient commodity_transferKey both companies agree on
+func transferKeyOf(commodityID string) []byte {
+	return transferKeyBetween(commodityID, org1MSP, org2MSP)
+}
+
+// transferKeyBetween returns the agreement on the transfer of a commodity from the putter to the getter org
+func transferKeyBetween(commodityID, putterOrg, getterOrg string) []byte {
+	return []byte(fmt.Sprintf(`{"version":3,"commodity":%q,"transferKey":%q,"transfer_id":"transfer-1","putter":%q,"getter":%q}`,
+		commodityID, secretOf(commodityID), putterOrg, getterOrg))
+}
+
+// secretOf returns the secret of the transferKey both companies agree on, 64 hex digits
+func secretOf(commodityID string) TransferKey {
+	return TransferKey(fmt.Sprintf("%x", sha256.Sum256([]byte("secret of "+commodityID))))
+}
+
+// createCommodity creates a commodity owned by the client's org and returns its id
+func createCommodity(t *testing.T, ledger *chaincodetest.Ledger, client chaincodetest.Identity, properties string) string {
+	t.Helper()
+	return createCommodityOnRoute(t, ledger, client, properties, "")
+}
+
+// createCommodityOnRoute creates a commodity owned by the client's org with a planned route and returns its id
+func createCommodityOnRoute(t *testing.T, ledger *chaincodetest.Ledger, client chaincodetest.Identity, properties string, route string) string {
+	t.Helper()
+
+	ctx := ledger.NewTransaction(client).WithTransient("commodity_properties", []byte(properties))
+	commodityID, err := newContract().CreateAsset(ctx, route, "a pallet")
+	if err != nil {
+		t.Fatalf("CreateAsset: %v", err)
+	}
+	if err = ctx.Commit(); err != nil {
+		t.Fatalf("commit CreateAsset: %v", err)
+	}
+
+	return commodityID
+}
+
+// agree records the agreement of the putter and getter orgs on the transfer of a commodity
+func agree(t *testing.T, ledger *chaincodetest.Ledger, putter, getter chaincodetest.Identity, commodityID, properties string, transferKey []byte) {
+	t.Helper()
+	s := newContract()
+
+	ctx := ledger.NewTransaction(putter).WithTransient("commodity_transferKey", transferKey)
+	if err := s.AgreeToPut(ctx, commodityID); err != nil {
+		t.Fatalf("AgreeToPut: %v", err)
+	}
+	if err := ctx.Commit(); err != nil {
+		t.Fatalf("commit AgreeToPut: %v", err)
+	}
+
+	ctx = ledger.NewTransaction(getter).
+		WithTransient("commodity_properties", []byte(properties)).
+		WithTransient("commodity_transferKey", transferKey)
+	if err := s.AgreeToGet(ctx, commodityID); err != nil {
+		t.Fatalf("AgreeToGet: %v", err)
+	}
+	if err := ctx.Commit(); err != nil {
+		t.Fatalf("commit AgreeToGet: %v", err)
+	}
+}
+
+// transfer transfers a commodity from the putter to the getter org
+func transfer(ledger *chaincodetest.Ledger, putter chaincodetest.Identity, getterOrg, commodityID string, transferKey []byte) (*chaincodetest.TransactionContext, error) {
+	ctx := ledger.NewTransaction(putter).WithTransient("commodity_transferKey", transferKey)
+	err := newContract().TransferCommodity(ctx, commodityID, getterOrg)
+	if err != nil {
+		return ctx, err
+	}
+	return ctx, ctx.Commit()
+}
+
+func TestTransferCommodity(t *testing.T) {
+	ledger := chaincodetest.NewLedger()
+	s := newContract()
+
+	commodityID := createCommodity(t, ledger, org1Client, palletProperties)
+	transferKey := transferKeyOf(commodityID)
+
+	// the downstream company verifies the properties before agreeing
+	ctx := ledger.NewTransaction(org2Client).WithTransient("commodity_properties", []byte(palletProperties))
+	verified, err := s.VerifyCommodityProperties(ctx, commodityID)
+	if err != nil || !verified {
+		t.Fatalf("VerifyCommodityProperties = %v, %v", verified, err)
+	}
+
+	agree(t, ledger, org1Client, org2Client, commodityID, palletProperties, transferKey)
+
+	if _, err = transfer(ledger, org1Client, org2MSP, commodityID, transferKey); err != nil {
+		t.Fatalf("TransferCommodity: %v", err)
+	}
+
+	commodity, err := s.ReadCommodity(ledger.NewTransaction(org3Client), commodityID)
+	if err != nil {
+		t.Fatalf("ReadCommodity: %v", err)
+	}
+	if commodity.OwnerOrg != org2MSP || commodity.Source != org1MSP {
+		t.Errorf("owner, source = %s, %s, want %s, %s", commodity.OwnerOrg, commodity.Source, org2MSP, org1MSP)
+	}
+
+	policy, err := statebased.NewStateEP(ledger.ValidationParameter(commodityID))
+	if err != nil {
+		t.Fatalf("parse endorsement policy: %v", err)
+	}
+	if orgs := policy.ListOrgs(); !reflect.DeepEqual(orgs, []string{org2MSP}) {
+		t.Errorf("endorsing orgs = %v, want [%s]", orgs, org2MSP)
+	}
+
+	if ledger.PrivateData(buildCollectionName(org1MSP), commodityID) != nil {
+		t.Error("commodity properties were not deleted from the upstream collection")
+	}
+	for _, client := range []chaincodetest.Identity{org1Client, org2Client} {
+		agreements, err := s.QueryCommodityPutAgreements(ledger.NewTransaction(client))
+		if err != nil || len(agreements) != 0 {
+			t.Errorf("%s put agreements = %v, %v, want none", client.MSPID, agreements, err)
+		}
+		agreements, err = s.QueryCommodityGetAgreements(ledger.NewTransaction(client))
+		if err != nil || len(agreements) != 0 {
+			t.Errorf("%s get agreements = %v, %v, want none", client.MSPID, agreements, err)
+		}
+	}
+
+	events := ledger.Events()
+	if last := events[len(events)-1]; last.Name != eventCommodityTransferred {
+		t.Errorf("last event = %s, want %s", last.Name, eventCommodityTransferred)
+	}
+}
+
+func TestTransferCommodityReceipts(t *testing.T) {
+	ledger := chaincodetest.NewLedger()
+	s := newContract()
+
+	commodityID := createCommodity(t, ledger, org1Client, palletProperties)
+	agree(t, ledger, org1Client, org2Client, commodityID, palletProperties, transferKeyOf(commodityID))
+	ctx, err := transfer(ledger, org1Client, org2MSP, commodityID, transferKeyOf(commodityID))
+	if err != nil {
+		t.Fatalf("TransferCommodity: %v", err)
+	}
+	txID := ctx.GetStub().GetTxID()
+
+	putReceipts, err := s.QueryPutReceipts(ledger.NewTransaction(org1Client))
+	if err != nil || len(putReceipts) != 1 {
+		t.Fatalf("QueryPutReceipts = %v, %v, want one receipt", putReceipts, err)
+	}
+	getReceipts, err := s.QueryGetReceipts(ledger.NewTransaction(org2Client))
+	if err != nil || len(getReceipts) != 1 {
+		t.Fatalf("QueryGetReceipts = %v, %v, want one receipt", getReceipts, err)
+	}
+	if putReceipts[0] != getReceipts[0] {
+		t.Errorf("put receipt %+v differs from get receipt %+v", putReceipts[0], getReceipts[0])
+	}
+
+	receipt, err := s.GetReceipt(ledger.NewTransaction(org2Client), commodityID, txID)
+	if err != nil {
+		t.Fatalf("GetReceipt: %v", err)
+	}
+	if receipt.CommodityID != commodityID || receipt.TxID != txID || receipt.PutterOrg != org1MSP ||
+		receipt.GetterOrg != org2MSP || receipt.TransferKey != secretOf(commodityID) || receipt.Timestamp.IsZero() {
+		t.Errorf("unexpected receipt %+v", receipt)
+	}
+
+	_, err = s.GetReceipt(ledger.NewTransaction(org3Client), commodityID, txID)
+	if err == nil {
+		t.Error("GetReceipt succeeded for an org that did not take part in the transfer")
+	}
+}
+
+func TestTransferCommodityRejectsMismatchedTransferKey(t *testing.T) {
+	ledger := chaincodetest.NewLedger()
+
+	commodityID := createCommodity(t, ledger, org1Client, palletProperties)
+	agree(t, ledger, org1Client, org2Client, commodityID, palletProperties, transferKeyOf(commodityID))
+
+	wrongKey := []byte(fmt.Sprintf(`{"version":3,"commodity":%q,"transferKey":%q,"transfer_id":"transfer-1","putter":%q,"getter":%q}`,
+		commodityID, secretOf("another"), org1MSP, org2MSP))
+	if _, err := transfer(ledger, org1Client, org2MSP, commodityID, wrongKey); err == nil {
+		t.Fatal("TransferCommodity succeeded with a transferKey the companies did not agree on")
+	}
+}
+
+func TestTransferCommodityRejectsMismatchedProperties(t *testing.T) {
+	ledger := chaincodetest.NewLedger()
+
+	commodityID := createCommodity(t, ledger, org1Client, palletProperties)
+	agree(t, ledger, org1Client, org2Client, commodityID, `{"name":"pallet","weight":99}`, transferKeyOf(commodityID))
+
+	if _, err := transfer(ledger, org1Client, org2MSP, commodityID, transferKeyOf(commodityID)); err == nil {
+		t.Fatal("TransferCommodity succeeded although the companies hold different commodity properties")
+	}
+}
+
+func TestTransferCommodityRequiresOwner(t *testing.T) {
+	ledger := chaincodetest.NewLedger()
+
+	commodityID := createCommodity(t, ledger, org1Client, palletProperties)
+	agree(t, ledger, org1Client, org2Client, commodityID, palletProperties, transferKeyOf(commodityID))
+
+	if _, err := transfer(ledger, org2Client, org2MSP, commodityID, transferKeyOf(commodityID)); err == nil {
+		t.Fatal("TransferCommodity succeeded for a client of an org not owning the commodity")
+	}
+}
+
+func TestCreateAssetRejectsDuplicate(t *testing.T) {
+	ledger := chaincodetest.NewLedger()
+	s := newContract()
+
+	commodityID := createCommodity(t, ledger, org1Client, palletProperties)
+
+	ctx := ledger.NewTransaction(org2Client).WithTransient("commodity_properties", []byte(palletProperties))
+	_, err := s.CreateAsset(ctx, org3MSP, "the same pallet")
+	var exists *CommodityExistsError
+	if !errors.As(err, &exists) || exists.ID != commodityID || exists.OwnerOrg != org1MSP {
+		t.Fatalf("CreateAsset error = %v, want CommodityExistsError for %s", err, commodityID)
+	}
+
+	// a salt tells physically distinct commodities with identical descriptions apart
+	saltedProperties := `{"name":"pallet","weight":100,"salt":"6f1c2a"}`
+	saltedID := createCommodity(t, ledger, org2Client, saltedProperties)
+	if saltedID == commodityID {
+		t.Fatal("salted commodity got the same id")
+	}
+
+	ctx = ledger.NewTransaction(org1Client).WithTransient("commodity_properties", []byte(saltedProperties))
+	verified, err := s.VerifyCommodityProperties(ctx, saltedID)
+	if err != nil || !verified {
+		t.Errorf("VerifyCommodityProperties = %v, %v", verified, err)
+	}
+
+	ctx = ledger.NewTransaction(org1Client).WithTransient("commodity_properties", []byte(saltedProperties))
+	hashID, err := s.GetCommodityHashId(ctx)
+	if err != nil || hashID != saltedID {
+		t.Errorf("GetCommodityHashId = %s, %v, want %s", hashID, err, saltedID)
+	}
+}
+
+func TestTransientInputErrors(t *testing.T) {
+	ledger := chaincodetest.NewLedger()
+	s := newContract()
+
+	_, err := s.CreateAsset(ledger.NewTransaction(org1Client), org2MSP, "a pallet")
+	var missing *MissingTransientKeyError
+	if !errors.As(err, &missing) || missing.Key != "commodity_properties" {
+		t.Errorf("error = %v, want MissingTransientKeyError for commodity_properties", err)
+	}
+
+	for name, properties := range map[string]string{
+		"malformed JSON": `{"name":`,
+		"not an object":  `["pallet"]`,
+		"salt type":      `{"name":"pallet","salt":7}`,
+	} {
+		ctx := ledger.NewTransaction(org1Client).WithTransient("commodity_properties", []byte(properties))
+		_, err = s.CreateAsset(ctx, org2MSP, "a pallet")
+		var invalid *InvalidTransientValueError
+		if !errors.As(err, &invalid) || invalid.Key != "commodity_properties" {
+			t.Errorf("%s: error = %v, want InvalidTransientValueError for commodity_properties", name, err)
+		}
+	}
+
+	commodityID := createCommodity(t, ledger, org1Client, palletProperties)
+	ctx := ledger.NewTransaction(org1Client).WithTransient("commodity_transferKey", []byte(`{"commodity":"x"}`))
+	err = s.AgreeToPut(ctx, commodityID)
+	var invalid *InvalidTransientValueError
+	if !errors.As(err, &invalid) || invalid.Key != "commodity_transferKey" {
+		t.Errorf("error = %v, want InvalidTransientValueError for commodity_transferKey", err)
+	}
+
+	// the first of several errors in member order is reported
+	for i := 0; i < 10; i++ {
+		err = commodityTermsInput.validate([]byte(`{"quantity":"40"}`))
+		if err == nil || !strings.Contains(err.Error(), `"currency"`) {
+			t.Fatalf("error = %v, want the missing member currency", err)
+		}
+	}
+
+	// legacy capitalized keys are still accepted
+	ctx = ledger.NewTransaction(org2Client).WithTransient("Commodity_properties", []byte(palletProperties))
+	verified, err := s.VerifyCommodityProperties(ctx, commodityID)
+	if err != nil || !verified {
+		t.Errorf("VerifyCommodityProperties with legacy key = %v, %v", verified, err)
+	}
+}
+
+func TestChangePublicDescription(t *testing.T) {
+	ledger := chaincodetest.NewLedger()
+	s := newContract()
+
+	commodityID := createCommodity(t, ledger, org1Client, palletProperties)
+
+	if err := s.ChangePublicDescription(ledger.NewTransaction(org2Client), commodityID, "stolen"); err == nil {
+		t.Error("ChangePublicDescription succeeded for a client of an org not owning the commodity")
+	}
+
+	ctx := ledger.NewTransaction(org1Client)
+	if err := s.ChangePublicDescription(ctx, commodityID, "a heavy pallet"); err != nil {
+		t.Fatalf("ChangePublicDescription: %v", err)
+	}
+	if err := ctx.Commit(); err != nil {
+		t.Fatalf("commit ChangePublicDescription: %v", err)
+	}
+
+	var event CommodityEvent
+	if err := json.Unmarshal(ctx.Stub().Event().Payload, &event); err != nil {
+		t.Fatalf("unmarshal event: %v", err)
+	}
+	want := CommodityEvent{
+		Version:     eventSchemaVersion,
+		EventType:   eventDescriptionChanged,
+		CommodityID: commodityID,
+		OwnerOrg:    org1MSP,
+		TxID:        ctx.GetStub().GetTxID(),
+	}
+	if !reflect.DeepEqual(event, want) {
+		t.Errorf("event = %+v, want %+v", event, want)
+	}
+
+	history, err := s.QueryCommodityHistory(ledger.NewTransaction(org3Client), commodityID)
+	if err != nil || len(history) != 2 {
+		t.Fatalf("QueryCommodityHistory = %v, %v, want 2 records", history, err)
+	}
+	if history[0].Record.PublicDescription != "a heavy pallet" {
+		t.Errorf("newest description = %q", history[0].Record.PublicDescription)
+	}
+}
+
+func TestPrivateDataRequiresClientFromPeerOrg(t *testing.T) {
+	ledger := chaincodetest.NewLedger()
+	commodityID := createCommodity(t, ledger, org1Client, palletProperties)
+
+	properties, err := newContract().GetCommodityPrivateProperties(ledger.NewTransaction(org1Client), commodityID)
+	if err != nil || properties != palletProperties {
+		t.Errorf("GetCommodityPrivateProperties = %s, %v, want %s", properties, err, palletProperties)
+	}
+
+	ctx := ledger.NewTransaction(org1Client).OnPeer(org2MSP)
+	if _, err = newContract().GetCommodityPrivateProperties(ctx, commodityID); err == nil {
+		t.Error("GetCommodityPrivateProperties succeeded for a client of Org1MSP on a peer of Org2MSP")
+	}
+
+	// external chaincode configured with the org of its peer
+	s := &SmartContract{PeerIdentity: StaticPeerIdentity(org2MSP)}
+	if _, err = s.GetCommodityPrivateProperties(ledger.NewTransaction(org1Client), commodityID); err == nil {
+		t.Error("GetCommodityPrivateProperties succeeded for a client of Org1MSP on a chaincode configured for Org2MSP")
+	}
+}
+
+func TestCancelAgreements(t *testing.T) {
+	ledger := chaincodetest.NewLedger()
+	s := newContract()
+
+	commodityID := createCommodity(t, ledger, org1Client, palletProperties)
+	agree(t, ledger, org1Client, org2Client, commodityID, palletProperties, transferKeyOf(commodityID))
+
+	ctx := ledger.NewTransaction(org2Client)
+	if err := s.CancelGetAgreement(ctx, commodityID); err != nil {
+		t.Fatalf("CancelGetAgreement: %v", err)
+	}
+	if err := ctx.Commit(); err != nil {
+		t.Fatalf("commit CancelGetAgreement: %v", err)
+	}
+	if ledger.PrivateData(buildCollectionName(org2MSP), commodityID) != nil {
+		t.Error("commodity properties were not deleted from the downstream collection")
+	}
+	if err := s.CancelGetAgreement(ledger.NewTransaction(org2Client), commodityID); err == nil {
+		t.Error("CancelGetAgreement succeeded for an agreement that does not exist")
+	}
+
+	ctx = ledger.NewTransaction(org1Client)
+	if err := s.CancelPutAgreement(ctx, commodityID); err != nil {
+		t.Fatalf("CancelPutAgreement: %v", err)
+	}
+	if err := ctx.Commit(); err != nil {
+		t.Fatalf("commit CancelPutAgreement: %v", err)
+	}
+	if ledger.PrivateData(buildCollectionName(org1MSP), commodityID) == nil {
+		t.Error("commodity properties were deleted from the owner's collection")
+	}
+
+	if _, err := transfer(ledger, org1Client, org2MSP, commodityID, transferKeyOf(commodityID)); err == nil {
+		t.Error("TransferCommodity succeeded after both agreements were cancelled")
+	}
+}
+
+func TestExpiredAgreements(t *testing.T) {
+	ledger := chaincodetest.NewLedger()
+	s := newContract()
+
+	commodityID := createCommodity(t, ledger, org1Client, palletProperties)
+	expires := ledger.Now().Add(time.Hour).Format(time.RFC3339)
+	transferKey := []byte(fmt.Sprintf(`{"version":3,"commodity":%q,"transferKey":%q,"transfer_id":"transfer-1","putter":%q,"getter":%q,"expires":%q}`,
+		commodityID, secretOf(commodityID), org1MSP, org2MSP, expires))
+	agree(t, ledger, org1Client, org2Client, commodityID, palletProperties, transferKey)
+
+	ledger.Advance(time.Hour)
+	if _, err := transfer(ledger, org1Client, org2MSP, commodityID, transferKey); err == nil {
+		t.Fatal("TransferCommodity succeeded with an expired agreement")
+	}
+
+	ctx := ledger.NewTransaction(org1Client).WithTransient("commodity_transferKey", transferKey)
+	if err := s.AgreeToPut(ctx, commodityID); err == nil {
+		t.Error("AgreeToPut succeeded with an expired agreement")
+	}
+
+	ctx = ledger.NewTransaction(org2Client)
+	purged, err := s.PurgeExpiredAgreements(ctx)
+	if err != nil || len(purged) != 1 || purged[0] != commodityID {
+		t.Fatalf("PurgeExpiredAgreements = %v, %v, want the agreement on %s", purged, err, commodityID)
+	}
+	if err = ctx.Commit(); err != nil {
+		t.Fatalf("commit PurgeExpiredAgreements: %v", err)
+	}
+	agreements, err := s.QueryCommodityGetAgreements(ledger.NewTransaction(org2Client))
+	if err != nil || len(agreements) != 0 {
+		t.Errorf("get agreements after purge = %v, %v, want none", agreements, err)
+	}
+	agreements, err = s.QueryCommodityPutAgreements(ledger.NewTransaction(org1Client))
+	if err != nil || len(agreements) != 1 {
+		t.Errorf("put agreements of another org = %v, %v, want one", agreements, err)
+	}
+}
+
+func TestRouteEnforcement(t *testing.T) {
+	ledger := chaincodetest.NewLedger()
+	s := newContract()
+
+	if _, err := s.CreateAsset(ledger.NewTransaction(org1Client).WithTransient("commodity_properties", []byte(palletProperties)), "Org2MSP,,Org3MSP", "a pallet"); err == nil {
+		t.Error("CreateAsset succeeded with an empty org in the route")
+	}
+
+	commodityID := createCommodityOnRoute(t, ledger, org1Client, palletProperties, "Org2MSP, Org3MSP")
+	commodity, err := s.ReadCommodity(ledger.NewTransaction(org1Client), commodityID)
+	if err != nil || commodity.Target != org3MSP || !reflect.DeepEqual(commodity.Route, []string{org2MSP, org3MSP}) {
+		t.Fatalf("ReadCommodity = %+v, %v", commodity, err)
+	}
+
+	// Org3MSP is not the next stop
+	agree(t, ledger, org1Client, org3Client, commodityID, palletProperties, transferKeyBetween(commodityID, org1MSP, org3MSP))
+	if _, err = transfer(ledger, org1Client, org3MSP, commodityID, transferKeyBetween(commodityID, org1MSP, org3MSP)); err == nil {
+		t.Fatal("TransferCommodity succeeded to an org deviating from the route")
+	}
+
+	agree(t, ledger, org1Client, org2Client, commodityID, palletProperties, transferKeyOf(commodityID))
+	if _, err = transfer(ledger, org1Client, org2MSP, commodityID, transferKeyOf(commodityID)); err != nil {
+		t.Fatalf("TransferCommodity along the route: %v", err)
+	}
+
+	progress, err := s.GetRouteProgress(ledger.NewTransaction(org1Client), commodityID)
+	if err != nil || progress.NextOrg != org3MSP || !reflect.DeepEqual(progress.Visited, []string{org2MSP}) || progress.Completed {
+		t.Fatalf("GetRouteProgress = %+v, %v", progress, err)
+	}
+
+	if err = s.AmendRoute(ledger.NewTransaction(org1Client), commodityID, org1MSP); err == nil {
+		t.Error("AmendRoute succeeded for a client of an org not owning the commodity")
+	}
+	ctx := ledger.NewTransaction(org2Client)
+	if err = s.AmendRoute(ctx, commodityID, "Org1MSP,Org3MSP"); err != nil {
+		t.Fatalf("AmendRoute: %v", err)
+	}
+	if err = ctx.Commit(); err != nil {
+		t.Fatalf("commit AmendRoute: %v", err)
+	}
+
+	progress, err = s.GetRouteProgress(ledger.NewTransaction(org2Client), commodityID)
+	if err != nil || !reflect.DeepEqual(progress.Route, []string{org2MSP, org1MSP, org3MSP}) || progress.NextOrg != org1MSP {
+		t.Errorf("GetRouteProgress after amendment = %+v, %v", progress, err)
+	}
+}
@@ -0,0 +1,258 @@
+package main
+
+import (
+	"bytes"
+	"encoding/json"
+	"fmt"
+	"sort"
+
+	"github.com/hyperledger/fabric-contract-api-go/contractapi"
+)
+
+// jsonType is the kind of a JSON value expected for a member of a transient input
+type jsonType string
+
+const (
+	jsonObject jsonType = "object"
+	jsonString jsonType = "string"
+	jsonNumber jsonType = "number"
+	jsonArray  jsonType = "array"
+)
+
+// transientSchema declares a private input passed by transient field: the documented key clients must use,
+// the legacy spellings still accepted for older clients and the JSON members its value must or may contain.
+// The value of a list input is a non-empty JSON array whose elements are objects with these members.
+type transientSchema struct {
+	key      string
+	aliases  []string
+	list     bool
+	required map[string]jsonType
+	optional map[string]jsonType
+}
+
+// commoditySaltMember is the member of the commodity properties holding a random salt (nonce) chosen by the creator.
+// As it is hashed along with the other properties, it changes the commodityID without changing how the properties are verified.
+const commoditySaltMember = "salt"
+
+// Private inputs accepted by the transactions of this chaincode.
+//
+//	commodity_properties:  JSON object with the immutable properties of a commodity, its hash is the commodityID.
+//	                       An optional "salt" string member distinguishes physically distinct commodities with identical descriptions.
+//	commodity_transferKey: JSON object {"version": 3, "commodity": string, "transferKey": string, "transfer_id": string,
+//	                       "putter": string, "getter": string, "expires": string} where "transferKey" is a high-entropy secret,
+//	                       e.g. 64 random hex digits, "putter" and "getter" are the MSP IDs of the companies of the transfer,
+//	                       and the optional "expires" is an RFC 3339 timestamp after which the agreement can no longer be used,
+//	                       see Agreement.go.
+//	commodity_details:     JSON object with sensitive details of a commodity such as lot numbers, supplier contracts or unit cost.
+//	commodity_children:    JSON array of commodity properties objects, one per commodity a commodity is split into.
+//	commodity_terms:       JSON object {"unitPrice": number, "currency": string, "quantity": number, "incoterm": string, "deliveryDate": string}
+//	                       with the commercial terms of a transfer, see CommercialTerms. The owner passes its terms again
+//	                       to TransferCommodity and ShipCommodity, which pay their price, see payAgreedPrice.
+var (
+	commodityPropertiesInput = transientSchema{
+		key:     "commodity_properties",
+		aliases: []string{"Commodity_properties"},
+		optional: map[string]jsonType{
+			commoditySaltMember: jsonString,
+		},
+	}
+	commodityTransferKeyInput = transientSchema{
+		key:     "commodity_transferKey",
+		aliases: []string{"Commodity_transferKey"},
+		// transferKey is a string, or a number in version 1 agreements, see parseAgreement
+		required: map[string]jsonType{
+			"commodity": jsonString,
+		},
+		optional: map[string]jsonType{
+			"version":     jsonNumber,
+			"transfer_id": jsonString,
+			"putter":      jsonString,
+			"getter":      jsonString,
+			"expires":     jsonString,
+		},
+	}
+	commodityDetailsInput = transientSchema{
+		key: "commodity_details",
+	}
+	commodityTermsInput = transientSchema{
+		key: "commodity_terms",
+		required: map[string]jsonType{
+			"unitPrice":    jsonNumber,
+			"currency":     jsonString,
+			"quantity":     jsonNumber,
+			"incoterm":     jsonString,
+			"deliveryDate": jsonString,
+		},
+	}
+	commodityChildrenInput = transientSchema{
+		key:  "commodity_children",
+		list: true,
+		optional: map[string]jsonType{
+			commoditySaltMember: jsonString,
+		},
+	}
+)
+
+// MissingTransientKeyError is returned when a private input is not found in the transient map
+type MissingTransientKeyError struct {
+	Key string
+}
+
+func (e *MissingTransientKeyError) Error() string {
+	return fmt.Sprintf("%s key not found in the transient map", e.Key)
+}
+
+// InvalidTransientValueError is returned when a private input does not match its declared schema
+type InvalidTransientValueError struct {
+	Key    string
+	Reason string
+}
+
+func (e *InvalidTransientValueError) Error() string {
+	return fmt.Sprintf("invalid value for transient key %s: %s", e.Key, e.Reason)
+}
+
+// getTransientInput retrieves a private input from the transient map and validates it against its schema.
+// The value is returned as is, since its hash is compared against on-chain hashes.
+func getTransientInput(ctx contractapi.TransactionContextInterface, schema transientSchema) ([]byte, error) {
+	transientMap, err := ctx.GetStub().GetTransient()
+	if err != nil {
+		return nil, fmt.Errorf("error getting transient: %v", err)
+	}
+
+	value, ok := transientMap[schema.key]
+	if !ok {
+		for _, alias := range schema.aliases {
+			if value, ok = transientMap[alias]; ok {
+				break
+			}
+		}
+	}
+	if !ok {
+		return nil, &MissingTransientKeyError{Key: schema.key}
+	}
+
+	err = schema.validate(value)
+	if err != nil {
+		return nil, err
+	}
+
+	return value, nil
+}
+
+// getTransientList retrieves a list input from the transient map, validates it against its schema and returns its elements as is
+func getTransientList(ctx contractapi.TransactionContextInterface, schema transientSchema) ([]json.RawMessage, error) {
+	value, err := getTransientInput(ctx, schema)
+	if err != nil {
+		return nil, err
+	}
+
+	var elements []json.RawMessage
+	err = json.Unmarshal(value, &elements)
+	if err != nil {
+		return nil, &InvalidTransientValueError{Key: schema.key, Reason: err.Error()}
+	}
+
+	return elements, nil
+}
+
+// validate checks that value is a JSON object, or for a list input a JSON array of objects, holding every required member,
+// and optional member if present, with the expected type
+func (schema transientSchema) validate(value []byte) error {
+	if !json.Valid(value) {
+		return &InvalidTransientValueError{Key: schema.key, Reason: "malformed JSON"}
+	}
+	if !schema.list {
+		return schema.validateObject(value, "value")
+	}
+
+	if kindOfJSON(value) != jsonArray {
+		return &InvalidTransientValueError{Key: schema.key, Reason: "value must be a JSON array"}
+	}
+	var elements []json.RawMessage
+	err := json.Unmarshal(value, &elements)
+	if err != nil {
+		return &InvalidTransientValueError{Key: schema.key, Reason: err.Error()}
+	}
+	if len(elements) == 0 {
+		return &InvalidTransientValueError{Key: schema.key, Reason: "value must not be empty"}
+	}
+	for i, element := range elements {
+		err = schema.validateObject(element, fmt.Sprintf("element %d", i))
+		if err != nil {
+			return err
+		}
+	}
+
+	return nil
+}
+
+// validateObject checks the members of a JSON object, which is named in errors
+func (schema transientSchema) validateObject(value []byte, name string) error {
+	if kindOfJSON(value) != jsonObject {
+		return &InvalidTransientValueError{Key: schema.key, Reason: fmt.Sprintf("%s must be a JSON object", name)}
+	}
+
+	var members map[string]json.RawMessage
+	err := json.Unmarshal(value, &members)
+	if err != nil {
+		return &InvalidTransientValueError{Key: schema.key, Reason: err.Error()}
+	}
+
+	// Members are checked in sorted order, so that the same error is reported for an input with several errors
+	for _, member := range sortedMembers(schema.required) {
+		expected := schema.required[member]
+		raw, ok := members[member]
+		if !ok {
+			return &InvalidTransientValueError{Key: schema.key, Reason: fmt.Sprintf("%s is missing member %q", name, member)}
+		}
+		if actual := kindOfJSON(raw); actual != expected {
+			return &InvalidTransientValueError{Key: schema.key, Reason: fmt.Sprintf("member %q of %s must be a %s, got %s", member, name, expected, actual)}
+		}
+	}
+
+	for _, member := range sortedMembers(schema.optional) {
+		expected := schema.optional[member]
+		raw, ok := members[member]
+		if !ok {
+			continue
+		}
+		if actual := kindOfJSON(raw); actual != expected {
+			return &InvalidTransientValueError{Key: schema.key, Reason: fmt.Sprintf("member %q of %s must be a %s, got %s", member, name, expected, actual)}
+		}
+	}
+
+	return nil
+}
+
+// sortedMembers returns the names of the members of a schema in sorted order
+func sortedMembers(members map[string]jsonType) []string {
+	names := make([]string, 0, len(members))
+	for member := range members {
+		names = append(names, member)
+	}
+	sort.Strings(names)
+	return names
+}
+
+// kindOfJSON returns the kind of a valid JSON value
+func kindOfJSON(value []byte) jsonType {
+	trimmed := bytes.TrimSpace(value)
+	if len(trimmed) == 0 {
+		return ""
+	}
+	switch trimmed[0] {
+	case '{':
+		return jsonObject
+	case '"':
+		return jsonString
+	case '[':
+		return jsonArray
+	case 't', 'f':
+		return "boolean"
+	case 'n':
+		return "null"
+	default:
+		return jsonNumber
+	}
+}
@@ -0,0 +1,273 @@
+package main
+
+import (
+	"fmt"
+	"strings"
+	"time"
+
+	"github.com/hyperledger/fabric-contract-api-go/contractapi"
+)
+
+// Shipment is a commodity handed to a carrier but not yet received by its next owner.
+// During transit the upstream company remains the owner, and both companies must endorse any update of the commodity.
+type Shipment struct {
+	PutterOrg string    `json:"putterOrg"`
+	GetterOrg string    `json:"getterOrg"`
+	TxID      string    `json:"txId"`
+	ShippedAt time.Time `json:"shippedAt"`
+	Dispute   *Dispute  `json:"dispute"`
+	Payment   *Payment  `json:"payment,omitempty"` // Payment is the price paid at shipping, refunded if the shipment is cancelled
+}
+
+// Dispute is raised by either company of a shipment, e.g. when the goods are lost or damaged in transit
+type Dispute struct {
+	RaisedBy string    `json:"raisedBy"`
+	Reason   string    `json:"reason"`
+	TxID     string    `json:"txId"`
+	RaisedAt time.Time `json:"raisedAt"`
+}
+
+// ShipCommodity checks transfer conditions like TransferCommodity and then ships the commodity to the downstream company,
+// which becomes its owner once it confirms the receipt. The transferKey records and the agreed price are settled at shipping.
+// ShipCommodity can only be called by current owner
+func (s *SmartContract) ShipCommodity(ctx contractapi.TransactionContextInterface, commodityID string, downStreamOrgID string) error {
+	clientOrgID, err := getClientOrgID(ctx)
+	if err != nil {
+		return err
+	}
+
+	transferKeyJSON, err := getTransientInput(ctx, commodityTransferKeyInput)
+	if err != nil {
+		return err
+	}
+
+	agreement, err := parseAgreement(transferKeyJSON, commodityID)
+	if err != nil {
+		return err
+	}
+
+	commodity, err := s.ReadCommodity(ctx, commodityID)
+	if err != nil {
+		return fmt.Errorf("failed to get commodity: %v", err)
+	}
+
+	err = verifyTransferConditions(ctx, commodity, clientOrgID, downStreamOrgID, transferKeyJSON)
+	if err != nil {
+		return fmt.Errorf("failed transfer verification: %w", err)
+	}
+
+	err = transitionStatus(ctx, commodity, statusInTransit)
+	if err != nil {
+		return err
+	}
+
+	payment, err := payAgreedPrice(ctx, commodityID, clientOrgID, downStreamOrgID)
+	if err != nil {
+		return fmt.Errorf("failed payment of the agreed price: %w", err)
+	}
+
+	err = settleTransferAgreement(ctx, commodityID, clientOrgID, downStreamOrgID, agreement.TransferKey)
+	if err != nil {
+		return fmt.Errorf("failed commodity shipping: %v", err)
+	}
+
+	shippedAt, err := getTxTime(ctx)
+	if err != nil {
+		return err
+	}
+	commodity.Shipment = &Shipment{
+		PutterOrg: clientOrgID,
+		GetterOrg: downStreamOrgID,
+		TxID:      ctx.GetStub().GetTxID(),
+		ShippedAt: shippedAt,
+		Payment:   payment,
+	}
+	err = putCommodity(ctx, commodity)
+	if err != nil {
+		return err
+	}
+
+	// Both companies endorse the updates of the commodity until it is received
+	err = setCommodityStateBasedEndorsement(ctx, commodity)
+	if err != nil {
+		return fmt.Errorf("failed setting state based endorsement for shipment: %v", err)
+	}
+
+	return setCommodityEvent(ctx, eventCommodityShipped, CommodityEvent{
+		CommodityID: commodityID,
+		OwnerOrg:    clientOrgID,
+		PutterOrg:   clientOrgID,
+		GetterOrg:   downStreamOrgID,
+	})
+}
+
+// ConfirmReceipt completes the shipment of a commodity, the downstream company becomes its owner.
+// ConfirmReceipt can only be called by the downstream company, also when the shipment was disputed.
+func (s *SmartContract) ConfirmReceipt(ctx contractapi.TransactionContextInterface, commodityID string) error {
+	clientOrgID, err := getClientOrgID(ctx)
+	if err != nil {
+		return err
+	}
+
+	commodity, err := s.ReadCommodity(ctx, commodityID)
+	if err != nil {
+		return fmt.Errorf("failed to get commodity: %v", err)
+	}
+
+	shipment := commodity.Shipment
+	if shipment == nil {
+		return fmt.Errorf("commodity %s is not in transit", commodityID)
+	}
+	if clientOrgID != shipment.GetterOrg {
+		return &AuthorizationError{ClientOrg: clientOrgID, Action: fmt.Sprintf("confirm the receipt of a commodity shipped to %s", shipment.GetterOrg)}
+	}
+
+	err = transitionStatus(ctx, commodity, statusDelivered)
+	if err != nil {
+		return err
+	}
+
+	commodity.Shipment = nil
+	err = handOverCommodity(ctx, commodity, shipment.PutterOrg, shipment.GetterOrg)
+	if err != nil {
+		return fmt.Errorf("failed commodity transfer: %v", err)
+	}
+
+	return setCommodityEvent(ctx, eventCommodityReceived, CommodityEvent{
+		CommodityID: commodityID,
+		OwnerOrg:    clientOrgID,
+		PutterOrg:   shipment.PutterOrg,
+		GetterOrg:   shipment.GetterOrg,
+	})
+}
+
+// CancelShipment returns a commodity in transit to the upstream company, e.g. when it was refused or when a dispute was
+// settled that way, and refunds the downstream company the price it paid at shipping. The commodity goes back to the
+// status it had before shipping. Like any update during transit, both companies must endorse the cancellation.
+// CancelShipment can only be called by the upstream company, RetireCommodity retires a commodity lost in transit instead
+func (s *SmartContract) CancelShipment(ctx contractapi.TransactionContextInterface, commodityID string) error {
+	clientOrgID, err := getClientOrgID(ctx)
+	if err != nil {
+		return err
+	}
+
+	commodity, err := s.ReadCommodity(ctx, commodityID)
+	if err != nil {
+		return fmt.Errorf("failed to get commodity: %v", err)
+	}
+
+	shipment := commodity.Shipment
+	if shipment == nil {
+		return fmt.Errorf("commodity %s is not in transit", commodityID)
+	}
+	if clientOrgID != shipment.PutterOrg {
+		return &AuthorizationError{ClientOrg: clientOrgID, Action: fmt.Sprintf("cancel a shipment from %s", shipment.PutterOrg)}
+	}
+
+	// The status before shipping is the one derived from the source of the commodity without its shipment
+	returned := *commodity
+	returned.Shipment = nil
+	err = transitionStatus(ctx, commodity, deriveCommodityStatus(&returned))
+	if err != nil {
+		return err
+	}
+
+	err = cancelShipment(ctx, commodity)
+	if err != nil {
+		return err
+	}
+	err = putCommodity(ctx, commodity)
+	if err != nil {
+		return err
+	}
+
+	return setCommodityEvent(ctx, eventShipmentCancelled, CommodityEvent{
+		CommodityID: commodityID,
+		OwnerOrg:    clientOrgID,
+		PutterOrg:   shipment.PutterOrg,
+		GetterOrg:   shipment.GetterOrg,
+	})
+}
+
+// cancelShipment refunds the downstream company of a shipment, deletes its copy of the commodity properties and
+// makes the upstream company the only org endorsing updates of the commodity again. The caller writes the commodity.
+func cancelShipment(ctx contractapi.TransactionContextInterface, commodity *Commodity) error {
+	shipment := commodity.Shipment
+	if shipment.Payment != nil {
+		err := moveTokens(ctx, shipment.Payment.Currency, shipment.PutterOrg, shipment.GetterOrg, shipment.Payment.Amount)
+		if err != nil {
+			return fmt.Errorf("failed refund of the shipment: %w", err)
+		}
+	}
+
+	err := ctx.GetStub().DelPrivateData(buildCollectionName(shipment.GetterOrg), commodity.ID)
+	if err != nil {
+		return fmt.Errorf("failed to delete commodity private details from downstream: %v", err)
+	}
+
+	commodity.Shipment = nil
+	err = setCommodityStateBasedEndorsement(ctx, commodity)
+	if err != nil {
+		return fmt.Errorf("failed setting state based endorsement for cancelled shipment: %v", err)
+	}
+	return nil
+}
+
+// RaiseTransitDispute records a dispute about a commodity in transit, e.g. lost or damaged goods.
+// Either company of the shipment can raise it, once.
+func (s *SmartContract) RaiseTransitDispute(ctx contractapi.TransactionContextInterface, commodityID string, reason string) error {
+	clientOrgID, err := getClientOrgID(ctx)
+	if err != nil {
+		return err
+	}
+
+	if strings.TrimSpace(reason) == "" {
+		return fmt.Errorf("a dispute needs a reason")
+	}
+
+	commodity, err := s.ReadCommodity(ctx, commodityID)
+	if err != nil {
+		return fmt.Errorf("failed to get commodity: %v", err)
+	}
+
+	shipment := commodity.Shipment
+	if shipment == nil {
+		return fmt.Errorf("commodity %s is not in transit", commodityID)
+	}
+	if clientOrgID != shipment.PutterOrg && clientOrgID != shipment.GetterOrg {
+		return &AuthorizationError{ClientOrg: clientOrgID, Action: fmt.Sprintf("dispute a shipment from %s to %s", shipment.PutterOrg, shipment.GetterOrg)}
+	}
+	if shipment.Dispute != nil {
+		return fmt.Errorf("shipment of %s was already disputed by %s: %s", commodityID, shipment.Dispute.RaisedBy, shipment.Dispute.Reason)
+	}
+
+	raisedAt, err := getTxTime(ctx)
+	if err != nil {
+		return err
+	}
+	shipment.Dispute = &Dispute{
+		RaisedBy: clientOrgID,
+		Reason:   reason,
+		TxID:     ctx.GetStub().GetTxID(),
+		RaisedAt: raisedAt,
+	}
+	err = putCommodity(ctx, commodity)
+	if err != nil {
+		return err
+	}
+
+	return setCommodityEvent(ctx, eventTransitDisputed, CommodityEvent{
+		CommodityID: commodityID,
+		OwnerOrg:    commodity.OwnerOrg,
+		PutterOrg:   shipment.PutterOrg,
+		GetterOrg:   shipment.GetterOrg,
+	})
+}
+
+// verifyNotInTransit checks that a commodity is not being shipped to its next owner
+func verifyNotInTransit(commodity *Commodity) error {
+	if commodity.Shipment != nil {
+		return fmt.Errorf("commodity %s is in transit to %s", commodity.ID, commodity.Shipment.GetterOrg)
+	}
+	return nil
+}
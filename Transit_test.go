@@ -0,0 +1,218 @@
+package main
+
+import (
+	"errors"
+	"testing"
+
+	"SupplyChainTrackingChaincode/chaincodetest"
+
+	"github.com/hyperledger/fabric-contract-api-go/contractapi"
+)
+
+// shipCommodity agrees on the transfer of a commodity and ships it from the putter to the getter org
+func shipCommodity(t *testing.T, ledger *chaincodetest.Ledger, putter, getter chaincodetest.Identity, commodityID string) {
+	t.Helper()
+
+	agree(t, ledger, putter, getter, commodityID, palletProperties, transferKeyBetween(commodityID, putter.MSPID, getter.MSPID))
+	ctx := ledger.NewTransaction(putter).WithTransient("commodity_transferKey", transferKeyBetween(commodityID, putter.MSPID, getter.MSPID))
+	if err := newContract().ShipCommodity(ctx, commodityID, getter.MSPID); err != nil {
+		t.Fatalf("ShipCommodity: %v", err)
+	}
+	if err := ctx.Commit(); err != nil {
+		t.Fatalf("commit ShipCommodity: %v", err)
+	}
+}
+
+func TestShipAndConfirmReceipt(t *testing.T) {
+	ledger := chaincodetest.NewLedger()
+	s := newContract()
+	commodityID := createCommodity(t, ledger, org1Client, palletProperties)
+	shipCommodity(t, ledger, org1Client, org2Client, commodityID)
+
+	commodity, err := s.ReadCommodity(ledger.NewTransaction(org3Client), commodityID)
+	if err != nil {
+		t.Fatalf("ReadCommodity: %v", err)
+	}
+	if commodity.OwnerOrg != org1MSP || commodity.Shipment == nil || commodity.Shipment.GetterOrg != org2MSP {
+		t.Fatalf("commodity in transit = %+v", commodity)
+	}
+	policy, err := s.GetEndorsementPolicy(ledger.NewTransaction(org3Client), commodityID)
+	if err != nil || policy.Policy != "AND(Org1MSP.peer, Org2MSP.peer)" {
+		t.Errorf("policy in transit = %+v, %v", policy, err)
+	}
+
+	// The agreement was settled at shipping, the commodity cannot be offered again while in transit
+	receipt, err := s.GetReceipt(ledger.NewTransaction(org2Client), commodityID, commodity.Shipment.TxID)
+	if err != nil || receipt.TransferKey != secretOf(commodityID) {
+		t.Errorf("GetReceipt = %+v, %v", receipt, err)
+	}
+	ctx := ledger.NewTransaction(org1Client).WithTransient("commodity_transferKey", transferKeyOf(commodityID))
+	if err = s.AgreeToPut(ctx, commodityID); err == nil {
+		t.Error("AgreeToPut of a commodity in transit succeeded")
+	}
+
+	ctx = ledger.NewTransaction(org1Client)
+	var denied *AuthorizationError
+	if err = s.ConfirmReceipt(ctx, commodityID); !errors.As(err, &denied) {
+		t.Errorf("ConfirmReceipt by the putter: err = %v, want an AuthorizationError", err)
+	}
+
+	ctx = ledger.NewTransaction(org2Client)
+	if err = s.ConfirmReceipt(ctx, commodityID); err != nil {
+		t.Fatalf("ConfirmReceipt: %v", err)
+	}
+	if err = ctx.Commit(); err == nil {
+		t.Fatal("receipt confirmed without the endorsement of the putter")
+	}
+	ctx = ledger.NewTransaction(org2Client).EndorsedBy(org1MSP, org2MSP)
+	err = ctx.Endorse(func(ctx contractapi.TransactionContextInterface) error {
+		return s.ConfirmReceipt(ctx, commodityID)
+	})
+	if err != nil {
+		t.Fatalf("ConfirmReceipt: %v", err)
+	}
+	if err = ctx.Commit(); err != nil {
+		t.Fatalf("commit ConfirmReceipt: %v", err)
+	}
+
+	commodity, err = s.ReadCommodity(ledger.NewTransaction(org3Client), commodityID)
+	if err != nil {
+		t.Fatalf("ReadCommodity: %v", err)
+	}
+	if commodity.OwnerOrg != org2MSP || commodity.Source != org1MSP || commodity.Shipment != nil {
+		t.Errorf("received commodity = %+v", commodity)
+	}
+	if ledger.PrivateData(buildCollectionName(org1MSP), commodityID) != nil {
+		t.Error("commodity properties were not deleted from the upstream collection")
+	}
+	if event := ctx.Stub().Event(); event == nil || event.Name != eventCommodityReceived {
+		t.Errorf("event = %+v", event)
+	}
+}
+
+func TestRaiseTransitDispute(t *testing.T) {
+	ledger := chaincodetest.NewLedger()
+	s := newContract()
+	commodityID := createCommodity(t, ledger, org1Client, palletProperties)
+
+	ctx := ledger.NewTransaction(org1Client)
+	if err := s.RaiseTransitDispute(ctx, commodityID, "lost"); err == nil {
+		t.Error("dispute of a commodity that is not in transit succeeded")
+	}
+
+	shipCommodity(t, ledger, org1Client, org2Client, commodityID)
+
+	ctx = ledger.NewTransaction(org3Client)
+	var denied *AuthorizationError
+	if err := s.RaiseTransitDispute(ctx, commodityID, "lost"); !errors.As(err, &denied) {
+		t.Errorf("dispute by a third org: err = %v, want an AuthorizationError", err)
+	}
+
+	ctx = ledger.NewTransaction(org2Client).EndorsedBy(org1MSP, org2MSP)
+	err := ctx.Endorse(func(ctx contractapi.TransactionContextInterface) error {
+		return s.RaiseTransitDispute(ctx, commodityID, "lost")
+	})
+	if err != nil {
+		t.Fatalf("RaiseTransitDispute: %v", err)
+	}
+	if err = ctx.Commit(); err != nil {
+		t.Fatalf("commit RaiseTransitDispute: %v", err)
+	}
+
+	commodity, err := s.ReadCommodity(ledger.NewTransaction(org3Client), commodityID)
+	if err != nil {
+		t.Fatalf("ReadCommodity: %v", err)
+	}
+	if dispute := commodity.Shipment.Dispute; dispute == nil || dispute.RaisedBy != org2MSP || dispute.Reason != "lost" {
+		t.Errorf("dispute = %+v", dispute)
+	}
+
+	ctx = ledger.NewTransaction(org1Client)
+	if err = s.RaiseTransitDispute(ctx, commodityID, "damaged"); err == nil {
+		t.Error("second dispute succeeded")
+	}
+}
+
+func TestCancelShipment(t *testing.T) {
+	ledger := chaincodetest.NewLedger()
+	s := newContract()
+	commodityID := agreeOnTerms(t, ledger)
+	fund(t, ledger, org2MSP, "EUR", 44000)
+
+	ctx := ledger.NewTransaction(org1Client).
+		WithTransient("commodity_transferKey", transferKeyOf(commodityID)).
+		WithTransient("commodity_terms", []byte(counterTerms)).
+		EndorsedBy(org1MSP, org2MSP)
+	err := ctx.Endorse(func(ctx contractapi.TransactionContextInterface) error {
+		return s.ShipCommodity(ctx, commodityID, org2MSP)
+	})
+	if err != nil {
+		t.Fatalf("ShipCommodity: %v", err)
+	}
+	if err = ctx.Commit(); err != nil {
+		t.Fatalf("commit ShipCommodity: %v", err)
+	}
+
+	var denied *AuthorizationError
+	if err := s.CancelShipment(ledger.NewTransaction(org2Client), commodityID); !errors.As(err, &denied) {
+		t.Errorf("CancelShipment by the getter: err = %v, want an AuthorizationError", err)
+	}
+
+	ctx = ledger.NewTransaction(org1Client).EndorsedBy(org1MSP, org2MSP)
+	err = ctx.Endorse(func(ctx contractapi.TransactionContextInterface) error {
+		return s.CancelShipment(ctx, commodityID)
+	})
+	if err != nil {
+		t.Fatalf("CancelShipment: %v", err)
+	}
+	if err = ctx.Commit(); err != nil {
+		t.Fatalf("commit CancelShipment: %v", err)
+	}
+
+	commodity, err := s.ReadCommodity(ledger.NewTransaction(org3Client), commodityID)
+	if err != nil || commodity.OwnerOrg != org1MSP || commodity.Shipment != nil || commodity.Status != statusCreated {
+		t.Errorf("commodity after CancelShipment = %+v, %v", commodity, err)
+	}
+	if ledger.PrivateData(buildCollectionName(org2MSP), commodityID) != nil {
+		t.Error("getter still holds the properties of the cancelled shipment")
+	}
+	if balance := balanceOf(t, ledger, org2MSP, "EUR"); balance != 44000 {
+		t.Errorf("balance of the getter after the refund = %d, want 44000", balance)
+	}
+	policy, err := s.GetEndorsementPolicy(ledger.NewTransaction(org3Client), commodityID)
+	if err != nil || policy.Policy != "Org1MSP.peer" {
+		t.Errorf("policy after CancelShipment = %+v, %v", policy, err)
+	}
+	if events := ledger.Events(); events[len(events)-1].Name != eventShipmentCancelled {
+		t.Errorf("last event = %s", events[len(events)-1].Name)
+	}
+}
+
+func TestRetireCommodityLostInTransit(t *testing.T) {
+	ledger := chaincodetest.NewLedger()
+	s := newContract()
+	commodityID := createCommodity(t, ledger, org1Client, palletProperties)
+	shipCommodity(t, ledger, org1Client, org2Client, commodityID)
+
+	ctx := ledger.NewTransaction(org1Client).EndorsedBy(org1MSP, org2MSP)
+	err := ctx.Endorse(func(ctx contractapi.TransactionContextInterface) error {
+		return s.RetireCommodity(ctx, commodityID, "lost in transit")
+	})
+	if err != nil {
+		t.Fatalf("RetireCommodity: %v", err)
+	}
+	if err = ctx.Commit(); err != nil {
+		t.Fatalf("commit RetireCommodity: %v", err)
+	}
+
+	commodity, err := s.ReadCommodity(ledger.NewTransaction(org3Client), commodityID)
+	if err != nil || commodity.Status != statusDestroyed || commodity.Shipment != nil {
+		t.Errorf("commodity retired in transit = %+v, %v", commodity, err)
+	}
+	if ledger.PrivateData(buildCollectionName(org2MSP), commodityID) != nil {
+		t.Error("getter still holds the properties of the lost commodity")
+	}
+	if receipt, err := s.GetRetirementReceipt(ledger.NewTransaction(org1Client), commodityID); err != nil || receipt.Reason != "lost in transit" {
+		t.Errorf("retirement receipt = %+v, %v", receipt, err)
+	}
+}
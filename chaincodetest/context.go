@@ -0,0 +1,184 @@
+package chaincodetest
+
+import (
+	"crypto/x509"
+	"errors"
+	"fmt"
+
+	"github.com/hyperledger/fabric-chaincode-go/pkg/cid"
+	"github.com/hyperledger/fabric-chaincode-go/shim"
+	"github.com/hyperledger/fabric-contract-api-go/contractapi"
+)
+
+// Identity describes the client submitting a transaction
+type Identity struct {
+	MSPID      string
+	ID         string
+	Attributes map[string]string
+}
+
+// ClientIdentity is the cid.ClientIdentity of a transaction submitted by an Identity
+type ClientIdentity struct {
+	identity Identity
+}
+
+// GetID returns the ID of the client, or an ID derived from its MSP ID if none was set
+func (ci *ClientIdentity) GetID() (string, error) {
+	if ci.identity.ID == "" {
+		return fmt.Sprintf("x509::CN=client,O=%s", ci.identity.MSPID), nil
+	}
+	return ci.identity.ID, nil
+}
+
+// GetMSPID returns the MSP ID of the client
+func (ci *ClientIdentity) GetMSPID() (string, error) {
+	if ci.identity.MSPID == "" {
+		return "", errors.New("client identity has no MSP ID")
+	}
+	return ci.identity.MSPID, nil
+}
+
+// GetAttributeValue returns the value of an attribute of the client
+func (ci *ClientIdentity) GetAttributeValue(attrName string) (string, bool, error) {
+	value, found := ci.identity.Attributes[attrName]
+	return value, found, nil
+}
+
+// AssertAttributeValue checks that the client has an attribute with the given value
+func (ci *ClientIdentity) AssertAttributeValue(attrName, attrValue string) error {
+	value, found := ci.identity.Attributes[attrName]
+	if !found {
+		return fmt.Errorf("attribute '%s' was not found", attrName)
+	}
+	if value != attrValue {
+		return fmt.Errorf("attribute '%s' equals '%s', not '%s'", attrName, value, attrValue)
+	}
+	return nil
+}
+
+// GetX509Certificate is not supported, the fake identities have no certificate
+func (ci *ClientIdentity) GetX509Certificate() (*x509.Certificate, error) {
+	return nil, errors.New("client identity has no X509 certificate")
+}
+
+// PeerIdentity resolves the org of the peer simulating a transaction started by Ledger.NewTransaction,
+// to be used as the peer identity provider of the chaincode under test
+type PeerIdentity struct{}
+
+// GetPeerMSPID returns the org of the peer simulating the transaction
+func (PeerIdentity) GetPeerMSPID(ctx contractapi.TransactionContextInterface) (string, error) {
+	txCtx, ok := ctx.(*TransactionContext)
+	if !ok {
+		return "", fmt.Errorf("transaction context %T was not started by a chaincodetest ledger", ctx)
+	}
+	return txCtx.peerMSPID, nil
+}
+
+// TransactionContext implements contractapi.TransactionContextInterface for a simulated transaction
+type TransactionContext struct {
+	ledger    *Ledger
+	stub      *Stub
+	identity  *ClientIdentity
+	peerMSPID string
+	endorsers []string
+	endorsed  bool
+	committed bool
+}
+
+// GetStub returns the stub of the transaction
+func (ctx *TransactionContext) GetStub() shim.ChaincodeStubInterface {
+	return ctx.stub
+}
+
+// GetClientIdentity returns the identity of the client submitting the transaction
+func (ctx *TransactionContext) GetClientIdentity() cid.ClientIdentity {
+	return ctx.identity
+}
+
+// Stub returns the fake stub of the transaction, to set its inputs and inspect its outputs
+func (ctx *TransactionContext) Stub() *Stub {
+	return ctx.stub
+}
+
+// PeerMSPID returns the org of the peer simulating the transaction
+func (ctx *TransactionContext) PeerMSPID() string {
+	return ctx.peerMSPID
+}
+
+// OnPeer simulates the transaction on a peer of another org, which becomes the only endorser
+func (ctx *TransactionContext) OnPeer(mspID string) *TransactionContext {
+	ctx.peerMSPID = mspID
+	ctx.stub.peerMSPID = mspID
+	ctx.endorsers = []string{mspID}
+	return ctx
+}
+
+// EndorsedBy sets the orgs whose peers endorse the transaction.
+// A transaction endorsed by other orgs than the one of its peer must be simulated with Endorse.
+func (ctx *TransactionContext) EndorsedBy(mspIDs ...string) *TransactionContext {
+	ctx.endorsers = mspIDs
+	return ctx
+}
+
+// Endorse simulates the transaction by calling tx on the peer of every endorsing org, like the client collecting
+// endorsements does, and fails unless every peer succeeds with the same write set. Commit then applies that write set.
+func (ctx *TransactionContext) Endorse(tx func(contractapi.TransactionContextInterface) error) error {
+	var endorsement *Stub
+	for _, mspID := range ctx.endorsers {
+		peerCtx := &TransactionContext{
+			ledger:    ctx.ledger,
+			stub:      ctx.stub.onPeer(mspID),
+			identity:  ctx.identity,
+			peerMSPID: mspID,
+			endorsers: ctx.endorsers,
+		}
+		err := tx(peerCtx)
+		if err != nil {
+			return fmt.Errorf("peer of %s failed to endorse transaction %s: %w", mspID, ctx.stub.txID, err)
+		}
+
+		if endorsement == nil {
+			endorsement = peerCtx.stub
+		} else if !endorsement.sameWriteSet(peerCtx.stub) {
+			return fmt.Errorf("peers of %s and %s endorsed different write sets for transaction %s", ctx.endorsers[0], mspID, ctx.stub.txID)
+		}
+	}
+
+	if endorsement != nil {
+		ctx.stub = endorsement
+		ctx.peerMSPID = endorsement.peerMSPID
+	}
+	ctx.endorsed = true
+	return nil
+}
+
+// WithTransient adds a value to the transient map of the transaction
+func (ctx *TransactionContext) WithTransient(key string, value []byte) *TransactionContext {
+	ctx.stub.transient[key] = value
+	return ctx
+}
+
+// WithFunction sets the function name and arguments of the transaction proposal
+func (ctx *TransactionContext) WithFunction(name string, args ...string) *TransactionContext {
+	ctx.stub.function = name
+	ctx.stub.args = args
+	return ctx
+}
+
+// Commit validates the endorsement policies of the written keys and applies the write set to the ledger
+func (ctx *TransactionContext) Commit() error {
+	if ctx.committed {
+		return fmt.Errorf("transaction %s was already committed", ctx.stub.txID)
+	}
+	ctx.committed = true
+
+	if !ctx.endorsed {
+		for _, mspID := range ctx.endorsers {
+			if mspID != ctx.peerMSPID {
+				return fmt.Errorf("transaction %s was only simulated on the peer of %s, use Endorse to simulate it on the peer of %s", ctx.stub.txID, ctx.peerMSPID, mspID)
+			}
+		}
+	}
+
+	return ctx.ledger.commit(ctx.stub, ctx.endorsers)
+}
@@ -0,0 +1,264 @@
+// Package chaincodetest provides an in-memory fake of the Fabric peer APIs used by the chaincode,
+// so that transactions can be unit tested without a network.
+//
+// A Ledger is shared by every org of the simulated channel. Each call to NewTransaction returns a
+// TransactionContext whose Stub simulates the transaction on the peer of an org: reads see the committed
+// state only, and writes are applied to the ledger by Commit once the state-based endorsement policies of
+// the written keys are satisfied by the endorsing orgs. A transaction endorsed by several orgs is simulated
+// on the peer of each of them by Endorse. The chaincode learns the org of the simulating peer through PeerIdentity.
+package chaincodetest
+
+import (
+	"crypto/sha256"
+	"encoding/hex"
+	"fmt"
+	"sort"
+	"strings"
+	"time"
+
+	"github.com/golang/protobuf/proto"
+	"github.com/golang/protobuf/ptypes"
+	"github.com/hyperledger/fabric-protos-go/common"
+	"github.com/hyperledger/fabric-protos-go/ledger/queryresult"
+	"github.com/hyperledger/fabric-protos-go/msp"
+)
+
+// implicitCollectionPrefix is the prefix of the implicit private data collection of every org
+const implicitCollectionPrefix = "_implicit_org_"
+
+// Event is a chaincode event set by a committed transaction
+type Event struct {
+	TxID    string
+	Name    string
+	Payload []byte
+}
+
+// Ledger is the committed state of an in-memory channel
+type Ledger struct {
+	state             map[string][]byte
+	validation        map[string][]byte
+	history           map[string][]*queryresult.KeyModification
+	private           map[string]map[string][]byte
+	privateValidation map[string]map[string][]byte
+	collections       map[string][]string
+	events            []Event
+	now               time.Time
+	txCount           int
+}
+
+// NewLedger returns an empty ledger whose clock starts at a fixed date
+func NewLedger() *Ledger {
+	return &Ledger{
+		state:             make(map[string][]byte),
+		validation:        make(map[string][]byte),
+		history:           make(map[string][]*queryresult.KeyModification),
+		private:           make(map[string]map[string][]byte),
+		privateValidation: make(map[string]map[string][]byte),
+		collections:       make(map[string][]string),
+		now:               time.Date(2022, time.January, 1, 0, 0, 0, 0, time.UTC),
+	}
+}
+
+// DefineCollection declares an explicit private data collection and the orgs that are members of it.
+// Implicit org collections never need to be declared.
+func (l *Ledger) DefineCollection(name string, memberMSPIDs ...string) {
+	l.collections[name] = memberMSPIDs
+}
+
+// Now returns the timestamp that the next transaction will get
+func (l *Ledger) Now() time.Time {
+	return l.now
+}
+
+// Advance moves the clock of the ledger forward
+func (l *Ledger) Advance(d time.Duration) {
+	l.now = l.now.Add(d)
+}
+
+// State returns the committed public value of a key
+func (l *Ledger) State(key string) []byte {
+	return l.state[key]
+}
+
+// PrivateData returns the committed value of a key in a private data collection
+func (l *Ledger) PrivateData(collection, key string) []byte {
+	return l.private[collection][key]
+}
+
+// ValidationParameter returns the committed state-based endorsement policy of a key
+func (l *Ledger) ValidationParameter(key string) []byte {
+	return l.validation[key]
+}
+
+// Events returns the events of all committed transactions in commit order
+func (l *Ledger) Events() []Event {
+	return l.events
+}
+
+// NewTransaction starts the simulation of a transaction submitted by client on a peer of the client's org,
+// which is also the only endorser. Use OnPeer, or EndorsedBy and Endorse, to simulate other setups.
+func (l *Ledger) NewTransaction(client Identity) *TransactionContext {
+	l.txCount++
+	txHash := sha256.Sum256([]byte(fmt.Sprintf("tx-%d", l.txCount)))
+
+	ctx := &TransactionContext{
+		ledger:   l,
+		identity: &ClientIdentity{identity: client},
+	}
+	ctx.stub = newStub(l, hex.EncodeToString(txHash[:]), l.now)
+	ctx.OnPeer(client.MSPID)
+
+	// every transaction gets a distinct timestamp
+	l.now = l.now.Add(time.Second)
+
+	return ctx
+}
+
+// isMember tells whether an org is a member of a private data collection
+func (l *Ledger) isMember(collection, mspID string) bool {
+	if members, ok := l.collections[collection]; ok {
+		for _, member := range members {
+			if member == mspID {
+				return true
+			}
+		}
+		return false
+	}
+
+	return collection == implicitCollectionPrefix+mspID
+}
+
+// commit validates the write set of a simulated transaction against the endorsing orgs and applies it
+func (l *Ledger) commit(stub *Stub, endorsers []string) error {
+	for _, key := range sortedKeys(stub.writes) {
+		err := satisfiesPolicy(l.validation[key], endorsers)
+		if err != nil {
+			return fmt.Errorf("endorsement policy failure for key %q: %v", key, err)
+		}
+	}
+	for _, key := range sortedKeys(stub.validationWrites) {
+		err := satisfiesPolicy(l.validation[key], endorsers)
+		if err != nil {
+			return fmt.Errorf("endorsement policy failure for validation parameter of key %q: %v", key, err)
+		}
+	}
+	for collection, writes := range stub.privateWrites {
+		for _, key := range sortedKeys(writes) {
+			err := satisfiesPolicy(l.privateValidation[collection][key], endorsers)
+			if err != nil {
+				return fmt.Errorf("endorsement policy failure for key %q of collection %s: %v", key, collection, err)
+			}
+		}
+	}
+
+	timestamp, err := ptypes.TimestampProto(stub.timestamp)
+	if err != nil {
+		return err
+	}
+
+	for key, value := range stub.writes {
+		if value == nil {
+			delete(l.state, key)
+		} else {
+			l.state[key] = value
+		}
+		l.history[key] = append(l.history[key], &queryresult.KeyModification{
+			TxId:      stub.txID,
+			Value:     value,
+			Timestamp: timestamp,
+			IsDelete:  value == nil,
+		})
+	}
+	for key, policy := range stub.validationWrites {
+		l.validation[key] = policy
+	}
+	for collection, writes := range stub.privateWrites {
+		if l.private[collection] == nil {
+			l.private[collection] = make(map[string][]byte)
+		}
+		for key, value := range writes {
+			if value == nil {
+				delete(l.private[collection], key)
+			} else {
+				l.private[collection][key] = value
+			}
+		}
+	}
+	for collection, writes := range stub.privateValidationWrites {
+		if l.privateValidation[collection] == nil {
+			l.privateValidation[collection] = make(map[string][]byte)
+		}
+		for key, policy := range writes {
+			l.privateValidation[collection][key] = policy
+		}
+	}
+	if stub.event != nil {
+		l.events = append(l.events, *stub.event)
+	}
+
+	return nil
+}
+
+// satisfiesPolicy checks that the endorsing orgs satisfy a state-based endorsement policy, including N out of M rules.
+// The endorsement of an org satisfies every principal of the org whatever its role, and may count for several principals.
+// Keys without a policy fall back to the chaincode policy, which any single org satisfies.
+func satisfiesPolicy(policy []byte, endorsers []string) error {
+	if policy == nil {
+		return nil
+	}
+
+	envelope := &common.SignaturePolicyEnvelope{}
+	err := proto.Unmarshal(policy, envelope)
+	if err != nil {
+		return fmt.Errorf("failed to unmarshal endorsement policy: %v", err)
+	}
+
+	var orgs []string
+	for _, principal := range envelope.GetIdentities() {
+		role := &msp.MSPRole{}
+		err = proto.Unmarshal(principal.GetPrincipal(), role)
+		if err != nil {
+			return fmt.Errorf("failed to unmarshal principal: %v", err)
+		}
+		orgs = append(orgs, role.GetMspIdentifier())
+	}
+
+	if !satisfiesRule(envelope.GetRule(), orgs, endorsers) {
+		return fmt.Errorf("policy over [%s] is not satisfied by the endorsements of [%s]", strings.Join(orgs, ", "), strings.Join(endorsers, ", "))
+	}
+	return nil
+}
+
+// satisfiesRule evaluates a signature policy rule, whose principals are the orgs of the policy
+func satisfiesRule(rule *common.SignaturePolicy, orgs []string, endorsers []string) bool {
+	if nOutOf := rule.GetNOutOf(); nOutOf != nil {
+		satisfied := int32(0)
+		for _, subRule := range nOutOf.GetRules() {
+			if satisfiesRule(subRule, orgs, endorsers) {
+				satisfied++
+			}
+		}
+		return satisfied >= nOutOf.GetN()
+	}
+
+	signedBy := rule.GetSignedBy()
+	return int(signedBy) < len(orgs) && contains(endorsers, orgs[signedBy])
+}
+
+func contains(values []string, value string) bool {
+	for _, v := range values {
+		if v == value {
+			return true
+		}
+	}
+	return false
+}
+
+func sortedKeys(m map[string][]byte) []string {
+	keys := make([]string, 0, len(m))
+	for key := range m {
+		keys = append(keys, key)
+	}
+	sort.Strings(keys)
+	return keys
+}
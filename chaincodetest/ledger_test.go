@@ -0,0 +1,170 @@
+package chaincodetest
+
+import (
+	"bytes"
+	"crypto/sha256"
+	"strings"
+	"testing"
+
+	"github.com/hyperledger/fabric-chaincode-go/pkg/statebased"
+	"github.com/hyperledger/fabric-contract-api-go/contractapi"
+)
+
+func TestCommitEnforcesStateBasedEndorsement(t *testing.T) {
+	ledger := NewLedger()
+	org1 := Identity{MSPID: "Org1MSP"}
+	org2 := Identity{MSPID: "Org2MSP"}
+
+	policy, err := statebased.NewStateEP(nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err = policy.AddOrgs(statebased.RoleTypePeer, org1.MSPID); err != nil {
+		t.Fatal(err)
+	}
+	policyBytes, err := policy.Policy()
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	ctx := ledger.NewTransaction(org1)
+	_ = ctx.GetStub().PutState("key", []byte("v1"))
+	_ = ctx.GetStub().SetStateValidationParameter("key", policyBytes)
+	if err = ctx.Commit(); err != nil {
+		t.Fatalf("commit: %v", err)
+	}
+
+	ctx = ledger.NewTransaction(org2)
+	_ = ctx.GetStub().PutState("key", []byte("v2"))
+	if err = ctx.Commit(); err == nil {
+		t.Fatal("commit succeeded without the endorsement of Org1MSP")
+	}
+	if value := ledger.State("key"); string(value) != "v1" {
+		t.Errorf("state = %s, want v1", value)
+	}
+
+	ctx = ledger.NewTransaction(org2).EndorsedBy(org1.MSPID, org2.MSPID)
+	_ = ctx.GetStub().PutState("key", []byte("v2"))
+	if err = ctx.Commit(); err == nil {
+		t.Fatal("commit succeeded without simulating the transaction on the peer of Org1MSP")
+	}
+
+	ctx = ledger.NewTransaction(org2).EndorsedBy(org1.MSPID, org2.MSPID)
+	err = ctx.Endorse(func(ctx contractapi.TransactionContextInterface) error {
+		return ctx.GetStub().PutState("key", []byte("v2"))
+	})
+	if err != nil {
+		t.Fatalf("Endorse: %v", err)
+	}
+	if err = ctx.Commit(); err != nil {
+		t.Fatalf("commit endorsed by both orgs: %v", err)
+	}
+}
+
+func TestEndorseSimulatesOnEveryEndorser(t *testing.T) {
+	ledger := NewLedger()
+	org1 := Identity{MSPID: "Org1MSP"}
+	collection := implicitCollectionPrefix + org1.MSPID
+
+	ctx := ledger.NewTransaction(org1)
+	_ = ctx.GetStub().PutPrivateData(collection, "key", []byte("secret"))
+	if err := ctx.Commit(); err != nil {
+		t.Fatalf("commit: %v", err)
+	}
+
+	// The peer of Org2MSP cannot read the collection of Org1MSP
+	ctx = ledger.NewTransaction(org1).EndorsedBy(org1.MSPID, "Org2MSP")
+	err := ctx.Endorse(func(ctx contractapi.TransactionContextInterface) error {
+		value, err := ctx.GetStub().GetPrivateData(collection, "key")
+		if err != nil {
+			return err
+		}
+		return ctx.GetStub().PutState("key", value)
+	})
+	if err == nil || !strings.Contains(err.Error(), "Org2MSP") {
+		t.Errorf("Endorse reading a collection of another org: err = %v", err)
+	}
+
+	// Peers writing different values do not endorse the same transaction
+	ctx = ledger.NewTransaction(org1).EndorsedBy(org1.MSPID, "Org2MSP")
+	err = ctx.Endorse(func(ctx contractapi.TransactionContextInterface) error {
+		peerMSPID, _ := PeerIdentity{}.GetPeerMSPID(ctx)
+		return ctx.GetStub().PutState("key", []byte(peerMSPID))
+	})
+	if err == nil {
+		t.Error("Endorse accepted different write sets")
+	}
+}
+
+func TestPrivateDataVisibility(t *testing.T) {
+	ledger := NewLedger()
+	org1 := Identity{MSPID: "Org1MSP"}
+	org2 := Identity{MSPID: "Org2MSP"}
+	collection := implicitCollectionPrefix + org1.MSPID
+
+	ctx := ledger.NewTransaction(org1)
+	_ = ctx.GetStub().PutPrivateData(collection, "key", []byte("secret"))
+	if value, _ := ctx.GetStub().GetPrivateData(collection, "key"); value != nil {
+		t.Error("uncommitted private data is visible to its own transaction")
+	}
+	if err := ctx.Commit(); err != nil {
+		t.Fatalf("commit: %v", err)
+	}
+
+	ctx = ledger.NewTransaction(org2)
+	if _, err := ctx.GetStub().GetPrivateData(collection, "key"); err == nil {
+		t.Error("peer of Org2MSP read the implicit collection of Org1MSP")
+	}
+	hash, err := ctx.GetStub().GetPrivateDataHash(collection, "key")
+	if want := sha256.Sum256([]byte("secret")); err != nil || !bytes.Equal(hash, want[:]) {
+		t.Errorf("GetPrivateDataHash = %x, %v, want %x", hash, err, want)
+	}
+}
+
+func TestCompositeKeys(t *testing.T) {
+	ledger := NewLedger()
+	ctx := ledger.NewTransaction(Identity{MSPID: "Org1MSP"})
+	stub := ctx.GetStub()
+
+	for _, id := range []string{"b", "a", "c"} {
+		key, err := stub.CreateCompositeKey("T", []string{id, "x"})
+		if err != nil {
+			t.Fatal(err)
+		}
+		_ = stub.PutState(key, []byte(id))
+	}
+	_ = stub.PutState("simple", []byte("simple"))
+	if err := ctx.Commit(); err != nil {
+		t.Fatal(err)
+	}
+
+	stub = ledger.NewTransaction(Identity{MSPID: "Org1MSP"}).GetStub()
+	iterator, metadata, err := stub.GetStateByPartialCompositeKeyWithPagination("T", nil, 2, "")
+	if err != nil {
+		t.Fatal(err)
+	}
+	var ids []string
+	for iterator.HasNext() {
+		kv, _ := iterator.Next()
+		objectType, attributes, err := stub.SplitCompositeKey(kv.Key)
+		if err != nil || objectType != "T" || len(attributes) != 2 {
+			t.Fatalf("SplitCompositeKey(%q) = %s, %v, %v", kv.Key, objectType, attributes, err)
+		}
+		ids = append(ids, attributes[0])
+	}
+	if len(ids) != 2 || ids[0] != "a" || ids[1] != "b" || metadata.Bookmark == "" {
+		t.Fatalf("first page = %v, bookmark %q", ids, metadata.Bookmark)
+	}
+
+	iterator, metadata, _ = stub.GetStateByPartialCompositeKeyWithPagination("T", nil, 2, metadata.Bookmark)
+	kv, _ := iterator.Next()
+	if string(kv.Value) != "c" || iterator.HasNext() || metadata.Bookmark != "" {
+		t.Errorf("second page starts with %s, bookmark %q", kv.Value, metadata.Bookmark)
+	}
+
+	iterator, _ = stub.GetStateByRange("", "")
+	kv, _ = iterator.Next()
+	if kv.Key != "simple" || iterator.HasNext() {
+		t.Error("range query returned composite keys")
+	}
+}
@@ -0,0 +1,491 @@
+package chaincodetest
+
+import (
+	"crypto/sha256"
+	"errors"
+	"fmt"
+	"reflect"
+	"sort"
+	"strings"
+	"time"
+	"unicode/utf8"
+
+	"github.com/golang/protobuf/ptypes"
+	"github.com/golang/protobuf/ptypes/timestamp"
+	"github.com/hyperledger/fabric-chaincode-go/shim"
+	"github.com/hyperledger/fabric-protos-go/ledger/queryresult"
+	pb "github.com/hyperledger/fabric-protos-go/peer"
+)
+
+const (
+	compositeKeyNamespace = "\x00"
+	minUnicodeRuneValue   = 0
+	maxUnicodeRuneValue   = utf8.MaxRune
+	// emptyKeySubstitute replaces an empty start key of a range query so that composite keys are not part of it
+	emptyKeySubstitute = "\x01"
+)
+
+// errRichQueryNotSupported is returned by rich queries, the fake ledger behaves like a LevelDB state database
+var errRichQueryNotSupported = errors.New("ExecuteQuery not supported for leveldb")
+
+// Stub implements shim.ChaincodeStubInterface for a transaction simulated on a peer of a Ledger.
+// A nil value in a write set records a deletion.
+type Stub struct {
+	ledger    *Ledger
+	txID      string
+	timestamp time.Time
+	peerMSPID string
+	function  string
+	args      []string
+	transient map[string][]byte
+	event     *Event
+
+	writes                  map[string][]byte
+	validationWrites        map[string][]byte
+	privateWrites           map[string]map[string][]byte
+	privateValidationWrites map[string]map[string][]byte
+}
+
+var _ shim.ChaincodeStubInterface = (*Stub)(nil)
+
+func newStub(ledger *Ledger, txID string, txTime time.Time) *Stub {
+	return &Stub{
+		ledger:                  ledger,
+		txID:                    txID,
+		timestamp:               txTime,
+		transient:               make(map[string][]byte),
+		writes:                  make(map[string][]byte),
+		validationWrites:        make(map[string][]byte),
+		privateWrites:           make(map[string]map[string][]byte),
+		privateValidationWrites: make(map[string]map[string][]byte),
+	}
+}
+
+// onPeer returns a stub simulating the same proposal on the peer of another org, with an empty write set
+func (s *Stub) onPeer(mspID string) *Stub {
+	stub := newStub(s.ledger, s.txID, s.timestamp)
+	stub.peerMSPID = mspID
+	stub.function = s.function
+	stub.args = s.args
+	stub.transient = s.transient
+	return stub
+}
+
+// sameWriteSet tells whether two simulations of a proposal produced the same writes and event.
+// Private writes are compared by value, which is the same as comparing the hashes that peers sign.
+func (s *Stub) sameWriteSet(other *Stub) bool {
+	return reflect.DeepEqual(s.writes, other.writes) &&
+		reflect.DeepEqual(s.validationWrites, other.validationWrites) &&
+		reflect.DeepEqual(s.privateWrites, other.privateWrites) &&
+		reflect.DeepEqual(s.privateValidationWrites, other.privateValidationWrites) &&
+		reflect.DeepEqual(s.event, other.event)
+}
+
+// Event returns the event set by the transaction, if any
+func (s *Stub) Event() *Event {
+	return s.event
+}
+
+// Writes returns the public write set of the transaction
+func (s *Stub) Writes() map[string][]byte {
+	return s.writes
+}
+
+// GetArgs returns the function name and arguments of the proposal
+func (s *Stub) GetArgs() [][]byte {
+	args := [][]byte{[]byte(s.function)}
+	for _, arg := range s.args {
+		args = append(args, []byte(arg))
+	}
+	return args
+}
+
+// GetStringArgs returns the function name and arguments of the proposal
+func (s *Stub) GetStringArgs() []string {
+	return append([]string{s.function}, s.args...)
+}
+
+// GetFunctionAndParameters returns the function name and arguments of the proposal
+func (s *Stub) GetFunctionAndParameters() (string, []string) {
+	return s.function, s.args
+}
+
+// GetArgsSlice returns the arguments of the proposal concatenated
+func (s *Stub) GetArgsSlice() ([]byte, error) {
+	var argsSlice []byte
+	for _, arg := range s.GetArgs() {
+		argsSlice = append(argsSlice, arg...)
+	}
+	return argsSlice, nil
+}
+
+// GetTxID returns the transaction ID
+func (s *Stub) GetTxID() string {
+	return s.txID
+}
+
+// GetChannelID returns the name of the simulated channel
+func (s *Stub) GetChannelID() string {
+	return "mychannel"
+}
+
+// InvokeChaincode is not supported
+func (s *Stub) InvokeChaincode(chaincodeName string, args [][]byte, channel string) pb.Response {
+	return pb.Response{Status: shim.ERROR, Message: "chaincode to chaincode invocation is not supported"}
+}
+
+// GetState returns the committed value of a key, writes of the transaction itself are not visible
+func (s *Stub) GetState(key string) ([]byte, error) {
+	return s.ledger.state[key], nil
+}
+
+// PutState adds a key to the write set
+func (s *Stub) PutState(key string, value []byte) error {
+	if key == "" {
+		return errors.New("key must not be an empty string")
+	}
+	s.writes[key] = append([]byte{}, value...)
+	return nil
+}
+
+// DelState adds the deletion of a key to the write set
+func (s *Stub) DelState(key string) error {
+	s.writes[key] = nil
+	return nil
+}
+
+// SetStateValidationParameter sets the state-based endorsement policy of a key
+func (s *Stub) SetStateValidationParameter(key string, ep []byte) error {
+	s.validationWrites[key] = ep
+	return nil
+}
+
+// GetStateValidationParameter returns the committed state-based endorsement policy of a key
+func (s *Stub) GetStateValidationParameter(key string) ([]byte, error) {
+	return s.ledger.validation[key], nil
+}
+
+// GetStateByRange returns the committed simple keys in [startKey, endKey)
+func (s *Stub) GetStateByRange(startKey, endKey string) (shim.StateQueryIteratorInterface, error) {
+	if startKey == "" {
+		startKey = emptyKeySubstitute
+	}
+	return newStateIterator(rangeOf(s.ledger.state, startKey, endKey)), nil
+}
+
+// GetStateByRangeWithPagination returns a page of the committed simple keys in [startKey, endKey)
+func (s *Stub) GetStateByRangeWithPagination(startKey, endKey string, pageSize int32, bookmark string) (shim.StateQueryIteratorInterface, *pb.QueryResponseMetadata, error) {
+	if startKey == "" {
+		startKey = emptyKeySubstitute
+	}
+	kvs, metadata := paginate(rangeOf(s.ledger.state, startKey, endKey), pageSize, bookmark)
+	return newStateIterator(kvs), metadata, nil
+}
+
+// GetStateByPartialCompositeKey returns the committed composite keys starting with objectType and keys
+func (s *Stub) GetStateByPartialCompositeKey(objectType string, keys []string) (shim.StateQueryIteratorInterface, error) {
+	startKey, endKey, err := partialCompositeKeyRange(objectType, keys)
+	if err != nil {
+		return nil, err
+	}
+	return newStateIterator(rangeOf(s.ledger.state, startKey, endKey)), nil
+}
+
+// GetStateByPartialCompositeKeyWithPagination returns a page of the committed composite keys starting with objectType and keys
+func (s *Stub) GetStateByPartialCompositeKeyWithPagination(objectType string, keys []string, pageSize int32, bookmark string) (shim.StateQueryIteratorInterface, *pb.QueryResponseMetadata, error) {
+	startKey, endKey, err := partialCompositeKeyRange(objectType, keys)
+	if err != nil {
+		return nil, nil, err
+	}
+	kvs, metadata := paginate(rangeOf(s.ledger.state, startKey, endKey), pageSize, bookmark)
+	return newStateIterator(kvs), metadata, nil
+}
+
+// CreateCompositeKey combines objectType and attributes into a composite key
+func (s *Stub) CreateCompositeKey(objectType string, attributes []string) (string, error) {
+	return createCompositeKey(objectType, attributes)
+}
+
+// SplitCompositeKey splits a composite key into its objectType and attributes
+func (s *Stub) SplitCompositeKey(compositeKey string) (string, []string, error) {
+	return splitCompositeKey(compositeKey)
+}
+
+// GetQueryResult is not supported, like on a LevelDB state database
+func (s *Stub) GetQueryResult(query string) (shim.StateQueryIteratorInterface, error) {
+	return nil, errRichQueryNotSupported
+}
+
+// GetQueryResultWithPagination is not supported, like on a LevelDB state database
+func (s *Stub) GetQueryResultWithPagination(query string, pageSize int32, bookmark string) (shim.StateQueryIteratorInterface, *pb.QueryResponseMetadata, error) {
+	return nil, nil, errRichQueryNotSupported
+}
+
+// GetHistoryForKey returns the committed modifications of a key, from newest to oldest
+func (s *Stub) GetHistoryForKey(key string) (shim.HistoryQueryIteratorInterface, error) {
+	modifications := s.ledger.history[key]
+	newestFirst := make([]*queryresult.KeyModification, 0, len(modifications))
+	for i := len(modifications) - 1; i >= 0; i-- {
+		newestFirst = append(newestFirst, modifications[i])
+	}
+	return &historyIterator{modifications: newestFirst}, nil
+}
+
+// GetPrivateData returns the committed value of a key of a collection the peer's org is a member of
+func (s *Stub) GetPrivateData(collection, key string) ([]byte, error) {
+	err := s.checkMembership(collection)
+	if err != nil {
+		return nil, err
+	}
+	return s.ledger.private[collection][key], nil
+}
+
+// GetPrivateDataHash returns the hash of the committed value of a key of any collection
+func (s *Stub) GetPrivateDataHash(collection, key string) ([]byte, error) {
+	value := s.ledger.private[collection][key]
+	if value == nil {
+		return nil, nil
+	}
+	hash := sha256.Sum256(value)
+	return hash[:], nil
+}
+
+// PutPrivateData adds a key of a collection to the private write set
+func (s *Stub) PutPrivateData(collection string, key string, value []byte) error {
+	if key == "" {
+		return errors.New("key must not be an empty string")
+	}
+	if len(value) == 0 {
+		return errors.New("value must not be empty")
+	}
+	s.privateWritesOf(collection)[key] = append([]byte{}, value...)
+	return nil
+}
+
+// DelPrivateData adds the deletion of a key of a collection to the private write set
+func (s *Stub) DelPrivateData(collection, key string) error {
+	s.privateWritesOf(collection)[key] = nil
+	return nil
+}
+
+// SetPrivateDataValidationParameter sets the key-level endorsement policy of a private key
+func (s *Stub) SetPrivateDataValidationParameter(collection, key string, ep []byte) error {
+	if s.privateValidationWrites[collection] == nil {
+		s.privateValidationWrites[collection] = make(map[string][]byte)
+	}
+	s.privateValidationWrites[collection][key] = ep
+	return nil
+}
+
+// GetPrivateDataValidationParameter returns the committed key-level endorsement policy of a private key
+func (s *Stub) GetPrivateDataValidationParameter(collection, key string) ([]byte, error) {
+	return s.ledger.privateValidation[collection][key], nil
+}
+
+// GetPrivateDataByRange returns the committed simple keys in [startKey, endKey) of a collection
+func (s *Stub) GetPrivateDataByRange(collection, startKey, endKey string) (shim.StateQueryIteratorInterface, error) {
+	err := s.checkMembership(collection)
+	if err != nil {
+		return nil, err
+	}
+	if startKey == "" {
+		startKey = emptyKeySubstitute
+	}
+	return newStateIterator(rangeOf(s.ledger.private[collection], startKey, endKey)), nil
+}
+
+// GetPrivateDataByPartialCompositeKey returns the committed composite keys of a collection starting with objectType and keys
+func (s *Stub) GetPrivateDataByPartialCompositeKey(collection, objectType string, keys []string) (shim.StateQueryIteratorInterface, error) {
+	err := s.checkMembership(collection)
+	if err != nil {
+		return nil, err
+	}
+	startKey, endKey, err := partialCompositeKeyRange(objectType, keys)
+	if err != nil {
+		return nil, err
+	}
+	return newStateIterator(rangeOf(s.ledger.private[collection], startKey, endKey)), nil
+}
+
+// GetPrivateDataQueryResult is not supported, like on a LevelDB state database
+func (s *Stub) GetPrivateDataQueryResult(collection, query string) (shim.StateQueryIteratorInterface, error) {
+	return nil, errRichQueryNotSupported
+}
+
+// GetCreator returns the MSP ID of the peer's org, the fake has no serialized identities
+func (s *Stub) GetCreator() ([]byte, error) {
+	return []byte(s.peerMSPID), nil
+}
+
+// GetTransient returns the transient map of the proposal
+func (s *Stub) GetTransient() (map[string][]byte, error) {
+	return s.transient, nil
+}
+
+// GetBinding is not supported
+func (s *Stub) GetBinding() ([]byte, error) {
+	return nil, errors.New("binding is not supported")
+}
+
+// GetDecorations returns no decorations
+func (s *Stub) GetDecorations() map[string][]byte {
+	return nil
+}
+
+// GetSignedProposal is not supported
+func (s *Stub) GetSignedProposal() (*pb.SignedProposal, error) {
+	return nil, errors.New("signed proposal is not supported")
+}
+
+// GetTxTimestamp returns the timestamp of the transaction
+func (s *Stub) GetTxTimestamp() (*timestamp.Timestamp, error) {
+	return ptypes.TimestampProto(s.timestamp)
+}
+
+// SetEvent sets the event of the transaction, replacing any previously set event
+func (s *Stub) SetEvent(name string, payload []byte) error {
+	if name == "" {
+		return errors.New("event name can not be empty string")
+	}
+	s.event = &Event{TxID: s.txID, Name: name, Payload: payload}
+	return nil
+}
+
+func (s *Stub) checkMembership(collection string) error {
+	if !s.ledger.isMember(collection, s.peerMSPID) {
+		return fmt.Errorf("peer of org %s is not a member of collection %s", s.peerMSPID, collection)
+	}
+	return nil
+}
+
+func (s *Stub) privateWritesOf(collection string) map[string][]byte {
+	if s.privateWrites[collection] == nil {
+		s.privateWrites[collection] = make(map[string][]byte)
+	}
+	return s.privateWrites[collection]
+}
+
+func createCompositeKey(objectType string, attributes []string) (string, error) {
+	if err := validateCompositeKeyAttribute(objectType); err != nil {
+		return "", err
+	}
+	ck := compositeKeyNamespace + objectType + string(rune(minUnicodeRuneValue))
+	for _, att := range attributes {
+		if err := validateCompositeKeyAttribute(att); err != nil {
+			return "", err
+		}
+		ck += att + string(rune(minUnicodeRuneValue))
+	}
+	return ck, nil
+}
+
+func splitCompositeKey(compositeKey string) (string, []string, error) {
+	if !strings.HasPrefix(compositeKey, compositeKeyNamespace) {
+		return "", nil, fmt.Errorf("%q is not a composite key", compositeKey)
+	}
+	components := strings.Split(strings.TrimPrefix(compositeKey, compositeKeyNamespace), string(rune(minUnicodeRuneValue)))
+	if len(components) < 2 {
+		return "", nil, fmt.Errorf("%q is not a composite key", compositeKey)
+	}
+	// the last component is the empty string after the trailing delimiter
+	components = components[:len(components)-1]
+	return components[0], components[1:], nil
+}
+
+func validateCompositeKeyAttribute(str string) error {
+	if !utf8.ValidString(str) {
+		return fmt.Errorf("not a valid utf8 string: [%x]", str)
+	}
+	for index, runeValue := range str {
+		if runeValue == minUnicodeRuneValue || runeValue == maxUnicodeRuneValue {
+			return fmt.Errorf("input contains unicode %#U starting at position [%d]. %#U and %#U are not allowed in the input attribute of a composite key",
+				runeValue, index, minUnicodeRuneValue, maxUnicodeRuneValue)
+		}
+	}
+	return nil
+}
+
+func partialCompositeKeyRange(objectType string, keys []string) (string, string, error) {
+	partialKey, err := createCompositeKey(objectType, keys)
+	if err != nil {
+		return "", "", err
+	}
+	return partialKey, partialKey + string(rune(maxUnicodeRuneValue)), nil
+}
+
+// rangeOf returns the entries of data with a key in [startKey, endKey), sorted by key. An empty endKey is unbounded.
+func rangeOf(data map[string][]byte, startKey, endKey string) []*queryresult.KV {
+	var kvs []*queryresult.KV
+	for key, value := range data {
+		if key < startKey || (endKey != "" && key >= endKey) {
+			continue
+		}
+		kvs = append(kvs, &queryresult.KV{Key: key, Value: value})
+	}
+	sort.Slice(kvs, func(i, j int) bool { return kvs[i].Key < kvs[j].Key })
+	return kvs
+}
+
+// paginate returns the page of kvs starting at the key of the bookmark, the bookmark of the next page is its first key
+func paginate(kvs []*queryresult.KV, pageSize int32, bookmark string) ([]*queryresult.KV, *pb.QueryResponseMetadata) {
+	start := 0
+	if bookmark != "" {
+		start = sort.Search(len(kvs), func(i int) bool { return kvs[i].Key >= bookmark })
+	}
+	end := len(kvs)
+	if pageSize > 0 && start+int(pageSize) < end {
+		end = start + int(pageSize)
+	}
+
+	metadata := &pb.QueryResponseMetadata{FetchedRecordsCount: int32(end - start)}
+	if end < len(kvs) {
+		metadata.Bookmark = kvs[end].Key
+	}
+	return kvs[start:end], metadata
+}
+
+type stateIterator struct {
+	kvs []*queryresult.KV
+}
+
+func newStateIterator(kvs []*queryresult.KV) *stateIterator {
+	return &stateIterator{kvs: kvs}
+}
+
+func (it *stateIterator) HasNext() bool {
+	return len(it.kvs) > 0
+}
+
+func (it *stateIterator) Next() (*queryresult.KV, error) {
+	if len(it.kvs) == 0 {
+		return nil, errors.New("no more results")
+	}
+	next := it.kvs[0]
+	it.kvs = it.kvs[1:]
+	return next, nil
+}
+
+func (it *stateIterator) Close() error {
+	return nil
+}
+
+type historyIterator struct {
+	modifications []*queryresult.KeyModification
+}
+
+func (it *historyIterator) HasNext() bool {
+	return len(it.modifications) > 0
+}
+
+func (it *historyIterator) Next() (*queryresult.KeyModification, error) {
+	if len(it.modifications) == 0 {
+		return nil, errors.New("no more results")
+	}
+	next := it.modifications[0]
+	it.modifications = it.modifications[1:]
+	return next, nil
+}
+
+func (it *historyIterator) Close() error {
+	return nil
+}